@@ -0,0 +1,52 @@
+package fqueue
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func adviseDontNeed(b []byte) error {
+	return unix.Madvise(b, unix.MADV_DONTNEED)
+}
+
+func fadviseDontNeed(f *os.File, off, n int64) error {
+	return unix.Fadvise(int(f.Fd()), off, n, unix.FADV_DONTNEED)
+}
+
+// punchHole frees the blocks of the range. File systems that can't are
+// left alone.
+func punchHole(f *os.File, off, n int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, n)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		return nil
+	}
+
+	return err
+}
+
+// apply populates the mapping before use, falling back to read-ahead on
+// kernels older than 5.14. Huge pages are best effort. Locked pages are
+// unlocked again when the mapping is unmapped.
+func (a mapAdvice) apply(b []byte) error {
+	if a.lock {
+		if err := unix.Mlock(b); err != nil {
+			return err
+		}
+	}
+	if a.hugePages {
+		if err := unix.Madvise(b, unix.MADV_HUGEPAGE); err != nil && !errors.Is(err, unix.EINVAL) {
+			return err
+		}
+	}
+	if a.populate {
+		err := unix.Madvise(b, unix.MADV_POPULATE_WRITE)
+		if errors.Is(err, unix.EINVAL) {
+			err = unix.Madvise(b, unix.MADV_WILLNEED)
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package fqueue
+
+import "os"
+
+func adviseDontNeed(b []byte) error {
+	return nil
+}
+
+func fadviseDontNeed(f *os.File, off, n int64) error {
+	return nil
+}
+
+func punchHole(f *os.File, off, n int64) error {
+	return nil
+}
+
+func (a mapAdvice) apply(b []byte) error {
+	return nil
+}
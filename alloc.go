@@ -0,0 +1,142 @@
+package fqueue
+
+import "time"
+
+// circularAlloc is an Allocation filled in place in the mapped file. It
+// holds wlock from Alloc until it is committed or aborted.
+type circularAlloc struct {
+	q    *circularFileQueue
+	f    frame
+	at   uint32
+	done bool
+}
+
+// bufferedAlloc is an Allocation filled in a buffer and pushed on Commit,
+// used where the entry can't be written in place.
+type bufferedAlloc struct {
+	q    *circularFileQueue
+	buf  []byte
+	done bool
+}
+
+var (
+	_ Allocation = (*circularAlloc)(nil)
+	_ Allocation = (*bufferedAlloc)(nil)
+)
+
+// Alloc reserves room for an entry of n bytes, to be filled through the
+// returned Allocation, which must be committed or aborted as pushes wait
+// for it. With a memory-mapped or memory backend the
+// entry is encoded straight into the queue; otherwise, and with
+// interceptors, deduplication, blobs or an overflow queue set up, it is
+// buffered and pushed on Commit.
+func (q *circularFileQueue) Alloc(n int) (Allocation, error) {
+	if n < 0 || int64(n) > int64(lengthMask) {
+		return nil, &EntrySizeError{Size: uint32(n), Limit: lengthMask}
+	}
+	m, ok := q.s.(mappedBackend)
+	if !ok || len(q.opts.interceptors) > 0 || q.dedup != nil || q.opts.blobs || q.overflow != nil {
+		return &bufferedAlloc{q: q, buf: make([]byte, n)}, nil
+	}
+
+	q.wlock.Lock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	// The size stands in for the data until its place is known.
+	f := newFrame(Message{})
+	f.data, f.srcLen = nil, uint32(n)
+	if err := q.checkFrame(f); err != nil {
+		q.wlock.Unlock()
+		return nil, err
+	}
+	if err := q.reserveFrame(&f, ""); err != nil {
+		q.wlock.Unlock()
+		return nil, err
+	}
+
+	pos := q.advance(q.end, preLength+seqLength+timeLength)
+	if first := q.capacity - pos; first < f.srcLen {
+		f.filled = [][]byte{m.slice(int64(pos), int64(first)), m.slice(int64(headPos), int64(f.srcLen-first))}
+	} else {
+		f.filled = [][]byte{m.slice(int64(pos), int64(f.srcLen))}
+	}
+	f.srcLen = 0
+	q.writing = f.length()
+
+	return &circularAlloc{q: q, f: f, at: q.end}, nil
+}
+
+func (a *circularAlloc) Bufs() [][]byte {
+	return a.f.filled
+}
+
+func (a *circularAlloc) Commit() error {
+	if a.done {
+		return ErrAllocDone
+	}
+	a.done = true
+	q := a.q
+	defer q.observe(OpPush, time.Now())
+	gen, err := a.publish()
+	if err != nil {
+		return err
+	}
+
+	return q.durable(gen)
+}
+
+func (a *circularAlloc) publish() (uint64, error) {
+	q := a.q
+	defer q.wlock.Unlock()
+	m := q.s.(mappedBackend)
+	pos := q.advance(a.at, preLength+seqLength+timeLength)
+	for _, p := range a.f.filled {
+		m.touch(int64(pos), int64(len(p)))
+		pos = headPos
+	}
+	r := q.region("fqueue.write")
+	end, err := q.writeFrame(a.at, a.f)
+	r.End()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.writing = 0
+	if err != nil {
+		q.disk.give(uint64(a.f.length()))
+		return 0, err
+	}
+
+	return q.publish(a.f, end, "", "", time.Now(), EventPushed)
+}
+
+func (a *circularAlloc) Abort() {
+	if a.done {
+		return
+	}
+	a.done = true
+	q := a.q
+	q.lock.Lock()
+	q.writing = 0
+	if q.nextSeq == a.f.seq+1 {
+		q.nextSeq = a.f.seq
+	}
+	q.disk.give(uint64(a.f.length()))
+	q.lock.Unlock()
+	q.wlock.Unlock()
+}
+
+func (a *bufferedAlloc) Bufs() [][]byte {
+	return [][]byte{a.buf}
+}
+
+func (a *bufferedAlloc) Commit() error {
+	if a.done {
+		return ErrAllocDone
+	}
+	a.done = true
+
+	return a.q.Push(a.buf)
+}
+
+func (a *bufferedAlloc) Abort() {
+	a.done = true
+}
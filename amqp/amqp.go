@@ -0,0 +1,88 @@
+// Package amqp republishes entries spooled in a local queue to a RabbitMQ
+// exchange whenever the broker is reachable. It is written against the
+// small Publisher interface below rather than a particular client
+// library.
+package amqp
+
+import (
+	"context"
+	"time"
+
+	"fqueue"
+	"fqueue/internal/bridge"
+	"fqueue/internal/retry"
+)
+
+// Publisher publishes a message to an exchange on a channel in confirm
+// mode and returns once the broker has confirmed it. A nack is returned
+// as an error.
+type Publisher interface {
+	Publish(ctx context.Context, exchange, routingKey string, body []byte) error
+}
+
+type Option func(*options)
+
+type options struct {
+	bridge.Options
+	routingKey func(data []byte) string
+}
+
+func defaultOptions() options {
+	return options{Options: bridge.DefaultOptions()}
+}
+
+// WithBackoff sets the delay between retries, which starts at min and
+// doubles up to max. The default is 100ms to 30s.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.Backoff = retry.Backoff{Min: min, Max: max}
+	}
+}
+
+// WithRoutingKey derives the routing key from each entry. The empty key
+// is used by default.
+func WithRoutingKey(fn func(data []byte) string) Option {
+	return func(o *options) {
+		o.routingKey = fn
+	}
+}
+
+// WithErrorHandler is called with every failure that is going to be
+// retried.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *options) {
+		o.OnError = fn
+	}
+}
+
+// Forwarder publishes the entries of a queue to an exchange. Each entry is
+// reserved, published, and committed to the queue only once the broker
+// confirmed it, so entries are delivered at least once and in order.
+type Forwarder struct {
+	q        fqueue.Queue
+	p        Publisher
+	exchange string
+	opts     options
+}
+
+func NewForwarder(q fqueue.Queue, p Publisher, exchange string, opts ...Option) *Forwarder {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Forwarder{q: q, p: p, exchange: exchange, opts: o}
+}
+
+// Run publishes entries until ctx is done, retrying failed publishes
+// indefinitely. The entry being published when ctx is done is returned
+// to the queue.
+func (f *Forwarder) Run(ctx context.Context) error {
+	return bridge.Forward(ctx, f.q, f.opts.Options, func(ctx context.Context, data []byte) error {
+		var key string
+		if f.opts.routingKey != nil {
+			key = f.opts.routingKey(data)
+		}
+		return f.p.Publish(ctx, f.exchange, key, data)
+	})
+}
@@ -0,0 +1,272 @@
+package fqueue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const blobsExt = ".blobs"
+
+// blobs keeps the data of entries too large to be stored in the queue in
+// files of their own, in a directory next to it. The queue holds an entry
+// with blobFlag set whose data refers to the blob, see blobRef.
+type blobs struct {
+	dir  string
+	mode os.FileMode
+}
+
+// openBlobs returns the blobs in the directory at path, creating it if
+// create is set. Without the directory there are no blobs and nil is
+// returned.
+func openBlobs(path string, fresh, create bool, mode os.FileMode) (*blobs, error) {
+	if fresh {
+		if err := os.RemoveAll(path); err != nil {
+			return nil, err
+		}
+	}
+	if create {
+		if err := createDir(path, mode); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &blobs{dir: path, mode: mode}, nil
+}
+
+// write stores n bytes read from r in a new blob, synced to disk before
+// it is given its final name, and returns that name. The directory is
+// synced too, so an entry queued afterwards never outlives its blob.
+func (b *blobs) write(r io.Reader, n int64) (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	name := hex.EncodeToString(id)
+	if err := writeFileAtomic(filepath.Join(b.dir, name), r, n, b.mode); err != nil {
+		os.Remove(filepath.Join(b.dir, name))
+		return "", err
+	}
+
+	return name, nil
+}
+
+// size returns the size of the blob, for references that don't record it.
+func (b *blobs) size(name string) (int64, error) {
+	info, err := os.Stat(filepath.Join(b.dir, name))
+	if os.IsNotExist(err) {
+		return 0, ErrCorrupted
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+func (b *blobs) read(name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(b.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrCorrupted
+	}
+
+	return data, err
+}
+
+func (b *blobs) copyTo(w io.Writer, name string) (int64, error) {
+	file, err := os.Open(filepath.Join(b.dir, name))
+	if os.IsNotExist(err) {
+		return 0, ErrCorrupted
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(w, file)
+}
+
+func (b *blobs) remove(name string) error {
+	err := os.Remove(filepath.Join(b.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// prune removes the blobs that no entry refers to, left behind by a crash
+// between writing a blob and queueing its entry, or between consuming the
+// entry and removing the blob.
+func (b *blobs) prune(keep map[string]bool) error {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !keep[e.Name()] {
+			if err := os.Remove(filepath.Join(b.dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// blobRef returns the data of an entry stored in the blob name holding n
+// bytes: the name, a colon and n in decimal, so the size is known without
+// opening the blob.
+func blobRef(name string, n int64) []byte {
+	return []byte(name + ":" + strconv.FormatInt(n, 10))
+}
+
+// parseBlobRef returns the blob name and size in ref, or a size of -1 for
+// references made before sizes were recorded, which hold the name alone.
+func parseBlobRef(ref []byte) (string, int64) {
+	name, size, ok := strings.Cut(string(ref), ":")
+	if !ok {
+		return name, -1
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return name, -1
+	}
+
+	return name, n
+}
+
+// toBlob reports whether data of the given size goes to a blob rather than
+// into the queue.
+func (q *circularFileQueue) toBlob(size uint64) bool {
+	if !q.opts.blobs {
+		return false
+	}
+	if q.opts.blobThreshold > 0 && size > uint64(q.opts.blobThreshold) {
+		return true
+	}
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.wantsBlob(size)
+}
+
+// wantsBlob is toBlob for a caller holding the lock.
+func (q *circularFileQueue) wantsBlob(size uint64) bool {
+	if q.opts.blobThreshold > 0 && size > uint64(q.opts.blobThreshold) {
+		return true
+	}
+
+	return size > uint64(lengthMask) || q.checkFrame(frame{srcLen: uint32(size)}) != nil
+}
+
+// pushBlob stores n bytes read from r in a blob and queues an entry
+// referring to it.
+func (q *circularFileQueue) pushBlob(m Message, r io.Reader, n int64, key string) (uint64, error) {
+	if q.opts.maxEntrySize > 0 && n > int64(q.opts.maxEntrySize) {
+		return 0, &EntrySizeError{Size: uint32(n), Limit: q.opts.maxEntrySize}
+	}
+	if err := q.disk.take(uint64(n)); err != nil {
+		return 0, q.life.full(err)
+	}
+	if err := q.opts.budget.take(n); err != nil {
+		q.disk.give(uint64(n))
+		return 0, err
+	}
+	name, err := q.blobs.write(r, n)
+	if err != nil {
+		return 0, err
+	}
+	m.Data = blobRef(name, n)
+	f := newFrame(m)
+	f.flags |= blobFlag
+	gen, err := q.pushBack(f, m.Topic, key)
+	if err != nil || gen == 0 {
+		q.logError("fqueue: removing blob failed", q.blobs.remove(name))
+	}
+
+	return gen, err
+}
+
+// blobAt returns the name of the blob the entry at pos refers to, if any.
+func (q *circularFileQueue) blobAt(pos uint32) (string, bool, error) {
+	name, _, ok, err := q.blobRefAt(pos)
+
+	return name, ok, err
+}
+
+// blobRefAt returns the name and recorded size of the blob the entry at
+// pos refers to, if any, see parseBlobRef.
+func (q *circularFileQueue) blobRefAt(pos uint32) (string, int64, bool, error) {
+	_, flags, err := q.frameAt(pos)
+	if err != nil || flags&blobFlag == 0 {
+		return "", 0, false, err
+	}
+	var dataPos, dataLen uint32
+	if _, _, err := q.dataAt(pos, &dataPos, &dataLen); err != nil {
+		return "", 0, false, err
+	}
+	ref := make([]byte, dataLen)
+	if _, err := q.readRing(ref, dataPos); err != nil {
+		return "", 0, false, err
+	}
+	name, size := parseBlobRef(ref)
+
+	return name, size, true, nil
+}
+
+// dropBlobs marks the blobs of the entries at positions, which have just
+// been consumed, for removal once the header saying so is synced: until
+// then a crash brings the entries back, and their blobs must still be
+// there.
+func (q *circularFileQueue) dropBlobs(positions []*reservation) {
+	for _, r := range positions {
+		name, ok, err := q.blobAt(r.pos)
+		if ok {
+			q.dropped = append(q.dropped, name)
+		}
+		// Corrupt data skipped by resync is released as a whole.
+		if err != ErrCorrupted {
+			q.logError("fqueue: removing blob failed", err)
+		}
+	}
+}
+
+// removeDropped removes the blobs marked by dropBlobs, called once the
+// header has been synced. Those left by a crash before are pruned on open.
+func (q *circularFileQueue) removeDropped() {
+	for _, name := range q.dropped {
+		q.logError("fqueue: removing blob failed", q.blobs.remove(name))
+	}
+	q.dropped = nil
+}
+
+// pruneBlobs removes the blobs no queued entry refers to.
+func (q *circularFileQueue) pruneBlobs() error {
+	keep := make(map[string]bool)
+	pos := q.start
+	for i := uint32(0); i < q.count; i++ {
+		length, _, err := q.frameAt(pos)
+		if err != nil {
+			return err
+		}
+		name, ok, err := q.blobAt(pos)
+		if err != nil {
+			return err
+		}
+		if ok {
+			keep[name] = true
+		}
+		pos = q.advance(pos, preLength+length+sufLength)
+	}
+
+	return q.blobs.prune(keep)
+}
@@ -1,182 +1,961 @@
 package fqueue
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"os"
+	"path/filepath"
+	"runtime/pprof"
 	"sync"
-
-	"github.com/edsrzf/mmap-go"
+	"time"
 )
 
 type circularFileQueue struct {
-	file  *os.File
-	m     mmap.MMap
-	start uint32
-	end   uint32
-	count uint32
-	lock  sync.RWMutex
-	cond  *sync.Cond
+	name       string
+	opts       options
+	s          Backend
+	capacity   uint32
+	start      uint32
+	end        uint32
+	count      uint32
+	nextSeq    uint64
+	topics     map[string]uint32
+	topicBytes map[string]uint32
+	limiter    *limiter
+	aboveHWM   bool
+	dirty      int
+	done       chan struct{}
+	flushReset chan struct{}
+	flushing   bool
+	retaining  bool
+	pushGen    uint64
+	group      *groupSync
+	dedup      *dedupWindow
+	ledger     *ledger
+	cursors    *cursors
+	quarantine *quarantine
+	blobs      *blobs
+	dropped    []string
+	notify     *notifier
+	labels     pprof.LabelSet
+	advised    uint32
+	paused     bool
+	closing    bool
+	closed     bool
+	overflow   *circularFileQueue
+	spilled    bool
+	emptyWait  int
+	life       Lifetime
+	lock       sync.RWMutex
+	wlock      sync.Mutex
+	writing    uint32
+	headGen    uint64
+	headSlot   int
+	temp       *tempFile
+	kept       []uint32
+	disk       *diskBudget
+	cond       *sync.Cond
+	// line holds consumers blocked in waitReady in the order they
+	// started waiting; only the first waits on cond.
+	line []*sync.Cond
+
+	// read and unread describe entries not yet handed to a consumer;
+	// everything in [start, read) is in flight, see reserve.go.
+	read      uint32
+	unread    uint32
+	dead      uint32
+	inflight  []*reservation
+	redeliver []*reservation
+	tokens    map[Token]*reservation
+	nextToken Token
 }
 
 const (
-	startTagPos uint32 = 0
-	endTagPos   uint32 = 1 << 2
-	countTagPos uint32 = 1 << 4
-
-	headPos = countTagPos
-
-	maxFileSize uint32 = 5 * 1024 * 1024
-	preLength   uint32 = 4
-	tagLength   uint32 = 4
+	startTagPos     uint32 = 0
+	endTagPos       uint32 = 1 << 2
+	deadTagPos      uint32 = 1 << 3
+	capTagPos       uint32 = deadTagPos + tagLength
+	countTagPos     uint32 = 1 << 4
+	seqTagPos       uint32 = countTagPos + tagLength
+	magicTagPos            = seqTagPos + seqLength
+	versionTagPos          = magicTagPos + tagLength
+	pushedTagPos           = versionTagPos + tagLength
+	poppedTagPos           = pushedTagPos + seqLength
+	bytesTagPos            = poppedTagPos + seqLength
+	fullTagPos             = bytesTagPos + seqLength
+	compactedTagPos        = fullTagPos + seqLength
+	slotGenPos             = compactedTagPos + timeLength
+	slotSumPos             = slotGenPos + seqLength
+	slotLength             = slotSumPos + tagLength
+
+	// The header is kept in two slots written alternately, so a crash
+	// while one is rewritten leaves the other intact.
+	headPos = 2 * slotLength
+
+	queueMagic    uint32 = 0x46515545 // "FQUE"
+	formatVersion uint32 = 5
+
+	defaultCapacity uint32 = 5 * 1024 * 1024
+	preLength              = tagLength + markerLength
+	sufLength              = tagLength + crcLength
+	tagLength       uint32 = 4
+	seqLength       uint32 = 8
 )
 
 var _ Queue = (*circularFileQueue)(nil)
 
-func NewCircularFileQueue(name string) (Queue, error) {
-	res := &circularFileQueue{}
-	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0755)
+func NewCircularFileQueue(name string, opts ...Option) (Queue, error) {
+	q, err := newCircularFileQueue(name, opts...)
+	if err != nil {
+		return nil, &OpenError{Path: name, Err: err}
+	}
+	q.opts.logger.Info("fqueue: opened", "queue", name, "capacity", q.capacity, "entries", q.count)
+
+	return q, nil
+}
+
+func newCircularFileQueue(name string, opts ...Option) (*circularFileQueue, error) {
+	o, err := buildOptions(opts)
 	if err != nil {
 		return nil, err
 	}
-	if err := file.Truncate(int64(maxFileSize)); err != nil {
-		file.Close()
+	if o.createDir {
+		if err := createDir(filepath.Dir(name), o.mode); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, o.mode)
+	if err != nil {
 		return nil, err
 	}
-	res.file = file
-
-	m, err := mmap.Map(file, mmap.RDWR, 0)
+	fresh, err := checkFile(file, &o)
+	if err == nil && fresh {
+		// Make the new file's name durable along with its contents.
+		err = syncDir(filepath.Dir(name))
+	}
 	if err != nil {
 		file.Close()
 		return nil, err
 	}
-	res.m = m
 
-	res.start = binary.BigEndian.Uint32(m[startTagPos : startTagPos+tagLength])
-	res.end = binary.BigEndian.Uint32(m[endTagPos : endTagPos+tagLength])
-	res.count = binary.BigEndian.Uint32(m[countTagPos : countTagPos+tagLength])
-	if res.start == 0 {
-		res.start = countTagPos + tagLength
+	return openQueue(name, file, fresh, o)
+}
+
+func buildOptions(opts []Option) (options, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.capacity <= headPos+preLength+sufLength {
+		return o, ErrInvalidCapacity
 	}
-	if res.end == 0 {
-		res.end = countTagPos + tagLength
+	if o.overflow != nil {
+		if _, ok := unwrap(o.overflow); !ok {
+			return o, ErrInvalidQueue
+		}
 	}
 
-	if res.start > res.end {
-		return nil, ErrInvalidQueue
+	return o, nil
+}
+
+// openQueue sets up a queue on file, which checkFile has vetted, laying
+// it out first if fresh. It takes ownership of file.
+func openQueue(name string, file *os.File, fresh bool, o options) (*circularFileQueue, error) {
+	if fresh && o.diskReserve {
+		if _, err := checkDisk(filepath.Dir(name), o.diskHeadroom, uint64(o.capacity)); err != nil && err != errNoDiskFree {
+			file.Close()
+			return nil, err
+		}
+	}
+	if fresh {
+		if err := file.Truncate(int64(o.capacity)); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	s, err := openStorage(file, &o)
+	if err != nil {
+		file.Close()
+		return nil, err
 	}
 
+	res := &circularFileQueue{
+		name:     name,
+		opts:     o,
+		s:        s,
+		capacity: o.capacity,
+		labels:   pprof.Labels("fqueue", name),
+		tokens:   make(map[Token]*reservation),
+		disk:     newDiskBudget(filepath.Dir(name), &o),
+	}
+	res.resetTopics()
+	if fresh {
+		res.start, res.end, res.read, res.advised, res.nextSeq = headPos, headPos, headPos, headPos, 1
+		err = res.syncMeta()
+	} else {
+		err = res.load()
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if res.cursors, err = loadCursors(name+cursorsExt, fresh, o.mode); err != nil {
+		s.Close()
+		return nil, err
+	}
+	res.cursors.budget = o.budget
+	if res.quarantine, err = loadQuarantine(name+quarantineExt, fresh, o.mode); err != nil {
+		s.Close()
+		return nil, err
+	}
+	res.quarantine.budget = o.budget
+	if res.blobs, err = openBlobs(name+blobsExt, fresh, o.blobs, o.mode); err == nil && res.blobs != nil && !fresh {
+		err = res.pruneBlobs()
+	}
+	if err == nil && o.notify {
+		res.notify, err = openNotifier(name+notifyExt, o.mode)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	if o.ledgerSize > 0 {
+		if res.ledger, err = openLedger(name+ledgerExt, o.ledgerSize, fresh, o.mode); err != nil {
+			res.notify.Close()
+			s.Close()
+			return nil, err
+		}
+		if err := res.skipProcessed(); err != nil {
+			res.ledger.Close()
+			res.notify.Close()
+			s.Close()
+			return nil, err
+		}
+	}
 	res.cond = sync.NewCond(&res.lock)
+	if overflow, ok := unwrap(o.overflow); ok {
+		res.overflow, res.spilled = overflow, !overflow.IsEmpty()
+	}
+	res.limiter = newLimiter(o.popRate, o.popBurst)
+	res.checkWatermarks()
+	res.done = make(chan struct{})
+	res.group = newGroupSync(o.syncOnPush, o.syncWindow)
+	if o.dedupEntries > 0 || o.dedupWindow > 0 {
+		res.dedup = newDedupWindow(o.dedupEntries, o.dedupWindow)
+	}
+	res.flushReset = make(chan struct{}, 1)
+	res.startLoops()
+	if o.notify {
+		go res.watchNotify()
+	}
+	if o.scrubInterval > 0 {
+		go res.scrubLoop()
+	}
 
 	return res, nil
 }
 
+// checkFile reports whether file is a new queue that still has to be laid
+// out. For an existing one it checks the header describes a queue of
+// this format and size and takes the capacity from it, so WithCapacity
+// only applies to new queues. A file truncated to size on creation but
+// never given a header counts as new.
+func checkFile(file *os.File, o *options) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return true, nil
+	}
+	if size < int64(headPos) {
+		return false, &LayoutError{Reason: fmt.Sprintf("file of %d bytes is too small", size)}
+	}
+
+	buf := make([]byte, headPos)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		return false, err
+	}
+	if size == int64(o.capacity) && allZero(buf) {
+		return true, nil
+	}
+	i, _, ok := newestSlot(buf)
+	slot := slotIn(buf, i)
+	magic := binary.BigEndian.Uint32(slot[magicTagPos : magicTagPos+tagLength])
+	if magic != queueMagic {
+		return false, &LayoutError{Reason: fmt.Sprintf("bad magic number %#x", magic)}
+	}
+	if v := binary.BigEndian.Uint32(slot[versionTagPos : versionTagPos+tagLength]); v != formatVersion {
+		return false, &LayoutError{Reason: fmt.Sprintf("unsupported format version %d", v)}
+	}
+	if !ok {
+		return false, errNoHeader
+	}
+	capacity := binary.BigEndian.Uint32(slot[capTagPos : capTagPos+tagLength])
+	if int64(capacity) != size {
+		return false, &LayoutError{Reason: fmt.Sprintf("header capacity %d, file size %d", capacity, size)}
+	}
+	o.capacity = capacity
+
+	return false, nil
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// newestSlot returns the index of the header slot in buf with the
+// highest generation whose checksum matches, and that generation.
+func newestSlot(buf []byte) (int, uint64, bool) {
+	best, gen, ok := 0, uint64(0), false
+	for i := 0; i < 2; i++ {
+		if g, intact := slotGen(slotIn(buf, i)); intact && (!ok || g > gen) {
+			best, gen, ok = i, g, true
+		}
+	}
+
+	return best, gen, ok
+}
+
+// slotGen returns the generation of a header slot, and whether its
+// checksum matches.
+func slotGen(slot []byte) (uint64, bool) {
+	sum := binary.BigEndian.Uint32(slot[slotSumPos : slotSumPos+tagLength])
+	if sum != crc32.Checksum(slot[:slotSumPos], crcTable) {
+		return 0, false
+	}
+
+	return binary.BigEndian.Uint64(slot[slotGenPos : slotGenPos+seqLength]), true
+}
+
+func slotIn(buf []byte, i int) []byte {
+	return buf[uint32(i)*slotLength : uint32(i+1)*slotLength]
+}
+
+// seal stamps a header built by header with generation gen and its
+// checksum.
+func seal(buf []byte, gen uint64) {
+	binary.BigEndian.PutUint64(buf[slotGenPos:slotGenPos+seqLength], gen)
+	binary.BigEndian.PutUint32(buf[slotSumPos:slotSumPos+tagLength], crc32.Checksum(buf[:slotSumPos], crcTable))
+}
+
+func (q *circularFileQueue) load() error {
+	q.forget()
+	buf, slots, err := q.readSlots()
+	if err != nil {
+		return err
+	}
+	// The newest header may have been written just before a crash that
+	// lost entries it counts. The other slot, which Sync flushed last, is
+	// tried next. When the newest is unusable, the one in use can't be
+	// trusted to be current until no entry turns up that it can't reach.
+	err = errNoHeader
+	var marks []mark
+	for n, i := range slots {
+		if err = q.useHeader(buf, i); err == nil {
+			marks = append(marks, mark{start: q.start, count: q.count, nextSeq: q.nextSeq})
+			err = q.recover()
+		}
+		if err == nil && (n > 0 || len(slots) == 1 && !allZero(slotIn(buf, 1-i))) {
+			err = q.stale()
+		}
+		if !errors.Is(err, ErrInvalidQueue) && !errors.Is(err, ErrCorrupted) {
+			break
+		}
+	}
+	if errors.Is(err, ErrInvalidQueue) || errors.Is(err, ErrCorrupted) {
+		q.opts.logger.Warn("fqueue: header inconsistent with entries, rebuilding", "queue", q.name, "err", err)
+		err = q.rebuild(marks)
+	}
+	if err != nil {
+		return err
+	}
+	q.read = q.start
+	q.unread = q.count
+	q.advised = q.start
+
+	return nil
+}
+
+// readHeader loads the pointers and counters from the newest header and
+// checks they are in range.
+func (q *circularFileQueue) readHeader() error {
+	buf, slots, err := q.readSlots()
+	if err != nil {
+		return err
+	}
+	if len(slots) == 0 {
+		return errNoHeader
+	}
+
+	return q.useHeader(buf, slots[0])
+}
+
+// readSlots reads the header slots and returns them along with the
+// indexes of the intact ones, newest first.
+func (q *circularFileQueue) readSlots() ([]byte, []int, error) {
+	buf := make([]byte, headPos)
+	if _, err := q.s.ReadAt(buf, 0); err != nil {
+		return nil, nil, err
+	}
+	var slots []int
+	if i, _, ok := newestSlot(buf); ok {
+		slots = append(slots, i)
+		if _, ok := slotGen(slotIn(buf, 1-i)); ok {
+			slots = append(slots, 1-i)
+		}
+	}
+
+	return buf, slots, nil
+}
+
+// useHeader loads the pointers and counters from header slot i of buf
+// and checks they are in range. Writes then go to the other slot.
+func (q *circularFileQueue) useHeader(buf []byte, i int) error {
+	buf = slotIn(buf, i)
+	if gen, _ := slotGen(buf); gen > q.headGen {
+		q.headGen = gen
+	}
+	q.headSlot = i
+
+	q.start = binary.BigEndian.Uint32(buf[startTagPos : startTagPos+tagLength])
+	q.end = binary.BigEndian.Uint32(buf[endTagPos : endTagPos+tagLength])
+	q.count = binary.BigEndian.Uint32(buf[countTagPos : countTagPos+tagLength])
+	q.dead = binary.BigEndian.Uint32(buf[deadTagPos : deadTagPos+tagLength])
+	q.nextSeq = binary.BigEndian.Uint64(buf[seqTagPos : seqTagPos+seqLength])
+	q.life.get(buf)
+
+	switch {
+	case q.start < headPos || q.start >= q.capacity:
+		return &LayoutError{Reason: fmt.Sprintf("start %d outside data region", q.start)}
+	case q.end < headPos || q.end >= q.capacity:
+		return &LayoutError{Reason: fmt.Sprintf("end %d outside data region", q.end)}
+	case q.dead > q.count:
+		return &LayoutError{Reason: fmt.Sprintf("%d removed entries out of %d", q.dead, q.count)}
+	case q.nextSeq == 0:
+		return &LayoutError{Reason: "zero sequence number"}
+	}
+
+	return nil
+}
+
 func (q *circularFileQueue) IsEmpty() bool {
 	q.lock.RLock()
 	defer q.lock.RUnlock()
 
-	return q.count == 0
+	return q.deliverable() == 0
 }
 
 func (q *circularFileQueue) Size() int {
 	q.lock.RLock()
 	defer q.lock.RUnlock()
 
-	return int(q.count)
+	return int(q.deliverable())
 }
 
 func (q *circularFileQueue) Pop() []byte {
+	defer q.observe(OpPop, time.Now())
+	q.limiter.wait()
 	q.lock.Lock()
-	for q.count == 0 {
-		q.cond.Wait()
+	defer q.lock.Unlock()
+	if q.waitReady() != nil {
+		return nil
 	}
 
-	var length uint32
-	if maxFileSize-q.start >= preLength {
-		length = binary.BigEndian.Uint32(q.m[q.start : q.start+preLength])
-	} else {
-		buf := make([]byte, preLength)
-		copy(buf[:maxFileSize-q.start], q.m[q.start:])
-		copy(buf[maxFileSize-q.start:], q.m[headPos:headPos+(maxFileSize-q.start)])
-		length = binary.BigEndian.Uint32(buf)
+	r, m, err := q.next()
+	if err != nil {
+		q.logError("fqueue: pop failed", err)
+		return nil
 	}
+	q.logError("fqueue: persisting header failed", q.commit(r))
+
+	return m.Data
+}
+
+func (q *circularFileQueue) Push(data []byte) error {
+	return q.push(Message{Data: data})
+}
 
-	res := make([]byte, length)
-	if maxFileSize-q.start-preLength >= length {
-		copy(res, q.m[q.start+preLength:q.start+preLength+length])
-		q.start = q.start + preLength + length
+func (q *circularFileQueue) push(m Message) error {
+	defer q.observe(OpPush, time.Now())
+	// The key is taken before interceptors run, as they may not be
+	// deterministic.
+	key := q.dedupKey(m)
+	data, err := q.intercept(OpPush, m.Data)
+	if err != nil {
+		return err
+	}
+	m.Data = data
+	var gen uint64
+	if q.toBlob(uint64(len(data))) {
+		gen, err = q.pushBlob(m, bytes.NewReader(data), int64(len(data)), key)
 	} else {
-		copy(res[:maxFileSize-q.start-preLength], q.m[q.start+preLength:maxFileSize])
-		remain := length - (maxFileSize - q.start - preLength)
-		copy(res[maxFileSize-q.start-preLength:], q.m[headPos:headPos+remain])
-		q.start = headPos + remain
+		gen, err = q.pushBack(newFrame(m), m.Topic, key)
+	}
+	if err != nil {
+		return err
 	}
-	binary.BigEndian.PutUint32(q.m[startTagPos:startTagPos+tagLength], q.start)
 
-	q.count--
-	binary.BigEndian.PutUint32(q.m[countTagPos:countTagPos+tagLength], q.count)
+	return q.durable(gen)
+}
 
+// PushV queues the concatenation of parts as a single entry, writing the
+// parts straight into the file. With interceptors or deduplication set up
+// the parts are joined first, as those need the data in one piece, and
+// so are they with WithBlobs.
+func (q *circularFileQueue) PushV(parts ...[]byte) error {
+	if len(q.opts.interceptors) > 0 || q.dedup != nil || q.opts.blobs {
+		return q.Push(bytes.Join(parts, nil))
+	}
+	defer q.observe(OpPush, time.Now())
+	f := newFrame(Message{})
+	f.data = parts
+	gen, err := q.pushBack(f, "", "")
+	if err != nil {
+		return err
+	}
+
+	return q.durable(gen)
+}
+
+// pushBack appends f. Pushes take turns on wlock, so at most one entry is
+// being written past end at a time, and write it without holding lock,
+// so consumers aren't held up by the copy. Until it is done the space
+// counts as used and the entry is not visible.
+func (q *circularFileQueue) pushBack(f frame, topic, key string) (uint64, error) {
+	q.wlock.Lock()
+	defer q.wlock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return 0, ErrQueueClosed
+	}
+	now := time.Now()
+	if q.dedup.seen(key, now) {
+		q.opts.logger.Debug("fqueue: dropped duplicate", "queue", q.name)
+		return 0, nil
+	}
+	if err := q.checkFrame(f); err != nil {
+		return 0, err
+	}
+	if q.spills(f) {
+		return q.spill(f, topic, key, now)
+	}
+	if err := q.reserveFrame(&f, topic); err != nil {
+		return 0, err
+	}
+
+	at := q.end
+	q.writing = f.length()
 	q.lock.Unlock()
+	r := q.region("fqueue.write")
+	pos, err := q.writeFrame(at, f)
+	r.End()
+	q.lock.Lock()
+	q.writing = 0
+	if err != nil {
+		return 0, err
+	}
 
-	return res
+	return q.publish(f, pos, topic, key, now, EventPushed)
 }
 
-func (q *circularFileQueue) Push(data []byte) error {
+// appendFrame writes f at the end of the queue, reporting it as kind. The
+// caller must hold the lock, and no push may be writing.
+func (q *circularFileQueue) appendFrame(f frame, topic, key string, now time.Time, kind EventKind) (uint64, error) {
+	if err := q.reserveFrame(&f, topic); err != nil {
+		return 0, err
+	}
+	r := q.region("fqueue.write")
+	pos, err := q.writeFrame(q.end, f)
+	r.End()
+	if err != nil {
+		return 0, err
+	}
+
+	return q.publish(f, pos, topic, key, now, kind)
+}
+
+// reserveFrame checks f can be appended and gives it the next sequence
+// number.
+func (q *circularFileQueue) reserveFrame(f *frame, topic string) error {
+	if err := q.checkEntries(1); err != nil {
+		return q.life.full(err)
+	}
+	needLen := f.length()
+	if free := q.free(); needLen > free {
+		return q.life.full(&SpaceError{Needed: needLen, Available: free})
+	}
+	if err := q.checkQuota(topic, 1, needLen); err != nil {
+		return err
+	}
+	if err := q.disk.take(uint64(needLen)); err != nil {
+		return q.life.full(err)
+	}
+	f.seq = q.nextSeq
+	q.nextSeq++
+
+	return nil
+}
+
+// publish makes the entry f, written up to pos, visible and reports it as
+// kind.
+func (q *circularFileQueue) publish(f frame, pos uint32, topic, key string, now time.Time, kind EventKind) (uint64, error) {
+	q.end = pos
+	q.count++
+	q.unread++
+	q.trackTopic(topic, 1, f.length())
+	q.life.pushed(f)
+	q.emit(kind, f.seq, topic)
+	q.dedup.add(key, now)
+	q.pushGen++
+	if err := q.stateChanged(); err != nil {
+		return 0, err
+	}
+	if q.notify != nil {
+		q.logError("fqueue: signalling push failed", q.notify.signal())
+	}
+
+	q.cond.Broadcast()
+
+	return q.pushGen, nil
+}
+
+// PushFront queues data ahead of everything else, so it is the next entry
+// handed out. It is meant for requeueing work that failed transiently.
+// The entry still gets the next sequence number, so it is the one entry
+// whose sequence number is out of order with its position.
+func (q *circularFileQueue) PushFront(data []byte) error {
+	defer q.observe(OpPush, time.Now())
+	data, err := q.intercept(OpPush, data)
+	if err != nil {
+		return err
+	}
+	gen, err := q.pushFront(newFrame(Message{Data: data}))
+	if err != nil {
+		return err
+	}
+
+	return q.durable(gen)
+}
+
+func (q *circularFileQueue) pushFront(f frame) (uint64, error) {
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	needLen := preLength + uint32(len(data))
-	if needLen > maxFileSize-q.end+q.start-headPos {
-		return ErrNotEnoughSpace
+	if err := q.checkFrame(f); err != nil {
+		return 0, err
+	}
+	if err := q.checkEntries(1); err != nil {
+		return 0, q.life.full(err)
+	}
+	needLen := f.length()
+	// Entries in front of start take the place of popped ones.
+	q.forget()
+	if free := q.free(); needLen > free {
+		return 0, q.life.full(&SpaceError{Needed: needLen, Available: free})
+	}
+	if err := q.checkQuota("", 1, needLen); err != nil {
+		return 0, err
+	}
+	if err := q.disk.take(uint64(needLen)); err != nil {
+		return 0, q.life.full(err)
 	}
 
-	if maxFileSize-q.end >= needLen {
-		q.end = q.pushBackEnough(data)
-	} else {
-		q.end = q.pushBackNotEnough(data)
+	f.seq = q.nextSeq
+	pos := q.retreat(q.start, needLen)
+	r := q.region("fqueue.write")
+	_, err := q.writeFrame(pos, f)
+	r.End()
+	if err != nil {
+		return 0, err
 	}
-	binary.BigEndian.PutUint32(q.m[endTagPos:endTagPos+tagLength], q.end)
 
+	q.start = pos
+	q.nextSeq++
 	q.count++
-	binary.BigEndian.PutUint32(q.m[countTagPos:countTagPos+tagLength], q.count)
+	q.trackTopic("", 1, needLen)
+	q.life.pushed(f)
+	q.emit(EventPushed, f.seq, "")
+	if len(q.inflight) == 0 {
+		q.read = pos
+		q.unread++
+	} else {
+		r := &reservation{pos: pos, seq: f.seq}
+		q.inflight = append([]*reservation{r}, q.inflight...)
+		q.redeliver = append([]*reservation{r}, q.redeliver...)
+	}
+	q.pushGen++
+	if err := q.stateChanged(); err != nil {
+		return 0, err
+	}
+	// Unlike entries appended at the end, an entry in front of start
+	// can't be recovered from its framing.
+	if err := q.flushMeta(); err != nil {
+		return 0, err
+	}
+
+	q.cond.Broadcast()
+
+	return q.pushGen, nil
+}
+
+// RangeReverse calls fn for each queued entry, starting with the most
+// recently pushed one, until fn returns false. Entries are not consumed.
+func (q *circularFileQueue) RangeReverse(fn func(data []byte) bool) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
 
-	q.cond.Signal()
+	suf := make([]byte, sufLength)
+	pos := q.end
+	for i := uint32(0); i < q.count; i++ {
+		if _, err := q.readRing(suf, q.retreat(pos, sufLength)); err != nil {
+			return err
+		}
+		length := binary.BigEndian.Uint32(suf)
+		pos = q.retreat(pos, preLength+length&lengthMask+sufLength)
+		if length&deadFlag != 0 {
+			continue
+		}
+		m, _, err := q.deliver(pos, OpPeek)
+		if err != nil {
+			return err
+		}
+		if !fn(m.Data) {
+			return nil
+		}
+	}
 
 	return nil
 }
 
-func (q *circularFileQueue) pushBackEnough(data []byte) uint32 {
-	length := uint32(len(data))
-	binary.BigEndian.PutUint32(q.m[q.end:q.end+preLength], length)
-	copy(q.m[q.end+preLength:q.end+preLength+length], data)
+func (q *circularFileQueue) used() uint32 {
+	return q.usedBetween(q.start, q.end, q.count)
+}
+
+func (q *circularFileQueue) usedBetween(start, end, count uint32) uint32 {
+	switch {
+	case count == 0:
+		return 0
+	case end > start:
+		return end - start
+	default:
+		return q.capacity - headPos - (start - end)
+	}
+}
+
+func (q *circularFileQueue) free() uint32 {
+	return q.capacity - headPos - q.used() - q.writing - q.keptBytes()
+}
+
+func (q *circularFileQueue) advance(pos, n uint32) uint32 {
+	if q.capacity-pos > n {
+		return pos + n
+	}
+
+	return headPos + n - (q.capacity - pos)
+}
+
+func (q *circularFileQueue) retreat(pos, n uint32) uint32 {
+	if pos-headPos >= n {
+		return pos - n
+	}
+
+	return q.capacity - (n - (pos - headPos))
+}
+
+// readRing fills p from the data region starting at pos, continuing at
+// headPos when the end of the file is reached, and returns the position
+// just past the bytes read.
+func (q *circularFileQueue) readRing(p []byte, pos uint32) (uint32, error) {
+	n := uint32(len(p))
+	if q.capacity-pos > n {
+		_, err := q.s.ReadAt(p, int64(pos))
+		return pos + n, err
+	}
+
+	first := q.capacity - pos
+	if _, err := q.s.ReadAt(p[:first], int64(pos)); err != nil {
+		return pos, err
+	}
+	if _, err := q.s.ReadAt(p[first:], int64(headPos)); err != nil {
+		return pos, err
+	}
+
+	return headPos + n - first, nil
+}
+
+func (q *circularFileQueue) writeRing(p []byte, pos uint32) (uint32, error) {
+	n := uint32(len(p))
+	if q.capacity-pos > n {
+		_, err := q.s.WriteAt(p, int64(pos))
+		return pos + n, err
+	}
+
+	first := q.capacity - pos
+	if _, err := q.s.WriteAt(p[:first], int64(pos)); err != nil {
+		return pos, err
+	}
+	if _, err := q.s.WriteAt(p[first:], int64(headPos)); err != nil {
+		return pos, err
+	}
+
+	return headPos + n - first, nil
+}
+
+// stateChanged is called with the lock held after every change to the
+// queue's pointers or counters. The header is written once every
+// metaFlushEvery changes; entries pushed in between are recovered from
+// their framing on open, and entries consumed in between are delivered
+// again.
+func (q *circularFileQueue) stateChanged() error {
+	q.checkWatermarks()
+	q.dirty++
+	if q.dirty < q.opts.metaFlushEvery {
+		return nil
+	}
 
-	return q.end + preLength + length
+	return q.flushMeta()
 }
 
-func (q *circularFileQueue) pushBackNotEnough(data []byte) uint32 {
-	length := uint32(len(data))
-	if maxFileSize-q.end >= preLength {
-		binary.BigEndian.PutUint32(q.m[q.end:q.end+preLength], length)
-		copy(q.m[q.end+preLength:maxFileSize], data[:maxFileSize-q.end-preLength])
-		remain := length - (maxFileSize - q.end - preLength)
-		copy(q.m[headPos:headPos+remain], data[maxFileSize-q.end-preLength:])
+func (q *circularFileQueue) flushMeta() error {
+	if q.dirty == 0 {
+		return nil
+	}
+	q.dirty = 0
+
+	return q.writeMeta()
+}
+
+// flushLoop writes the header every metaFlushInterval until that is set
+// to zero. A send on flushReset makes it pick up a new interval.
+func (q *circularFileQueue) flushLoop() {
+	for {
+		q.lock.Lock()
+		interval := q.opts.metaFlushInterval
+		if interval <= 0 {
+			q.flushing = false
+			q.lock.Unlock()
+			return
+		}
+		q.lock.Unlock()
+
+		t := time.NewTimer(interval)
+		select {
+		case <-t.C:
+			q.lock.Lock()
+			if !q.closed {
+				q.logError("fqueue: persisting header failed", q.flushMeta())
+			}
+			q.lock.Unlock()
+		case <-q.flushReset:
+			t.Stop()
+		case <-q.done:
+			t.Stop()
+			return
+		}
+	}
+}
+
+// writeMeta writes the header to the slot other than headSlot, which
+// holds the header last flushed to disk. That one is left alone, so
+// however a crash tears the writes since, it can be fallen back on.
+func (q *circularFileQueue) writeMeta() error {
+	buf := q.header(q.start, q.end, q.capacity)
+	seal(buf, q.headGen+1)
+	_, err := q.s.WriteAt(buf, int64(1-q.headSlot)*int64(slotLength))
+	if err == nil {
+		q.headGen++
+	}
+
+	return err
+}
 
-		return headPos + remain
+// syncMeta writes the header and flushes the file, after which headSlot
+// moves to the slot just written.
+func (q *circularFileQueue) syncMeta() error {
+	q.dirty = 0
+	if err := q.writeMeta(); err != nil {
+		return err
+	}
+	if err := q.s.Sync(); err != nil {
+		return err
 	}
+	q.headSlot = 1 - q.headSlot
+	q.removeDropped()
 
-	buf := make([]byte, preLength)
-	binary.BigEndian.PutUint32(buf, length)
-	copy(q.m[q.end:maxFileSize], buf)
-	remain := preLength - (maxFileSize - q.end)
-	copy(q.m[headPos:headPos+remain], buf[maxFileSize-q.end:])
-	copy(q.m[headPos+remain:headPos+remain+length], data)
+	return nil
+}
 
-	return headPos + length + remain
+func (q *circularFileQueue) header(start, end, capacity uint32) []byte {
+	buf := make([]byte, slotLength)
+	binary.BigEndian.PutUint32(buf[startTagPos:startTagPos+tagLength], start)
+	binary.BigEndian.PutUint32(buf[endTagPos:endTagPos+tagLength], end)
+	binary.BigEndian.PutUint32(buf[deadTagPos:deadTagPos+tagLength], q.dead)
+	binary.BigEndian.PutUint32(buf[countTagPos:countTagPos+tagLength], q.count)
+	binary.BigEndian.PutUint64(buf[seqTagPos:seqTagPos+seqLength], q.nextSeq)
+	binary.BigEndian.PutUint32(buf[capTagPos:capTagPos+tagLength], capacity)
+	binary.BigEndian.PutUint32(buf[magicTagPos:magicTagPos+tagLength], queueMagic)
+	binary.BigEndian.PutUint32(buf[versionTagPos:versionTagPos+tagLength], formatVersion)
+	q.life.put(buf)
+
+	return buf
 }
 
+// Close flushes the header and closes the queue. Calls blocked waiting for
+// an entry return, and every call made afterwards fails with
+// ErrQueueClosed, or returns nothing if it has no error result. So do
+// pushes still waiting to be flushed with WithSyncOnPush. Calling Close
+// again, also after CloseDrain, fails with ErrQueueClosed.
 func (q *circularFileQueue) Close() error {
-	if err := q.m.Unmap(); err != nil {
-		q.file.Close()
+	q.lock.Lock()
+	closed := q.closed
+	q.closed = true
+	q.cond.Broadcast()
+	for _, c := range q.line {
+		c.Signal()
+	}
+	q.lock.Unlock()
+	if closed {
+		return ErrQueueClosed
+	}
+	close(q.done)
+	q.group.stop()
+	defer q.temp.remove()
+	// Pushes write the file holding wlock only, and readers hold lock,
+	// so both are kept until the file is closed.
+	q.wlock.Lock()
+	defer q.wlock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var err error
+	if len(q.dropped) > 0 {
+		err = q.syncMeta()
+	} else {
+		err = q.flushMeta()
+	}
+	if err != nil {
+		q.ledger.Close()
+		q.notify.Close()
+		q.s.Close()
 		return err
 	}
+	q.opts.logger.Info("fqueue: closed", "queue", q.name, "entries", q.count)
+	q.logError("fqueue: closing ledger failed", q.ledger.Close())
+	q.logError("fqueue: closing notification file failed", q.notify.Close())
 
-	return q.file.Close()
+	return q.s.Close()
 }
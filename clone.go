@@ -0,0 +1,162 @@
+package fqueue
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+)
+
+// Clone writes the entries still in the queue, in flight ones included,
+// to a new queue file at path, leaving out removed entries and free
+// space. The clone has the given capacity, or the queue's when it is
+// zero. Sequence numbers and lifetime counters carry over, as do the
+// blobs of entries stored in them; cursors, the ledger and quarantined
+// entries don't. The queue stays usable, but pushes and pops wait until
+// the clone is written and synced. Clone fails if path exists.
+func (q *circularFileQueue) Clone(path string, capacity uint32) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	if capacity == 0 {
+		capacity = q.capacity
+	}
+	if capacity <= headPos+preLength+sufLength {
+		return ErrInvalidCapacity
+	}
+	entries, used, err := q.live()
+	if err != nil {
+		return err
+	}
+	if avail := capacity - headPos; used > avail {
+		return &SpaceError{Needed: used, Available: avail}
+	}
+	if err := q.reserveDisk(filepath.Dir(path), capacity); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, q.opts.mode)
+	if err != nil {
+		return err
+	}
+	// Blobs go first, so the clone never refers to a missing one.
+	if err = q.cloneBlobs(path+blobsExt, entries); err == nil {
+		err = q.cloneEntries(file, capacity, entries)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		os.RemoveAll(path + blobsExt)
+	}
+
+	return err
+}
+
+// live returns the positions of the entries that are neither removed nor
+// committed, and the space they take.
+func (q *circularFileQueue) live() ([]uint32, uint32, error) {
+	committed := make(map[uint32]bool)
+	for _, r := range q.inflight {
+		if r.committed {
+			committed[r.pos] = true
+		}
+	}
+	var res []uint32
+	used := uint32(0)
+	pos := q.start
+	for i := uint32(0); i < q.count; i++ {
+		length, flags, err := q.frameAt(pos)
+		if err != nil {
+			return nil, 0, err
+		}
+		n := preLength + length + sufLength
+		if flags&deadFlag == 0 && !committed[pos] {
+			res = append(res, pos)
+			used += n
+		}
+		pos = q.advance(pos, n)
+	}
+
+	return res, used, nil
+}
+
+func (q *circularFileQueue) cloneBlobs(dir string, entries []uint32) error {
+	var b *blobs
+	for _, pos := range entries {
+		name, ok, err := q.blobAt(pos)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if q.blobs == nil {
+			return ErrCorrupted
+		}
+		if b == nil {
+			if b, err = openBlobs(dir, true, true, q.opts.mode); err != nil {
+				return err
+			}
+		}
+		file, err := os.OpenFile(filepath.Join(b.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, b.mode)
+		if err != nil {
+			return err
+		}
+		_, err = q.blobs.copyTo(file, name)
+		if err == nil {
+			err = file.Sync()
+		}
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if b == nil {
+		return nil
+	}
+
+	return syncDir(b.dir)
+}
+
+// cloneEntries lays out the entries at the front of file, sized to
+// capacity, with a header describing them, and syncs it.
+func (q *circularFileQueue) cloneEntries(file *os.File, capacity uint32, entries []uint32) error {
+	if err := file.Truncate(int64(capacity)); err != nil {
+		return err
+	}
+	s := newFileStorage(file)
+	off := headPos
+	for _, pos := range entries {
+		length, _, err := q.frameAt(pos)
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, preLength+length+sufLength)
+		if _, err := q.readRing(buf, pos); err != nil {
+			return err
+		}
+		if _, err := s.WriteAt(buf, int64(off)); err != nil {
+			return err
+		}
+		off += uint32(len(buf))
+	}
+	end := off
+	if end == capacity {
+		end = headPos
+	}
+	head := q.header(headPos, end, capacity)
+	binary.BigEndian.PutUint32(head[deadTagPos:], 0)
+	binary.BigEndian.PutUint32(head[countTagPos:], uint32(len(entries)))
+	seal(head, 1)
+	if _, err := s.WriteAt(head, 0); err != nil {
+		return err
+	}
+
+	return s.Sync()
+}
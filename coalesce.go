@@ -0,0 +1,110 @@
+package fqueue
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// Coalescer packs small entries into blocks of up to a given size, each
+// stored as a single queue entry, which saves the per-entry framing and
+// header write. Entries are only in the queue once their block is flushed,
+// either because it is full or by Flush. On the consuming side a block is
+// committed when its last entry has been handed out, so after a crash the
+// whole block is delivered again. A queue used through a Coalescer must
+// not be used directly.
+type Coalescer struct {
+	q    Queue
+	size int
+
+	pushLock sync.Mutex
+	block    []byte
+
+	popLock sync.Mutex
+	pending [][]byte
+	token   Token
+}
+
+func NewCoalescer(q Queue, blockSize int) *Coalescer {
+	return &Coalescer{q: q, size: blockSize}
+}
+
+// Push adds data to the current block, flushing the block first if data
+// doesn't fit in it. An entry larger than the block size gets a block of
+// its own.
+func (c *Coalescer) Push(data []byte) error {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+	n := binary.PutUvarint(make([]byte, binary.MaxVarintLen64), uint64(len(data))) + len(data)
+	if len(c.block) > 0 && len(c.block)+n > c.size {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+	c.block = binary.AppendUvarint(c.block, uint64(len(data)))
+	c.block = append(c.block, data...)
+	if len(c.block) >= c.size {
+		return c.flush()
+	}
+
+	return nil
+}
+
+// Flush pushes the current block to the queue, if it holds any entries.
+func (c *Coalescer) Flush() error {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+
+	return c.flush()
+}
+
+func (c *Coalescer) flush() error {
+	if len(c.block) == 0 {
+		return nil
+	}
+	if err := c.q.Push(c.block); err != nil {
+		return err
+	}
+	c.block = nil
+
+	return nil
+}
+
+// Pop blocks until an entry is available and returns it.
+func (c *Coalescer) Pop() []byte {
+	c.popLock.Lock()
+	defer c.popLock.Unlock()
+	if len(c.pending) == 0 {
+		block, token := c.q.Reserve()
+		if token == 0 {
+			return nil
+		}
+		c.pending, c.token = splitBlock(block), token
+	}
+
+	data := c.pending[0]
+	c.pending = c.pending[1:]
+	if len(c.pending) == 0 {
+		c.q.Commit(c.token)
+	}
+
+	return data
+}
+
+// splitBlock returns the entries packed in block. A block that can't be
+// decoded is returned as a single entry.
+func splitBlock(block []byte) [][]byte {
+	var res [][]byte
+	for buf := block; len(buf) > 0; {
+		n, k := binary.Uvarint(buf)
+		if k <= 0 || n > uint64(len(buf)-k) {
+			return [][]byte{block}
+		}
+		res = append(res, buf[k:k+int(n)])
+		buf = buf[k+int(n):]
+	}
+	if len(res) == 0 {
+		return [][]byte{block}
+	}
+
+	return res
+}
@@ -0,0 +1,108 @@
+package fqueue
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+// TypeHeader is the header Registry stores an entry's type name in.
+const TypeHeader = "fqueue-type"
+
+// Codec converts values of one type to entry data and back.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte) (any, error)
+}
+
+type jsonCodec struct {
+	typ reflect.Type
+}
+
+// JSONCodec returns a Codec storing values as JSON and decoding them into
+// new values of the type of sample. Pointers decode to pointers.
+func JSONCodec(sample any) Codec {
+	return jsonCodec{typ: reflect.TypeOf(sample)}
+}
+
+func (c jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (c jsonCodec) Unmarshal(data []byte) (any, error) {
+	typ, ptr := c.typ, c.typ.Kind() == reflect.Pointer
+	if ptr {
+		typ = typ.Elem()
+	}
+	v := reflect.New(typ)
+	if err := json.Unmarshal(data, v.Interface()); err != nil {
+		return nil, err
+	}
+	if ptr {
+		return v.Interface(), nil
+	}
+
+	return v.Elem().Interface(), nil
+}
+
+// Registry maps type names to codecs, so entries of different types, or
+// different versions of one, can share a queue. Encode tags each entry
+// with its type name in TypeHeader and Decode picks the codec by it.
+// Entries without the header, such as ones pushed with Push, use the
+// codec registered under the empty name.
+type Registry struct {
+	lock   sync.RWMutex
+	codecs map[string]Codec
+}
+
+func NewRegistry() *Registry {
+	return &Registry{codecs: make(map[string]Codec)}
+}
+
+// Register adds c under name, replacing any codec registered before.
+func (r *Registry) Register(name string, c Codec) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.codecs[name] = c
+}
+
+func (r *Registry) codec(name string) (Codec, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	c, ok := r.codecs[name]
+	if !ok {
+		return nil, &TypeError{Name: name}
+	}
+
+	return c, nil
+}
+
+// Encode marshals v with the codec registered under name into a Message
+// for PushMsg, tagged with name.
+func (r *Registry) Encode(name string, v any) (Message, error) {
+	c, err := r.codec(name)
+	if err != nil {
+		return Message{}, err
+	}
+	data, err := c.Marshal(v)
+	if err != nil {
+		return Message{}, err
+	}
+	m := Message{Data: data}
+	if name != "" {
+		m.Headers = map[string]string{TypeHeader: name}
+	}
+
+	return m, nil
+}
+
+// Decode unmarshals the data of m with the codec its type name is
+// registered under.
+func (r *Registry) Decode(m Message) (any, error) {
+	c, err := r.codec(m.Headers[TypeHeader])
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Unmarshal(m.Data)
+}
@@ -0,0 +1,76 @@
+package fqueue
+
+import "time"
+
+// Compact removes every queued entry that has a later queued entry with
+// the same key, keeping only the latest one per key, and returns how many
+// were removed. Entries for which key returns "" are always kept. Like
+// RemoveIf, the space is reclaimed once consumption reaches the removed
+// entries, and entries handed out by Reserve are not considered.
+func (q *circularFileQueue) Compact(key func(m Message) string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return 0
+	}
+
+	removed, err := q.compact(key)
+	q.logError("fqueue: compact failed", err)
+	q.life.Compacted = time.Now()
+	if removed == 0 {
+		q.logError("fqueue: persisting header failed", q.stateChanged())
+		return 0
+	}
+
+	q.dead += removed
+	q.logError("fqueue: compact failed", q.skipDead())
+	q.release()
+	q.logError("fqueue: persisting header failed", q.stateChanged())
+	q.opts.logger.Info("fqueue: compacted", "queue", q.name, "entries", removed)
+
+	return int(removed)
+}
+
+func (q *circularFileQueue) compact(key func(m Message) string) (uint32, error) {
+	type keyed struct {
+		pos   uint32
+		seq   uint64
+		key   string
+		topic string
+	}
+	var entries []keyed
+	latest := make(map[string]int)
+	pos := q.read
+	for i := uint32(0); i < q.unread; i++ {
+		length, flags, err := q.frameAt(pos)
+		if err != nil {
+			return 0, err
+		}
+		if flags&deadFlag == 0 {
+			m, _, err := q.deliver(pos, OpPeek)
+			if err != nil {
+				return 0, err
+			}
+			if k := key(m); k != "" {
+				latest[k] = len(entries)
+				entries = append(entries, keyed{pos: pos, seq: m.Seq, key: k, topic: m.Topic})
+			}
+		}
+		pos = q.advance(pos, preLength+length+sufLength)
+	}
+
+	removed := uint32(0)
+	for i, e := range entries {
+		if latest[e.key] == i {
+			continue
+		}
+		if err := q.markDead(e.pos); err != nil {
+			return removed, err
+		}
+		q.untrack(e.topic, e.pos)
+		q.emit(EventRemoved, e.seq, e.topic)
+		removed++
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,92 @@
+package fqueue
+
+import "errors"
+
+// corruptAt reports whether err means the data at the read position is
+// corrupt and should be skipped rather than returned.
+func (q *circularFileQueue) corruptAt(err error) bool {
+	return q.opts.skipCorrupt && errors.Is(err, ErrCorrupted)
+}
+
+// resync drops the corrupt bytes at the read position up to the next
+// intact frame, or up to end if there is none, treating the entries they
+// held as consumed. How many entries that was is worked out from those
+// still found between the new read position and end.
+func (q *circularFileQueue) resync() error {
+	from := q.read
+	total := q.usedBetween(q.read, q.end, q.unread)
+	skip, err := q.nextIntact(q.advance(from, 1), total-1)
+	if err != nil {
+		return err
+	}
+	skip++
+
+	pos, left := q.advance(from, skip), total-skip
+	// Topics are counted afresh, going back to the old counts on failure.
+	topics, sizes := q.topics, q.topicBytes
+	fail := func(err error) error {
+		q.topics, q.topicBytes = topics, sizes
+		return err
+	}
+	q.resetTopics()
+	for _, r := range q.inflight {
+		if !r.committed {
+			q.trackTopic(r.topic, 1, q.sizeAt(r.pos))
+		}
+	}
+	n, dead := uint32(0), uint32(0)
+	for left > 0 {
+		length, flags, ok, err := q.intactAt(pos, left)
+		if err != nil {
+			return fail(err)
+		}
+		if !ok {
+			off, err := q.nextIntact(pos, left)
+			if err != nil {
+				return fail(err)
+			}
+			pos, left = q.advance(pos, off), left-off
+			continue
+		}
+		if flags&deadFlag != 0 {
+			dead++
+		} else {
+			m, err := q.metaAt(pos)
+			if err != nil {
+				return fail(err)
+			}
+			q.trackTopic(m.Topic, 1, preLength+length+sufLength)
+		}
+		n++
+		pos, left = q.advance(pos, preLength+length+sufLength), left-(preLength+length+sufLength)
+	}
+	if n >= q.unread {
+		n = q.unread - 1
+	}
+
+	q.opts.logger.Warn("fqueue: skipped corrupt data", "queue", q.name, "pos", from, "bytes", skip, "entries", q.unread-n)
+	q.inflight = append(q.inflight, &reservation{pos: from, committed: true})
+	q.count -= q.unread - n - 1
+	q.read = q.advance(from, skip)
+	q.unread = n
+	q.dead = dead
+	q.release()
+	if q.opts.onCorrupt != nil {
+		q.opts.onCorrupt(from, skip)
+	}
+
+	return q.stateChanged()
+}
+
+// nextIntact returns the offset from pos of the first intact frame within
+// limit bytes, or limit if there is none.
+func (q *circularFileQueue) nextIntact(pos, limit uint32) (uint32, error) {
+	for off := uint32(0); off < limit; off++ {
+		_, _, ok, err := q.intactAt(q.advance(pos, off), limit-off)
+		if err != nil || ok {
+			return off, err
+		}
+	}
+
+	return limit, nil
+}
@@ -0,0 +1,102 @@
+package fqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sort"
+)
+
+const cursorsExt = ".cursors"
+
+// cursors holds the last sequence number each named consumer committed,
+// persisted in a file next to the queue that is rewritten on every
+// commit.
+type cursors struct {
+	path   string
+	mode   os.FileMode
+	budget budgetFunc
+	seqs   map[string]uint64
+}
+
+func loadCursors(path string, fresh bool, mode os.FileMode) (*cursors, error) {
+	c := &cursors{path: path, mode: mode, seqs: make(map[string]uint64)}
+	// A new queue file starts its sequence numbers over.
+	if fresh {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for len(buf) > 0 {
+		var name string
+		var seq uint64
+		if name, buf, err = readString(buf); err != nil {
+			return nil, err
+		}
+		if seq, buf, err = readUvarint(buf); err != nil {
+			return nil, err
+		}
+		c.seqs[name] = seq
+	}
+
+	return c, nil
+}
+
+func (c *cursors) save() error {
+	names := make([]string, 0, len(c.seqs))
+	for name := range c.seqs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf []byte
+	for _, name := range names {
+		buf = appendString(buf, name)
+		buf = binary.AppendUvarint(buf, c.seqs[name])
+	}
+	if err := c.budget.take(int64(len(buf))); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.path, bytes.NewReader(buf), int64(len(buf)), c.mode)
+}
+
+// CommitCursor records seq as the last entry processed by the consumer
+// named cursor, for it to pick up from after a restart.
+func (q *circularFileQueue) CommitCursor(cursor string, seq uint64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	old, ok := q.cursors.seqs[cursor]
+	q.cursors.seqs[cursor] = seq
+	if err := q.cursors.save(); err != nil {
+		if ok {
+			q.cursors.seqs[cursor] = old
+		} else {
+			delete(q.cursors.seqs, cursor)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// CursorSeq returns the sequence number last committed for cursor, if
+// any.
+func (q *circularFileQueue) CursorSeq(cursor string) (uint64, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	seq, ok := q.cursors.seqs[cursor]
+
+	return seq, ok
+}
@@ -0,0 +1,66 @@
+package fqueue
+
+import (
+	"crypto/sha256"
+	"time"
+)
+
+// dedupWindow remembers the keys of recent pushes, bounded by count, age
+// or both. Each key is in order at most once, so it can be dropped from
+// keys when it falls out of order.
+type dedupWindow struct {
+	entries int
+	window  time.Duration
+	keys    map[string]struct{}
+	order   []dedupEntry
+}
+
+type dedupEntry struct {
+	key  string
+	time time.Time
+}
+
+func newDedupWindow(entries int, window time.Duration) *dedupWindow {
+	return &dedupWindow{entries: entries, window: window, keys: make(map[string]struct{})}
+}
+
+func (q *circularFileQueue) dedupKey(m Message) string {
+	switch {
+	case q.dedup == nil:
+		return ""
+	case q.opts.dedupKey != nil:
+		return q.opts.dedupKey(m)
+	default:
+		sum := sha256.Sum256(m.Data)
+		return string(sum[:])
+	}
+}
+
+func (d *dedupWindow) seen(key string, now time.Time) bool {
+	if d == nil || key == "" {
+		return false
+	}
+	for len(d.order) > 0 && d.window > 0 && now.Sub(d.order[0].time) >= d.window {
+		d.drop()
+	}
+	_, ok := d.keys[key]
+
+	return ok
+}
+
+func (d *dedupWindow) add(key string, now time.Time) {
+	if d == nil || key == "" {
+		return
+	}
+	d.keys[key] = struct{}{}
+	d.order = append(d.order, dedupEntry{key: key, time: now})
+	if d.entries > 0 && len(d.order) > d.entries {
+		d.drop()
+	}
+}
+
+func (d *dedupWindow) drop() {
+	delete(d.keys, d.order[0].key)
+	d.order[0] = dedupEntry{}
+	d.order = d.order[1:]
+}
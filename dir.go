@@ -0,0 +1,62 @@
+package fqueue
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// dirMode adds search permission to mode wherever it grants read
+// permission.
+func dirMode(mode os.FileMode) os.FileMode {
+	return mode | mode&0444>>2
+}
+
+// createDir creates dir and its missing parents, syncing the parent of
+// each one created so they survive a crash.
+func createDir(dir string, mode os.FileMode) error {
+	if _, err := os.Stat(dir); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	parent := filepath.Dir(dir)
+	if parent != dir {
+		if err := createDir(parent, mode); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, dirMode(mode)); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	return syncDir(parent)
+}
+
+// writeFileAtomic writes n bytes read from r to path. They go to a
+// temporary file first, synced before it is renamed over path, and the
+// directory is synced last, so a crash leaves either the old file or the
+// whole new one.
+func writeFileAtomic(path string, r io.Reader, n int64, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.CopyN(file, r, n); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package fqueue
+
+// syncDir does nothing; directories can't be synced here.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package fqueue
+
+import "os"
+
+// syncDir flushes the entries of dir, so files just created in it keep
+// their names after a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,49 @@
+package fqueue
+
+import (
+	"errors"
+	"os"
+	"sort"
+)
+
+const maxDirtyRanges = 32
+
+var pageSize = int64(os.Getpagesize())
+
+var errNoRangeSync = errors.New("range sync not supported")
+
+// dirtyRanges records which page-aligned byte ranges of a mapping were
+// written since the last flush, so only those need to be synced. Ranges
+// are kept sorted and merged; past maxDirtyRanges they collapse into one.
+type dirtyRanges struct {
+	r [][2]int64
+}
+
+func (d *dirtyRanges) add(lo, hi int64) {
+	lo = lo / pageSize * pageSize
+	hi = (hi + pageSize - 1) / pageSize * pageSize
+
+	i := sort.Search(len(d.r), func(i int) bool { return d.r[i][1] >= lo })
+	j := i
+	for j < len(d.r) && d.r[j][0] <= hi {
+		if d.r[j][0] < lo {
+			lo = d.r[j][0]
+		}
+		if d.r[j][1] > hi {
+			hi = d.r[j][1]
+		}
+		j++
+	}
+	d.r = append(d.r[:i], append([][2]int64{{lo, hi}}, d.r[j:]...)...)
+
+	if len(d.r) > maxDirtyRanges {
+		d.r = [][2]int64{{d.r[0][0], d.r[len(d.r)-1][1]}}
+	}
+}
+
+func (d *dirtyRanges) take() [][2]int64 {
+	r := d.r
+	d.r = nil
+
+	return r
+}
@@ -0,0 +1,94 @@
+package fqueue
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// errNoDiskFree is returned by diskFree where free space can't be told.
+var errNoDiskFree = errors.New("free disk space unknown")
+
+// diskBudget keeps the file system holding a queue from filling up, see
+// WithDiskReserve. Finding the free space takes a system call, so writes
+// draw on a budget measured by the last check, as if every byte needed a
+// new block, and the space is only checked again once it runs out.
+type diskBudget struct {
+	lock     sync.Mutex
+	dir      string
+	headroom uint64
+	left     uint64
+}
+
+func newDiskBudget(dir string, o *options) *diskBudget {
+	if !o.diskReserve {
+		return nil
+	}
+
+	return &diskBudget{dir: dir, headroom: o.diskHeadroom}
+}
+
+// take draws n bytes about to be written from the budget, failing with
+// ErrDiskFull if they could take the free space below the headroom.
+func (b *diskBudget) take(n uint64) error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if n <= b.left {
+		b.left -= n
+		return nil
+	}
+	left, err := checkDisk(b.dir, b.headroom, n)
+	if err == errNoDiskFree {
+		b.left = math.MaxUint64
+		return nil
+	}
+	if err != nil {
+		b.left = 0
+		return err
+	}
+	b.left = left
+
+	return nil
+}
+
+// give returns n bytes drawn with take that weren't written after all.
+func (b *diskBudget) give(n uint64) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.left <= math.MaxUint64-n {
+		b.left += n
+	}
+}
+
+// checkDisk fails with ErrDiskFull unless the file system holding dir has
+// n bytes free beyond headroom, and returns how many more it has.
+func checkDisk(dir string, headroom, n uint64) (uint64, error) {
+	free, err := diskFree(dir)
+	if err != nil {
+		return 0, err
+	}
+	if free < headroom || free-headroom < n {
+		return 0, ErrDiskFull
+	}
+
+	return free - headroom - n, nil
+}
+
+// reserveDisk checks there is room for a new queue file of n bytes, for
+// Resize and Clone.
+func (q *circularFileQueue) reserveDisk(dir string, n uint32) error {
+	if !q.opts.diskReserve {
+		return nil
+	}
+	if _, err := checkDisk(dir, q.opts.diskHeadroom, uint64(n)); err != nil && err != errNoDiskFree {
+		return err
+	}
+
+	return nil
+}
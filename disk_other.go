@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package fqueue
+
+// diskFree can't tell the free space here, so WithDiskReserve has no
+// effect.
+func diskFree(dir string) (uint64, error) {
+	return 0, errNoDiskFree
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin
+
+package fqueue
+
+import "golang.org/x/sys/unix"
+
+// diskFree returns the bytes free for unprivileged use on the file system
+// holding dir.
+func diskFree(dir string) (uint64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,18 @@
+package fqueue
+
+import "golang.org/x/sys/windows"
+
+// diskFree returns the bytes free for the calling user on the volume
+// holding dir.
+func diskFree(dir string) (uint64, error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &free, nil, nil); err != nil {
+		return 0, err
+	}
+
+	return free, nil
+}
@@ -0,0 +1,120 @@
+package fqueue
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Dispatcher spreads entries over queues owned by individual workers.
+// Each worker pops from its own queue first and steals from the fullest
+// sibling when that one is empty, so a worker stuck on slow jobs doesn't
+// hold back the entries queued behind it. Entries must be pushed through
+// the Dispatcher for waiting workers to be woken up.
+type Dispatcher struct {
+	queues []Queue
+	lock   sync.Mutex
+	wake   chan struct{}
+	next   int
+}
+
+// NewDispatcher returns a Dispatcher over queues, where worker i owns
+// queues[i].
+func NewDispatcher(queues ...Queue) *Dispatcher {
+	return &Dispatcher{queues: queues, wake: make(chan struct{})}
+}
+
+// Queue returns the queue owned by the given worker.
+func (d *Dispatcher) Queue(worker int) Queue {
+	return d.queues[worker]
+}
+
+// Push adds data to the queue with the fewest entries, falling back to
+// the others in turn when it is out of space.
+func (d *Dispatcher) Push(data []byte) error {
+	return d.push(func(q Queue) error { return q.Push(data) })
+}
+
+func (d *Dispatcher) PushMsg(m Message) error {
+	return d.push(func(q Queue) error { return q.PushMsg(m) })
+}
+
+func (d *Dispatcher) push(push func(q Queue) error) error {
+	var err error
+	for _, q := range d.bySize(-1, false) {
+		if err = push(q); !errors.Is(err, ErrNotEnoughSpace) {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	close(d.wake)
+	d.wake = make(chan struct{})
+	d.lock.Unlock()
+
+	return nil
+}
+
+// Pop blocks until an entry is available to the given worker and returns
+// it, taking it from the worker's own queue if possible and otherwise from
+// the sibling with the most entries. It gives up when ctx is done.
+func (d *Dispatcher) Pop(ctx context.Context, worker int) ([]byte, error) {
+	for {
+		d.lock.Lock()
+		wake := d.wake
+		d.lock.Unlock()
+
+		if data, ok := d.queues[worker].TryPop(); ok {
+			return data, nil
+		}
+		for _, q := range d.bySize(worker, true) {
+			if data, ok := q.TryPop(); ok {
+				return data, nil
+			}
+		}
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// bySize returns the queues other than skip ordered by size, ties broken
+// round-robin so equally loaded queues share the pushes.
+func (d *Dispatcher) bySize(skip int, desc bool) []Queue {
+	d.lock.Lock()
+	first := d.next
+	d.next = (d.next + 1) % len(d.queues)
+	d.lock.Unlock()
+
+	type sized struct {
+		q    Queue
+		size int
+	}
+	res := make([]sized, 0, len(d.queues))
+	for n := range d.queues {
+		i := (first + n) % len(d.queues)
+		if i != skip {
+			res = append(res, sized{d.queues[i], d.queues[i].Size()})
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if desc {
+			return res[i].size > res[j].size
+		}
+		return res[i].size < res[j].size
+	})
+
+	qs := make([]Queue, len(res))
+	for i, s := range res {
+		qs[i] = s.q
+	}
+
+	return qs
+}
@@ -0,0 +1,129 @@
+package fqueue
+
+import (
+	"context"
+	"runtime/pprof"
+	"time"
+)
+
+// Drain pops entries until the queue is empty and returns them in order.
+// It does not wait for new entries and is not subject to WithPopRate,
+// which makes it suited to flushing the backlog on shutdown. Nothing is
+// handed out while the queue is paused, so Drain then returns at once.
+// When ctx is done Drain stops and returns the entries popped so far
+// along with ctx.Err(). The call runs with the queue's profiler labels
+// added to those of ctx.
+func (q *circularFileQueue) Drain(ctx context.Context) (res [][]byte, err error) {
+	pprof.Do(ctx, q.labels, func(ctx context.Context) {
+		res, err = q.drain(ctx)
+	})
+
+	return res, err
+}
+
+func (q *circularFileQueue) drain(ctx context.Context) ([][]byte, error) {
+	var res [][]byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		data, ok, err := q.drainOne()
+		if ok {
+			res = append(res, data)
+		}
+		if err != nil || !ok {
+			return res, err
+		}
+	}
+}
+
+// TryPop is Pop that returns false instead of waiting when no entry can be
+// handed out. Like Drain, it is not subject to WithPopRate.
+func (q *circularFileQueue) TryPop() ([]byte, bool) {
+	defer q.observe(OpPop, time.Now())
+	data, ok, err := q.drainOne()
+	if err != nil {
+		q.logError("fqueue: pop failed", err)
+	}
+
+	return data, ok
+}
+
+func (q *circularFileQueue) drainOne() ([]byte, bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return nil, false, ErrQueueClosed
+	}
+	if !q.available() {
+		return nil, false, nil
+	}
+
+	r, m, err := q.next()
+	if err == errNoEntry {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return m.Data, true, q.commit(r)
+}
+
+// CloseDrain stops accepting pushes, which fail with ErrClosing, waits for
+// consumers to take and commit every entry, then closes the queue. When
+// ctx is done first the queue is closed anyway, with entries left in it,
+// and ctx.Err() is returned.
+func (q *circularFileQueue) CloseDrain(ctx context.Context) error {
+	err := q.quiesce(ctx)
+	if cerr := q.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// quiesce stops accepting pushes and waits until no entries are left.
+func (q *circularFileQueue) quiesce(ctx context.Context) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	q.closing = true
+
+	return q.waitEmpty(ctx)
+}
+
+// WaitUntilEmpty blocks until consumers have taken and committed every
+// entry in the queue, or ctx is done. Unlike CloseDrain it leaves the
+// queue open, so entries pushed meanwhile have to be consumed as well.
+func (q *circularFileQueue) WaitUntilEmpty(ctx context.Context) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.emptyWait++
+	defer func() { q.emptyWait-- }()
+
+	return q.waitEmpty(ctx)
+}
+
+// waitEmpty waits until no entries are left. The caller must hold the
+// lock, and make release wake it up.
+func (q *circularFileQueue) waitEmpty(ctx context.Context) error {
+	if q.count == q.dead {
+		return nil
+	}
+	defer q.region("fqueue.wait").End()
+	defer q.wakeOnDone(ctx)()
+	for q.count > q.dead {
+		if q.closed {
+			return ErrQueueClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.cond.Wait()
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+package fqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// groupSync lets concurrent pushers share flushes: whoever finds no flush
+// in progress becomes the leader and flushes on behalf of every push made
+// before it started, while later pushers wait for the next round.
+type groupSync struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	on      bool
+	window  time.Duration
+	running bool
+	stopped bool
+	synced  uint64
+}
+
+func newGroupSync(on bool, window time.Duration) *groupSync {
+	g := &groupSync{on: on, window: window}
+	g.cond = sync.NewCond(&g.lock)
+
+	return g
+}
+
+// set turns syncing on push on or off. Pushes already waiting for a flush
+// still get it.
+func (g *groupSync) set(on bool, window time.Duration) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.on, g.window = on, window
+}
+
+// stop waits for the flush in progress, if any, and makes pushes still
+// waiting for one fail with ErrQueueClosed, so the file can be closed.
+func (g *groupSync) stop() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for g.running {
+		g.cond.Wait()
+	}
+	g.stopped = true
+	g.cond.Broadcast()
+}
+
+// Sync writes the header and flushes the queue file to disk. The lock is
+// held throughout, so the header isn't rewritten while it is flushed.
+func (q *circularFileQueue) Sync() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	return q.syncMeta()
+}
+
+// durable blocks until the push numbered gen has been flushed. It must be
+// called without the queue lock held.
+func (q *circularFileQueue) durable(gen uint64) error {
+	g := q.group
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if !g.on {
+		return nil
+	}
+	for g.synced < gen {
+		if g.running {
+			g.cond.Wait()
+			continue
+		}
+		if g.stopped {
+			return ErrQueueClosed
+		}
+
+		g.running = true
+		window := g.window
+		g.lock.Unlock()
+		if window > 0 {
+			time.Sleep(window)
+		}
+		q.lock.RLock()
+		target := q.pushGen
+		q.lock.RUnlock()
+		// Entries pushed so far are recoverable from their framing, so
+		// only the data has to reach the disk, not the header.
+		r := q.region("fqueue.sync")
+		err := q.s.Sync()
+		r.End()
+		g.lock.Lock()
+		g.running = false
+		if err == nil {
+			g.synced = target
+		}
+		g.cond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
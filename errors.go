@@ -0,0 +1,124 @@
+package fqueue
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidQueue    = errors.New("invalid queue")
+	ErrNotEnoughSpace  = errors.New("not enough space")
+	ErrInvalidCapacity = errors.New("invalid capacity")
+	ErrEntryTooLarge   = errors.New("entry too large")
+	ErrTxDone          = errors.New("transaction already committed or rolled back")
+	ErrUnknownToken    = errors.New("unknown or already settled token")
+	ErrCorrupted       = errors.New("corrupted entry")
+	ErrInvalidName     = errors.New("invalid queue name")
+	ErrBudgetExceeded  = errors.New("disk budget exceeded")
+	ErrManagerClosed   = errors.New("manager closed")
+	ErrNotRetained     = errors.New("entry not retained")
+	ErrQueueFull       = errors.New("queue full")
+	ErrClosing         = errors.New("queue closing")
+	ErrNotQuarantined  = errors.New("entry not quarantined")
+	ErrQuotaExceeded   = errors.New("topic quota exceeded")
+	ErrNotTemporary    = errors.New("queue not temporary")
+	ErrUnknownType     = errors.New("unknown entry type")
+	ErrAllocDone       = errors.New("allocation already committed or aborted")
+	ErrDiskFull        = errors.New("file system full")
+	ErrFixedOption     = errors.New("option can't be changed on an open queue")
+	ErrQueueClosed     = errors.New("queue closed")
+
+	errNoEntry  = errors.New("no entry")
+	errNoHeader = &LayoutError{Reason: "no header slot passes its checksum"}
+)
+
+// SpaceError is returned by Push when the entry does not fit in the free
+// space left in the queue. It matches ErrNotEnoughSpace.
+type SpaceError struct {
+	Needed    uint32
+	Available uint32
+}
+
+func (e *SpaceError) Error() string {
+	return fmt.Sprintf("%s: need %d bytes, %d available", ErrNotEnoughSpace, e.Needed, e.Available)
+}
+
+func (e *SpaceError) Is(target error) bool {
+	return target == ErrNotEnoughSpace
+}
+
+// BudgetError is returned when writing a blob or a file kept next to a
+// queue opened by a Manager would take its directory over budget. It
+// matches ErrBudgetExceeded, and ErrQuotaExceeded like the other limits
+// on what a queue may hold.
+type BudgetError struct {
+	Needed    int64
+	Available int64
+}
+
+func (e *BudgetError) Error() string {
+	return fmt.Sprintf("%s: need %d bytes, %d available", ErrBudgetExceeded, e.Needed, e.Available)
+}
+
+func (e *BudgetError) Is(target error) bool {
+	return target == ErrBudgetExceeded || target == ErrQuotaExceeded
+}
+
+// EntrySizeError is returned by Push when the entry exceeds the configured
+// maximum entry size or could never fit in the queue. It matches
+// ErrEntryTooLarge.
+type EntrySizeError struct {
+	Size  uint32
+	Limit uint32
+}
+
+func (e *EntrySizeError) Error() string {
+	return fmt.Sprintf("%s: %d bytes, limit %d", ErrEntryTooLarge, e.Size, e.Limit)
+}
+
+func (e *EntrySizeError) Is(target error) bool {
+	return target == ErrEntryTooLarge
+}
+
+// OpenError records the path of a queue that failed to open along with the
+// underlying cause.
+type OpenError struct {
+	Path string
+	Err  error
+}
+
+func (e *OpenError) Error() string {
+	return "fqueue: open " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *OpenError) Unwrap() error {
+	return e.Err
+}
+
+// LayoutError is returned when opening a file that is not a queue, or
+// whose header doesn't describe a usable one. It matches ErrInvalidQueue.
+type LayoutError struct {
+	Reason string
+}
+
+func (e *LayoutError) Error() string {
+	return ErrInvalidQueue.Error() + ": " + e.Reason
+}
+
+func (e *LayoutError) Is(target error) bool {
+	return target == ErrInvalidQueue
+}
+
+// TypeError is returned by Registry when no codec is registered under an
+// entry's type name. It matches ErrUnknownType.
+type TypeError struct {
+	Name string
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("%s %q", ErrUnknownType, e.Name)
+}
+
+func (e *TypeError) Is(target error) bool {
+	return target == ErrUnknownType
+}
@@ -0,0 +1,47 @@
+package fqueue
+
+import "time"
+
+// EventKind is the step in the life of an entry an Event records.
+type EventKind int
+
+const (
+	// EventPushed is emitted once an entry is in the queue.
+	EventPushed EventKind = iota
+	// EventDelivered is emitted each time an entry is handed to a
+	// consumer, so an entry that is redelivered has several.
+	EventDelivered
+	// EventAcked is emitted once an entry is consumed: when it is popped,
+	// or committed after Reserve.
+	EventAcked
+	// EventExpired is emitted for entries dropped by WithRetention.
+	EventExpired
+	// EventDeadLettered is emitted for entries that ran out of deliveries,
+	// see WithMaxDeliveries, or were quarantined.
+	EventDeadLettered
+	// EventRemoved is emitted for entries dropped without being consumed:
+	// by RemoveIf, TruncateBefore or Compact, on open because WithLedger
+	// recorded them as processed, and by PurgeQuarantined.
+	EventRemoved
+	// EventRefilled is emitted instead of EventPushed for entries moved
+	// back from the overflow queue, see WithOverflow, under the sequence
+	// number they get here.
+	EventRefilled
+)
+
+// Event is what WithEvents reports for an entry.
+type Event struct {
+	Kind  EventKind
+	Seq   uint64
+	Topic string
+	Time  time.Time
+}
+
+// emit reports an event for the entry seq. The caller must hold the
+// lock.
+func (q *circularFileQueue) emit(kind EventKind, seq uint64, topic string) {
+	if q.opts.events == nil {
+		return
+	}
+	q.opts.events(Event{Kind: kind, Seq: seq, Topic: topic, Time: time.Now()})
+}
@@ -0,0 +1,5 @@
+package fqueue
+
+// HeaderSize is the size of the header slots at the front of a queue
+// file, for tests that tamper with them.
+const HeaderSize = headPos
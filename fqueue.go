@@ -1,16 +1,96 @@
 package fqueue
 
-import "errors"
+import (
+	"context"
+	"io"
+	"time"
+)
 
 type Queue interface {
+	iterQueue
+
 	IsEmpty() bool
 	Size() int
 	Pop() []byte
+	TryPop() ([]byte, bool)
+	PopTo(w io.Writer) (int64, error)
 	Push(data []byte) error
+	PushV(parts ...[]byte) error
+	PushFrom(r io.Reader, n int64) error
+	Alloc(n int) (Allocation, error)
+	PushMsg(m Message) error
+	PopMsg() Message
+	PopTopic(topic string) Message
+	PopMatch(fn func(data []byte) bool, mode MatchMode) []byte
+	TopicCounts() map[string]int
+	PushFront(data []byte) error
+	RangeReverse(fn func(data []byte) bool) error
+	RemoveIf(fn func(data []byte) bool) int
+	Compact(key func(m Message) string) int
+	Begin() Tx
+	Reserve() ([]byte, Token)
+	ReserveContext(ctx context.Context) ([]byte, Token, error)
+	Commit(token Token) error
+	CommitCursor(cursor string, seq uint64) error
+	CursorSeq(cursor string) (uint64, bool)
+	Lag(cursor string) (Lag, bool)
+	Abort(token Token) error
+	Attempts(token Token) int
+	Quarantine(token Token, note string) error
+	Quarantined() []QuarantinedEntry
+	RequeueQuarantined(seq uint64) error
+	PurgeQuarantined(seq uint64) error
+	Stats() Stats
+	OldestAge() time.Duration
+	Sync() error
+	Refresh() error
+	Resize(capacity uint32) error
+	Reconfigure(opts ...Option) error
+	Clone(path string, capacity uint32) error
+	Persist(path string) error
+	Pause()
+	Resume()
+	Drain(ctx context.Context) ([][]byte, error)
+	Subscribe(ctx context.Context, handler Handler, opts ...SubscribeOption) error
+	PeekSize() (int, bool)
+	Get(seq uint64) ([]byte, error)
+	NewReplayCursor(fromSeq uint64) *ReplayCursor
+	Replay(n int) ([]Message, error)
+	TruncateBefore(seq uint64) (int, error)
+	Capacity() uint32
+	Free() uint32
+	IsFull() bool
+	Verify() (Report, error)
 	Close() error
+	CloseDrain(ctx context.Context) error
+	WaitUntilEmpty(ctx context.Context) error
 }
 
-var (
-	ErrInvalidQueue   = errors.New("invalid queue")
-	ErrNotEnoughSpace = errors.New("not enough space")
-)
+// Tx stages several operations on a queue so they become visible, and
+// durable, all at once on Commit. The queue is locked for other callers
+// until the transaction is committed or rolled back.
+type Tx interface {
+	Push(data []byte) error
+	// Pop returns the next entry that was queued when the transaction
+	// began, or false if there are none left. It never blocks, and
+	// returns false while consumers blocked before the transaction began
+	// are still waiting, as they come first.
+	Pop() ([]byte, bool)
+	Commit() error
+	Rollback() error
+}
+
+// Allocation is room for an entry of a known size, reserved by Alloc so
+// the entry can be encoded straight into the queue. Other pushes wait
+// until it is committed or aborted, so an Allocation must never be
+// dropped: one that is neither blocks every later push for good.
+// Deferring Abort, which does nothing after Commit, takes care of it.
+type Allocation interface {
+	// Bufs returns where the entry goes: one slice, or two when it wraps
+	// around the end of the file, to be filled in order.
+	Bufs() [][]byte
+	// Commit queues the entry as filled in.
+	Commit() error
+	// Abort gives the room back without queueing anything.
+	Abort()
+}
@@ -0,0 +1,644 @@
+package fqueue_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fqueue"
+	"fqueue/fqueuetest"
+)
+
+func TestConformance(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []fqueue.Option
+	}{
+		{"Mmap", nil},
+		{"FileIO", []fqueue.Option{fqueue.WithFileIO()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fqueuetest.Run(t, func(t *testing.T) fqueue.Queue {
+				q, err := fqueue.NewCircularFileQueue(filepath.Join(t.TempDir(), "queue"), tt.opts...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return q
+			})
+		})
+	}
+	t.Run("Fake", func(t *testing.T) {
+		fqueuetest.Run(t, func(t *testing.T) fqueue.Queue {
+			return fqueuetest.NewFake(0)
+		})
+	})
+}
+
+func TestCrash(t *testing.T) {
+	rounds := 200
+	if testing.Short() {
+		rounds = 20
+	}
+	t.Run("Mmap", func(t *testing.T) {
+		fqueuetest.RunCrash(t, rounds, fqueue.WithCapacity(4096))
+	})
+	t.Run("FileIO", func(t *testing.T) {
+		fqueuetest.RunCrash(t, rounds, fqueue.WithCapacity(4096), fqueue.WithFileIO())
+	})
+	t.Run("MetaFlush", func(t *testing.T) {
+		fqueuetest.RunCrash(t, rounds, fqueue.WithCapacity(4096), fqueue.WithMetaFlush(16, 0))
+	})
+	t.Run("Blobs", func(t *testing.T) {
+		fqueuetest.RunCrash(t, rounds, fqueue.WithCapacity(4096), fqueue.WithBlobs(100))
+	})
+}
+
+func TestBlobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+	opts := []fqueue.Option{fqueue.WithCapacity(4096), fqueue.WithBlobs(64)}
+	q, err := fqueue.NewCircularFileQueue(path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small := []byte("small")
+	large := bytes.Repeat([]byte("large"), 2000)
+	for _, data := range [][]byte{small, large, large[:100]} {
+		if err := q.Push(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data := q.Pop(); !bytes.Equal(data, small) {
+		t.Fatalf("Pop() = %.10q, want %q", data, small)
+	}
+	if n, ok := q.PeekSize(); !ok || n != len(large) {
+		t.Fatalf("PeekSize() = %d, %v, want %d, true", n, ok, len(large))
+	}
+	if data := q.Pop(); !bytes.Equal(data, large) {
+		t.Fatalf("Pop() = %.10q (%d bytes), want the large entry", data, len(data))
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = fqueue.NewCircularFileQueue(path, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if n, ok := q.PeekSize(); !ok || n != 100 {
+		t.Fatalf("PeekSize() after reopening = %d, %v, want 100, true", n, ok)
+	}
+	if data := q.Pop(); !bytes.Equal(data, large[:100]) {
+		t.Fatalf("Pop() after reopening = %.10q, want the blob entry", data)
+	}
+	if !q.IsEmpty() {
+		t.Fatal("queue not empty")
+	}
+}
+
+func TestResize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+	q, err := fqueue.NewCircularFileQueue(path, fqueue.WithCapacity(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { q.Close() }()
+	entry := func(i int) []byte {
+		return append([]byte(fmt.Sprint(i, ":")), make([]byte, 300)...)
+	}
+	// Push and pop until the entries wrap around the end of the file.
+	next, popped := 0, 0
+	for i := 0; i < 20; i++ {
+		for q.Push(entry(next)) == nil {
+			next++
+		}
+		for j := 0; j < 3; j++ {
+			if data := q.Pop(); !bytes.Equal(data, entry(popped)) {
+				t.Fatalf("Pop() = %.10q, want entry %d", data, popped)
+			}
+			popped++
+		}
+	}
+
+	var serr *fqueue.SpaceError
+	if err := q.Resize(1024); !errors.As(err, &serr) {
+		t.Fatalf("shrinking below the used space: %v, want a SpaceError", err)
+	}
+	if err := q.Resize(8192); err != nil {
+		t.Fatal(err)
+	}
+	if q.Capacity() != 8192 {
+		t.Fatalf("Capacity() = %d, want 8192", q.Capacity())
+	}
+	for q.Push(entry(next)) == nil {
+		next++
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if q, err = fqueue.NewCircularFileQueue(path); err != nil {
+		t.Fatal(err)
+	}
+	for ; popped < next; popped++ {
+		data, ok := q.TryPop()
+		if !ok || !bytes.Equal(data, entry(popped)) {
+			t.Fatalf("TryPop() after reopening = %.10q, %v, want entry %d", data, ok, popped)
+		}
+	}
+	if !q.IsEmpty() {
+		t.Fatal("queue not empty")
+	}
+}
+
+func TestCursorReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+	q, err := fqueue.NewCircularFileQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name string
+		seq  uint64
+	}{{"a", 3}, {"b", 7}, {"a", 5}} {
+		if err := q.CommitCursor(c.name, c.seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	q, err = fqueue.NewCircularFileQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for name, want := range map[string]uint64{"a": 5, "b": 7} {
+		if seq, ok := q.CursorSeq(name); !ok || seq != want {
+			t.Errorf("CursorSeq(%q) after reopening = %d, %v, want %d, true", name, seq, ok, want)
+		}
+	}
+	if seq, ok := q.CursorSeq("c"); ok {
+		t.Errorf("CursorSeq(%q) = %d, true for a cursor never committed", "c", seq)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	dir := t.TempDir()
+	key := func(m fqueue.Message) string { return m.Topic }
+	// Splitting the same entries twice puts every key in the same
+	// partition both times.
+	var first map[string]int
+	var src fqueue.Queue
+	for _, name := range []string{"a", "b"} {
+		var err error
+		src, err = fqueue.NewCircularFileQueue(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer src.Close()
+		for i := 0; i < 100; i++ {
+			m := fqueue.Message{Topic: fmt.Sprint("key", i%10), Data: []byte(fmt.Sprint(i))}
+			if err := src.PushMsg(m); err != nil {
+				t.Fatal(err)
+			}
+		}
+		parts, n, err := fqueue.Split(context.Background(), src, 3, key)
+		for _, q := range parts {
+			defer q.Close()
+		}
+		if err != nil || n != 100 {
+			t.Fatalf("Split() moved %d entries, %v, want 100", n, err)
+		}
+		if !src.IsEmpty() {
+			t.Fatal("source not empty after Split")
+		}
+
+		seen := make(map[string]int)
+		last := make(map[string]int)
+		for p, q := range parts {
+			for {
+				m, ok := popMsg(q)
+				if !ok {
+					break
+				}
+				if i, ok := seen[m.Topic]; ok && i != p {
+					t.Fatalf("key %q in partitions %d and %d", m.Topic, i, p)
+				}
+				seen[m.Topic] = p
+				var i int
+				fmt.Sscan(string(m.Data), &i)
+				if prev, ok := last[m.Topic]; ok && i < prev {
+					t.Fatalf("key %q: entry %d after %d", m.Topic, i, prev)
+				}
+				last[m.Topic] = i
+			}
+		}
+		if len(seen) != 10 {
+			t.Fatalf("%d keys recovered, want 10", len(seen))
+		}
+		if first == nil {
+			first = seen
+		} else {
+			for k, p := range seen {
+				if first[k] != p {
+					t.Fatalf("key %q in partition %d, was %d", k, p, first[k])
+				}
+			}
+		}
+	}
+
+	if _, _, err := fqueue.Split(context.Background(), src, 3, key); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("Split() over existing partitions: %v, want os.ErrExist", err)
+	}
+}
+
+// popMsg is PopMsg that doesn't block on an empty queue.
+func popMsg(q fqueue.Queue) (fqueue.Message, bool) {
+	if q.IsEmpty() {
+		return fqueue.Message{}, false
+	}
+
+	return q.PopMsg(), true
+}
+
+func TestManagerBudget(t *testing.T) {
+	m, err := fqueue.NewManager(t.TempDir(), 64*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	q, err := m.Open("blobs", fqueue.WithCapacity(4096), fqueue.WithBlobs(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 8*1024)
+	for i := 0; ; i++ {
+		err := q.Push(data)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, fqueue.ErrQuotaExceeded) || !errors.Is(err, fqueue.ErrBudgetExceeded) {
+			t.Fatalf("push %d: %v, want a BudgetError", i, err)
+		}
+		if i == 0 || i > 8 {
+			t.Fatalf("push %d over budget, want the budget to cover some but not all", i)
+		}
+		break
+	}
+	if used, err := m.Usage(); err != nil || used > 64*1024 {
+		t.Fatalf("Usage() = %d, %v, want at most the budget", used, err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+	open := func() fqueue.Queue {
+		q, err := fqueue.NewCircularFileQueue(path, fqueue.WithCapacity(4096))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	entry := func(i int) []byte {
+		return append([]byte(fmt.Sprint(i, ":")), make([]byte, 300)...)
+	}
+	q := open()
+	for i := 0; i < 5; i++ {
+		if err := q.Push(entry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := file[:fqueue.HeaderSize]
+
+	// Consume those and push enough to wrap, then put the old header
+	// back: it is intact, but contradicts the entries.
+	q = open()
+	for i := 0; i < 5; i++ {
+		if _, ok := q.TryPop(); !ok {
+			t.Fatalf("entry %d missing", i)
+		}
+	}
+	for i := 5; i < 13; i++ {
+		if err := q.Push(entry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt(stale, 0)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries consumed just before the queued ones may be delivered
+	// again, but those still queued come back in order.
+	q = open()
+	defer q.Close()
+	next := -1
+	for {
+		data, ok := q.TryPop()
+		if !ok {
+			break
+		}
+		var i int
+		fmt.Sscan(string(data), &i)
+		if next >= 0 && i != next {
+			t.Fatalf("recovered entry %d, want %d", i, next)
+		}
+		if next < 0 && i > 5 {
+			t.Fatalf("recovered entries start at %d, entry 5 lost", i)
+		}
+		if !bytes.Equal(data, entry(i)) {
+			t.Fatalf("entry %d recovered as %.10q", i, data)
+		}
+		next = i + 1
+	}
+	if next != 13 {
+		t.Fatalf("recovered entries end before %d, want 13", next)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+	q, err := fqueue.NewCircularFileQueue(path, fqueue.WithCapacity(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 0; i < 5; i++ {
+		if err := q.Push([]byte(fmt.Sprint("entry", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := q.Verify(); err != nil || !r.OK() || r.Entries != 5 {
+		t.Fatalf("Verify() = %+v, %v, want 5 intact entries", r, err)
+	}
+
+	// Damage the third entry behind the queue's back.
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := bytes.Index(file, []byte("entry2"))
+	if off < 0 {
+		t.Fatal("entry not found in the file")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("E"), int64(off))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := q.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.OK() || r.Entries != 2 || int(r.Offset) > off {
+		t.Fatalf("Verify() = %+v, want a problem with the third entry, before offset %d", r, off)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+	c := fqueuetest.NewCrasher(1)
+	q, err := fqueue.NewCircularFileQueue(path, fqueue.WithCapacity(4096), fqueue.WithBackend(c.Open))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 13; i++ {
+		if err := q.Push([]byte(fmt.Sprint("entry", i))); err != nil {
+			t.Fatal(err)
+		}
+		if i == 9 {
+			if err := q.Sync(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := c.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	reports := make(chan fqueue.Report, 1)
+	q, err = fqueue.NewCircularFileQueue(path, fqueue.WithScrub(time.Millisecond, func(r fqueue.Report) {
+		select {
+		case reports <- r:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if r := <-reports; !r.OK() || r.Entries < 10 {
+		t.Fatalf("scrub after crash: %+v, want at least the 10 synced entries intact", r)
+	}
+
+	file, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := bytes.Index(file, []byte("entry4"))
+	if off < 0 {
+		t.Fatal("entry not found in the file")
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("E"), int64(off))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case r := <-reports:
+			if r.OK() {
+				continue
+			}
+			if r.Entries != 4 {
+				t.Fatalf("scrub after damage: %+v, want a problem with the fifth entry", r)
+			}
+			return
+		case <-timeout:
+			t.Fatal("scrub didn't report the damaged entry")
+		}
+	}
+}
+
+func TestRetentionCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+	c := fqueuetest.NewCrasher(1)
+	q, err := fqueue.NewCircularFileQueue(path, fqueue.WithCapacity(4096), fqueue.WithBackend(c.Open), fqueue.WithRetention(500, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(i int) []byte {
+		return append([]byte(fmt.Sprint(i, ":")), make([]byte, 100)...)
+	}
+	for i := 0; i < 10; i++ {
+		if err := q.Push(entry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Size() == 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("retention dropped nothing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	kept := q.Size()
+	if err := q.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	// The entries retention dropped before the Sync stay dropped.
+	q, err = fqueue.NewCircularFileQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 10 - kept; i < 10; i++ {
+		if data, ok := q.TryPop(); !ok || !bytes.Equal(data, entry(i)) {
+			t.Fatalf("TryPop() after crash = %.10q, %v, want entry %d", data, ok, i)
+		}
+	}
+	if !q.IsEmpty() {
+		t.Fatal("entries dropped by retention came back")
+	}
+}
+
+func TestRemoveIfCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+	c := fqueuetest.NewCrasher(1)
+	q, err := fqueue.NewCircularFileQueue(path, fqueue.WithCapacity(4096), fqueue.WithBackend(c.Open))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := q.Push([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first entry goes too, so the space of removed entries at the
+	// head is reclaimed as well as removed ones marked in place.
+	if n := q.RemoveIf(func(data []byte) bool { return data[0]%2 == 0 }); n != 5 {
+		t.Fatalf("RemoveIf() = %d, want 5", n)
+	}
+	if err := q.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q, err = fqueue.NewCircularFileQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	for i := 1; i < 10; i += 2 {
+		if data, ok := q.TryPop(); !ok || data[0] != byte(i) {
+			t.Fatalf("TryPop() after crash = %v, %v, want entry %d", data, ok, i)
+		}
+	}
+	if !q.IsEmpty() {
+		t.Fatal("removed entries came back")
+	}
+}
+
+func TestResizeCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+	c := fqueuetest.NewCrasher(1)
+	q, err := fqueue.NewCircularFileQueue(path, fqueue.WithCapacity(4096), fqueue.WithBackend(c.Open))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := func(i int) []byte {
+		return append([]byte(fmt.Sprint(i, ":")), make([]byte, 300)...)
+	}
+	next := 0
+	for q.Push(entry(next)) == nil {
+		next++
+	}
+	if err := q.Resize(8192); err != nil {
+		t.Fatal(err)
+	}
+	// Entries pushed after the resize and synced survive with the rest;
+	// the one pushed after the Sync may or may not.
+	synced := next + 5
+	for ; next < synced; next++ {
+		if err := q.Push(entry(next)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push(entry(next)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q, err = fqueue.NewCircularFileQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if q.Capacity() != 8192 {
+		t.Fatalf("Capacity() after crash = %d, want 8192", q.Capacity())
+	}
+	for i := 0; i < synced; i++ {
+		if data, ok := q.TryPop(); !ok || !bytes.Equal(data, entry(i)) {
+			t.Fatalf("TryPop() after crash = %.10q, %v, want entry %d", data, ok, i)
+		}
+	}
+	if data, ok := q.TryPop(); ok && !bytes.Equal(data, entry(synced)) {
+		t.Fatalf("TryPop() after crash = %.10q, want the last entry or none", data)
+	}
+}
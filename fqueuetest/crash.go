@@ -0,0 +1,141 @@
+package fqueuetest
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+
+	"fqueue"
+)
+
+// ErrCrashed is returned by a Crasher's backend once Crash was called.
+var ErrCrashed = errors.New("fqueuetest: crashed")
+
+// Crasher simulates power failures under a queue. Used through
+// WithBackend, it keeps the file's contents in memory, with Sync making
+// them durable. Crash then writes the file as a crash could have left
+// it: everything synced, plus a random subset of the writes since, some
+// of them torn partway.
+type Crasher struct {
+	lock sync.Mutex
+	rand *rand.Rand
+	last *crashBackend
+}
+
+type crashBackend struct {
+	c       *Crasher
+	file    *os.File
+	mem     []byte
+	durable []byte
+	pending []write
+	crashed bool
+}
+
+type write struct {
+	off  int64
+	data []byte
+}
+
+// NewCrasher returns a Crasher whose choices of what a crash keeps are
+// determined by seed.
+func NewCrasher(seed int64) *Crasher {
+	return &Crasher{rand: rand.New(rand.NewSource(seed))}
+}
+
+// Open is a fqueue.BackendFunc. Crash applies to the backend opened
+// last, which is the queue's current one after a Resize.
+func (c *Crasher) Open(file *os.File, capacity int64) (fqueue.Backend, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	mem := make([]byte, capacity)
+	if _, err := file.ReadAt(mem, 0); err != nil {
+		return nil, err
+	}
+	c.last = &crashBackend{c: c, file: file, mem: mem, durable: append([]byte(nil), mem...)}
+
+	return c.last, nil
+}
+
+// Crash writes the file as a crash at this point could have left it.
+// Every later call on the backend fails with ErrCrashed; the queue should
+// still be closed to release the file.
+func (c *Crasher) Crash() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b := c.last
+	if b == nil || b.crashed {
+		return ErrCrashed
+	}
+	b.crashed = true
+	image := b.durable
+	for _, w := range b.pending {
+		switch c.rand.Intn(4) {
+		case 0:
+			// Lost.
+		case 1:
+			copy(image[w.off:], w.data[:c.rand.Intn(len(w.data)+1)])
+		default:
+			copy(image[w.off:], w.data)
+		}
+	}
+	_, err := b.file.WriteAt(image, 0)
+
+	return err
+}
+
+func (b *crashBackend) ReadAt(p []byte, off int64) (int, error) {
+	b.c.lock.Lock()
+	defer b.c.lock.Unlock()
+	if b.crashed {
+		return 0, ErrCrashed
+	}
+
+	return copy(p, b.mem[off:]), nil
+}
+
+func (b *crashBackend) WriteAt(p []byte, off int64) (int, error) {
+	b.c.lock.Lock()
+	defer b.c.lock.Unlock()
+	if b.crashed {
+		return 0, ErrCrashed
+	}
+	copy(b.mem[off:], p)
+	b.pending = append(b.pending, write{off: off, data: append([]byte(nil), p...)})
+
+	return len(p), nil
+}
+
+func (b *crashBackend) Sync() error {
+	b.c.lock.Lock()
+	defer b.c.lock.Unlock()
+	if b.crashed {
+		return ErrCrashed
+	}
+	copy(b.durable, b.mem)
+	b.pending = nil
+
+	return nil
+}
+
+func (b *crashBackend) Release(off, n int64) error {
+	return nil
+}
+
+// Close writes out everything written, as a clean shutdown would, unless
+// the backend crashed.
+func (b *crashBackend) Close() error {
+	b.c.lock.Lock()
+	defer b.c.lock.Unlock()
+	var err error
+	if !b.crashed {
+		_, err = b.file.WriteAt(b.mem, 0)
+	}
+	if cerr := b.file.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
@@ -0,0 +1,1115 @@
+package fqueuetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"fqueue"
+)
+
+// Fake is an in-memory Queue for unit tests of code that pushes to or pops
+// from one. Entries are kept in a slice, so no file is involved, and calls
+// only block where the real queue's would: Pop, PopMsg, PopTopic,
+// PopMatch, PopTo and Reserve while no entry is available, and
+// transactions while another is open, until Close. FailNext makes the
+// next calls of a method fail, and every call is recorded for Calls.
+//
+// Consumed entries are kept for Get and Replay until TruncateBefore drops
+// them. Methods that need a file fail with ErrUnsupported, and
+// NewReplayCursor returns a nil cursor, which has nothing to replay.
+type Fake struct {
+	lock        sync.Mutex
+	cond        *sync.Cond
+	capacity    uint32
+	used        uint32
+	entries     []fqueue.Message
+	tokens      map[fqueue.Token]fqueue.Message
+	attempts    map[uint64]int
+	consumed    []fqueue.Message
+	quarantined []fqueue.QuarantinedEntry
+	cursors     map[string]uint64
+	life        fqueue.Lifetime
+	nextSeq     uint64
+	nextToken   fqueue.Token
+	paused      bool
+	closing     bool
+	closed      bool
+	blocked     int
+	fail        map[string][]error
+	calls       []Call
+}
+
+var _ fqueue.Queue = (*Fake)(nil)
+
+var (
+	// ErrUnsupported is returned by the methods of Fake that need a
+	// queue file, such as Clone.
+	ErrUnsupported = errors.New("fqueuetest: not supported by Fake")
+
+	// errEmpty is what take fails with when no entry can be handed out.
+	errEmpty = errors.New("fqueuetest: no entry")
+)
+
+// Call is a call made on a Fake. Calls on a transaction are recorded
+// with methods named "Tx.Push", "Tx.Pop", "Tx.Commit" and "Tx.Rollback".
+type Call struct {
+	Method string
+	// Data is the entry pushed or handed out, if any.
+	Data  []byte
+	Token fqueue.Token
+	Err   error
+}
+
+// NewFake returns an empty Fake that holds up to capacity bytes of entry
+// data, or any amount if capacity is zero. Pushes that don't fit fail
+// with a *fqueue.SpaceError.
+func NewFake(capacity uint32) *Fake {
+	f := &Fake{
+		capacity: capacity,
+		tokens:   make(map[fqueue.Token]fqueue.Message),
+		attempts: make(map[uint64]int),
+		cursors:  make(map[string]uint64),
+		nextSeq:  1,
+		fail:     make(map[string][]error),
+	}
+	f.cond = sync.NewCond(&f.lock)
+
+	return f
+}
+
+// FailNext makes the next len(errs) calls of the named method, such as
+// "Push", fail with errs in turn. Methods without an error result return
+// what the real queue does on failure instead: Pop a nil entry, Reserve a
+// zero token.
+func (f *Fake) FailNext(method string, errs ...error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.fail[method] = append(f.fail[method], errs...)
+}
+
+// Calls returns the calls made so far, in order.
+func (f *Fake) Calls() []Call {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]Call(nil), f.calls...)
+}
+
+// WaitBlocked waits until n callers are blocked waiting for an entry, so a
+// test can push knowing who is waiting for it.
+func (f *Fake) WaitBlocked(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for f.blocked < n {
+		f.cond.Wait()
+	}
+}
+
+// failing takes the error set up for the next call of method, if any. The
+// caller must hold the lock.
+func (f *Fake) failing(method string) error {
+	errs := f.fail[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	f.fail[method] = errs[1:]
+
+	return errs[0]
+}
+
+// usable takes the error set up for the next call of method, like
+// failing, or returns fqueue.ErrQueueClosed once the fake is closed. The
+// caller must hold the lock.
+func (f *Fake) usable(method string) error {
+	if err := f.failing(method); err != nil {
+		return err
+	}
+	if f.closed {
+		return fqueue.ErrQueueClosed
+	}
+
+	return nil
+}
+
+func (f *Fake) record(method string, data []byte, token fqueue.Token, err error) {
+	f.calls = append(f.calls, Call{Method: method, Data: data, Token: token, Err: err})
+}
+
+// check runs the checks common to every push of n bytes. The caller must
+// hold the lock.
+func (f *Fake) check(method string, n uint32) error {
+	err := f.failing(method)
+	switch {
+	case err != nil:
+	case f.closed:
+		err = fqueue.ErrQueueClosed
+	case f.closing:
+		err = fqueue.ErrClosing
+	case f.capacity > 0 && n > f.capacity-f.used:
+		f.life.Full++
+		err = &fqueue.SpaceError{Needed: n, Available: f.capacity - f.used}
+	}
+
+	return err
+}
+
+// add gives m the next sequence number and queues it, in front with
+// front. The caller must hold the lock and have checked m fits.
+func (f *Fake) add(m fqueue.Message, front bool) {
+	m.Seq, m.Time = f.nextSeq, time.Now()
+	f.nextSeq++
+	f.used += uint32(len(m.Data))
+	f.life.Pushed++
+	f.life.Bytes += uint64(len(m.Data))
+	if front {
+		f.entries = append([]fqueue.Message{m}, f.entries...)
+	} else {
+		f.entries = append(f.entries, m)
+	}
+	f.cond.Broadcast()
+}
+
+func (f *Fake) push(method string, m fqueue.Message, front bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.check(method, uint32(len(m.Data)))
+	if err == nil {
+		f.add(m, front)
+	}
+	f.record(method, m.Data, 0, err)
+
+	return err
+}
+
+func (f *Fake) Push(data []byte) error {
+	return f.push("Push", fqueue.Message{Data: data}, false)
+}
+
+func (f *Fake) PushV(parts ...[]byte) error {
+	return f.push("PushV", fqueue.Message{Data: bytes.Join(parts, nil)}, false)
+}
+
+func (f *Fake) PushMsg(m fqueue.Message) error {
+	return f.push("PushMsg", m, false)
+}
+
+func (f *Fake) PushFront(data []byte) error {
+	return f.push("PushFront", fqueue.Message{Data: data}, true)
+}
+
+// PushFrom reads n bytes from r and pushes them. If r fails or ends early
+// nothing is queued.
+func (f *Fake) PushFrom(r io.Reader, n int64) error {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.record("PushFrom", nil, 0, err)
+		return err
+	}
+
+	return f.push("PushFrom", fqueue.Message{Data: data}, false)
+}
+
+// Alloc returns room for n bytes in a buffer that Commit pushes. The
+// call is recorded, and FailNext takes effect, on Commit.
+func (f *Fake) Alloc(n int) (fqueue.Allocation, error) {
+	return &fakeAlloc{f: f, buf: make([]byte, n)}, nil
+}
+
+type fakeAlloc struct {
+	f    *Fake
+	buf  []byte
+	done bool
+}
+
+func (a *fakeAlloc) Bufs() [][]byte {
+	return [][]byte{a.buf}
+}
+
+func (a *fakeAlloc) Commit() error {
+	if a.done {
+		return fqueue.ErrAllocDone
+	}
+	a.done = true
+
+	return a.f.push("Alloc", fqueue.Message{Data: a.buf}, false)
+}
+
+func (a *fakeAlloc) Abort() {
+	a.done = true
+}
+
+// wakeOnDone wakes every waiter once ctx is done, so waits can check
+// ctx.Err() after each wake-up. The returned func stops watching; it may
+// be called with the lock held.
+func (f *Fake) wakeOnDone(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.lock.Lock()
+			f.cond.Broadcast()
+			f.lock.Unlock()
+		case <-stop:
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+// first picks the entry to hand out: the first one, if there is any.
+func (f *Fake) first() int {
+	if len(f.entries) == 0 {
+		return -1
+	}
+
+	return 0
+}
+
+// wait blocks until pick finds an entry to hand out, the fake is closed
+// or ctx is done, and returns the entry's index. The caller must hold the
+// lock.
+func (f *Fake) wait(ctx context.Context, pick func() int) (int, error) {
+	defer f.wakeOnDone(ctx)()
+	for !f.closed {
+		if !f.paused {
+			if i := pick(); i >= 0 {
+				return i, nil
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return -1, err
+		}
+		f.blocked++
+		f.cond.Broadcast()
+		f.cond.Wait()
+		f.blocked--
+	}
+
+	return -1, nil
+}
+
+// take hands out the entry pick chooses, waiting for one if block is set.
+// With reserve the entry stays in the fake under a new token until
+// committed or aborted.
+func (f *Fake) take(ctx context.Context, method string, block, reserve bool, pick func() int) (fqueue.Message, fqueue.Token, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	i := -1
+	err := f.failing(method)
+	if err == nil && block {
+		i, err = f.wait(ctx, pick)
+	} else if err == nil && !f.paused {
+		i = pick()
+	}
+	switch {
+	case err != nil:
+	case f.closed:
+		err = fqueue.ErrQueueClosed
+	case i < 0:
+		f.record(method, nil, 0, nil)
+		return fqueue.Message{}, 0, errEmpty
+	}
+	if err != nil {
+		f.record(method, nil, 0, err)
+		return fqueue.Message{}, 0, err
+	}
+	m := f.entries[i]
+	f.entries = append(f.entries[:i], f.entries[i+1:]...)
+	f.attempts[m.Seq]++
+	var token fqueue.Token
+	if reserve {
+		f.nextToken++
+		token = f.nextToken
+		f.tokens[token] = m
+	} else {
+		f.release(m)
+	}
+	f.record(method, m.Data, token, nil)
+
+	return m, token, nil
+}
+
+// release drops a consumed entry. The caller must hold the lock.
+func (f *Fake) release(m fqueue.Message) {
+	f.drop(m)
+	f.life.Popped++
+	f.consumed = append(f.consumed, m)
+}
+
+// drop frees the space of an entry that leaves the fake. The caller must
+// hold the lock.
+func (f *Fake) drop(m fqueue.Message) {
+	f.used -= uint32(len(m.Data))
+	delete(f.attempts, m.Seq)
+	f.cond.Broadcast()
+}
+
+func (f *Fake) Pop() []byte {
+	m, _, _ := f.take(context.Background(), "Pop", true, false, f.first)
+	return m.Data
+}
+
+func (f *Fake) PopMsg() fqueue.Message {
+	m, _, _ := f.take(context.Background(), "PopMsg", true, false, f.first)
+	return m
+}
+
+func (f *Fake) TryPop() ([]byte, bool) {
+	m, _, err := f.take(context.Background(), "TryPop", false, false, f.first)
+	return m.Data, err == nil
+}
+
+func (f *Fake) PopTopic(topic string) fqueue.Message {
+	m, _, _ := f.take(context.Background(), "PopTopic", true, false, func() int {
+		for i, m := range f.entries {
+			if m.Topic == topic {
+				return i
+			}
+		}
+		return -1
+	})
+
+	return m
+}
+
+func (f *Fake) PopMatch(fn func(data []byte) bool, mode fqueue.MatchMode) []byte {
+	m, _, _ := f.take(context.Background(), "PopMatch", true, false, func() int {
+		for i := 0; i < len(f.entries); {
+			if fn(f.entries[i].Data) {
+				return i
+			}
+			if mode != fqueue.MatchDiscard {
+				i++
+				continue
+			}
+			f.drop(f.entries[i])
+			f.entries = append(f.entries[:i], f.entries[i+1:]...)
+		}
+		return -1
+	})
+
+	return m.Data
+}
+
+// PopTo writes the data of the next entry to w. If writing fails the
+// entry stays in front.
+func (f *Fake) PopTo(w io.Writer) (int64, error) {
+	m, token, err := f.take(context.Background(), "PopTo", true, true, f.first)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(m.Data)
+	if err != nil {
+		f.settle("PopTo", token, true)
+		return int64(n), err
+	}
+
+	return int64(n), f.settle("PopTo", token, false)
+}
+
+func (f *Fake) Reserve() ([]byte, fqueue.Token) {
+	m, token, _ := f.take(context.Background(), "Reserve", true, true, f.first)
+	return m.Data, token
+}
+
+func (f *Fake) ReserveContext(ctx context.Context) ([]byte, fqueue.Token, error) {
+	m, token, err := f.take(ctx, "ReserveContext", true, true, f.first)
+	return m.Data, token, err
+}
+
+// Drain pops entries until the fake is empty and returns them in order.
+func (f *Fake) Drain(ctx context.Context) ([][]byte, error) {
+	var res [][]byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		m, _, err := f.take(ctx, "Drain", false, false, f.first)
+		if err == errEmpty {
+			return res, nil
+		}
+		if err != nil {
+			return res, err
+		}
+		res = append(res, m.Data)
+	}
+}
+
+// Subscribe hands entries to handler one at a time until ctx is done,
+// committing them when it returns nil and aborting them otherwise. The
+// options are ignored. Like the rest, failed commits and aborts show up
+// in Calls.
+func (f *Fake) Subscribe(ctx context.Context, handler fqueue.Handler, opts ...fqueue.SubscribeOption) error {
+	for {
+		data, token, err := f.ReserveContext(ctx)
+		if err != nil {
+			return err
+		}
+		if err := handle(ctx, handler, data); err != nil {
+			f.Abort(token)
+			continue
+		}
+		f.Commit(token)
+	}
+}
+
+// handle calls handler, turning a panic into an error.
+func handle(ctx context.Context, handler fqueue.Handler, data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+
+	return handler(ctx, data)
+}
+
+// settle ends the reservation behind token, putting the entry back in
+// front with requeue.
+func (f *Fake) settle(method string, token fqueue.Token, requeue bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.usable(method)
+	m, ok := f.tokens[token]
+	switch {
+	case err != nil:
+	case !ok:
+		err = fqueue.ErrUnknownToken
+	case requeue:
+		delete(f.tokens, token)
+		f.entries = append([]fqueue.Message{m}, f.entries...)
+		f.cond.Broadcast()
+	default:
+		delete(f.tokens, token)
+		f.release(m)
+	}
+	f.record(method, m.Data, token, err)
+
+	return err
+}
+
+func (f *Fake) Commit(token fqueue.Token) error {
+	return f.settle("Commit", token, false)
+}
+
+func (f *Fake) Abort(token fqueue.Token) error {
+	return f.settle("Abort", token, true)
+}
+
+// Attempts returns how many times the entry behind token has been handed
+// out, this time included, or 0 if the token is unknown.
+func (f *Fake) Attempts(token fqueue.Token) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if m, ok := f.tokens[token]; ok {
+		return f.attempts[m.Seq]
+	}
+
+	return 0
+}
+
+// Quarantine sets the entry behind token aside with note.
+func (f *Fake) Quarantine(token fqueue.Token, note string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.usable("Quarantine")
+	m, ok := f.tokens[token]
+	switch {
+	case err != nil:
+	case !ok:
+		err = fqueue.ErrUnknownToken
+	default:
+		delete(f.tokens, token)
+		f.drop(m)
+		f.quarantined = append(f.quarantined, fqueue.QuarantinedEntry{Message: m, Note: note, At: time.Now()})
+	}
+	f.record("Quarantine", m.Data, token, err)
+
+	return err
+}
+
+func (f *Fake) Quarantined() []fqueue.QuarantinedEntry {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return append([]fqueue.QuarantinedEntry(nil), f.quarantined...)
+}
+
+// RequeueQuarantined pushes the quarantined entry that had sequence
+// number seq again, under a new one.
+func (f *Fake) RequeueQuarantined(seq uint64) error {
+	return f.unquarantine("RequeueQuarantined", seq, true)
+}
+
+func (f *Fake) PurgeQuarantined(seq uint64) error {
+	return f.unquarantine("PurgeQuarantined", seq, false)
+}
+
+func (f *Fake) unquarantine(method string, seq uint64, requeue bool) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.failing(method)
+	i := 0
+	for i < len(f.quarantined) && f.quarantined[i].Seq != seq {
+		i++
+	}
+	var data []byte
+	switch {
+	case err != nil:
+	case i == len(f.quarantined):
+		err = fqueue.ErrNotQuarantined
+	default:
+		e := f.quarantined[i]
+		data = e.Data
+		if requeue {
+			if err = f.check(method, uint32(len(e.Data))); err != nil {
+				break
+			}
+			f.add(fqueue.Message{Topic: e.Topic, Headers: e.Headers, Data: e.Data}, false)
+		}
+		f.quarantined = append(f.quarantined[:i], f.quarantined[i+1:]...)
+	}
+	f.record(method, data, 0, err)
+
+	return err
+}
+
+func (f *Fake) CommitCursor(cursor string, seq uint64) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.usable("CommitCursor")
+	if err == nil {
+		f.cursors[cursor] = seq
+	}
+	f.record("CommitCursor", nil, 0, err)
+
+	return err
+}
+
+func (f *Fake) CursorSeq(cursor string) (uint64, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	seq, ok := f.cursors[cursor]
+
+	return seq, ok
+}
+
+func (f *Fake) Lag(cursor string) (fqueue.Lag, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	seq, ok := f.cursors[cursor]
+	if !ok || f.closed {
+		return fqueue.Lag{}, false
+	}
+	var lag fqueue.Lag
+	if tail := f.nextSeq - 1; tail > seq {
+		lag.Entries = tail - seq
+	}
+	f.each(func(m fqueue.Message) {
+		if m.Seq > seq {
+			lag.Bytes += uint64(len(m.Data))
+		}
+	})
+
+	return lag, true
+}
+
+// each calls fn for every entry still in the fake, reserved ones
+// included. The caller must hold the lock.
+func (f *Fake) each(fn func(m fqueue.Message)) {
+	for _, m := range f.entries {
+		fn(m)
+	}
+	for _, m := range f.tokens {
+		fn(m)
+	}
+}
+
+func (f *Fake) TopicCounts() map[string]int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	res := make(map[string]int)
+	f.each(func(m fqueue.Message) {
+		res[m.Topic]++
+	})
+
+	return res
+}
+
+// RangeReverse calls fn for each queued entry, most recently queued first,
+// until fn returns false.
+func (f *Fake) RangeReverse(fn func(data []byte) bool) error {
+	f.lock.Lock()
+	if f.closed {
+		f.lock.Unlock()
+		return fqueue.ErrQueueClosed
+	}
+	entries := append([]fqueue.Message(nil), f.entries...)
+	f.lock.Unlock()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if !fn(entries[i].Data) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// remove drops the queued entries for which fn returns true and returns
+// how many it dropped. The caller must hold the lock.
+func (f *Fake) remove(fn func(i int, m fqueue.Message) bool) int {
+	kept := f.entries[:0]
+	n := 0
+	for i, m := range f.entries {
+		if fn(i, m) {
+			f.drop(m)
+			n++
+			continue
+		}
+		kept = append(kept, m)
+	}
+	f.entries = kept
+
+	return n
+}
+
+func (f *Fake) RemoveIf(fn func(data []byte) bool) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return 0
+	}
+	n := f.remove(func(_ int, m fqueue.Message) bool { return fn(m.Data) })
+	f.record("RemoveIf", nil, 0, nil)
+
+	return n
+}
+
+func (f *Fake) Compact(key func(m fqueue.Message) string) int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return 0
+	}
+	last := make(map[string]int)
+	for i, m := range f.entries {
+		if k := key(m); k != "" {
+			last[k] = i
+		}
+	}
+	n := f.remove(func(i int, m fqueue.Message) bool {
+		k := key(m)
+		return k != "" && last[k] != i
+	})
+	f.life.Compacted = time.Now()
+	f.record("Compact", nil, 0, nil)
+
+	return n
+}
+
+// TruncateBefore drops the queued entries, and the consumed ones kept for
+// Get and Replay, with sequence numbers below seq.
+func (f *Fake) TruncateBefore(seq uint64) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.usable("TruncateBefore")
+	n := 0
+	if err == nil {
+		n = f.remove(func(_ int, m fqueue.Message) bool { return m.Seq < seq })
+		kept := f.consumed[:0]
+		for _, m := range f.consumed {
+			if m.Seq >= seq {
+				kept = append(kept, m)
+			}
+		}
+		f.consumed = kept
+	}
+	f.record("TruncateBefore", nil, 0, err)
+
+	return n, err
+}
+
+// Begin starts a transaction, which holds the fake locked until it is
+// committed or rolled back.
+func (f *Fake) Begin() fqueue.Tx {
+	f.lock.Lock()
+
+	return &fakeTx{f: f}
+}
+
+type fakeTx struct {
+	f      *Fake
+	popped int
+	pushed []fqueue.Message
+	bytes  uint32
+	done   bool
+}
+
+func (tx *fakeTx) Push(data []byte) error {
+	if tx.done {
+		return fqueue.ErrTxDone
+	}
+	f := tx.f
+	// Space freed by pops in the transaction is only freed on commit.
+	err := f.check("Tx.Push", tx.bytes+uint32(len(data)))
+	if err == nil {
+		tx.pushed = append(tx.pushed, fqueue.Message{Data: data})
+		tx.bytes += uint32(len(data))
+	}
+	f.record("Tx.Push", data, 0, err)
+
+	return err
+}
+
+func (tx *fakeTx) Pop() ([]byte, bool) {
+	f := tx.f
+	if tx.done || f.closed || f.paused || tx.popped == len(f.entries) {
+		return nil, false
+	}
+	data := f.entries[tx.popped].Data
+	tx.popped++
+	f.record("Tx.Pop", data, 0, nil)
+
+	return data, true
+}
+
+func (tx *fakeTx) Commit() error {
+	if tx.done {
+		return fqueue.ErrTxDone
+	}
+	tx.done = true
+	f := tx.f
+	defer f.lock.Unlock()
+	err := f.usable("Tx.Commit")
+	if err == nil {
+		taken := append([]fqueue.Message(nil), f.entries[:tx.popped]...)
+		f.entries = f.entries[tx.popped:]
+		for _, m := range taken {
+			f.release(m)
+		}
+		for _, m := range tx.pushed {
+			f.add(m, false)
+		}
+	}
+	f.record("Tx.Commit", nil, 0, err)
+
+	return err
+}
+
+func (tx *fakeTx) Rollback() error {
+	if tx.done {
+		return fqueue.ErrTxDone
+	}
+	tx.done = true
+	tx.f.record("Tx.Rollback", nil, 0, nil)
+	tx.f.lock.Unlock()
+
+	return nil
+}
+
+// Get returns the data of the entry with sequence number seq, queued,
+// reserved or consumed.
+func (f *Fake) Get(seq uint64) ([]byte, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return nil, fqueue.ErrQueueClosed
+	}
+	var data []byte
+	found := false
+	f.each(func(m fqueue.Message) {
+		if m.Seq == seq {
+			data, found = m.Data, true
+		}
+	})
+	for _, m := range f.consumed {
+		if m.Seq == seq {
+			data, found = m.Data, true
+		}
+	}
+	if !found {
+		return nil, fqueue.ErrNotRetained
+	}
+
+	return data, nil
+}
+
+// Replay returns up to n of the most recently consumed entries, oldest
+// first.
+func (f *Fake) Replay(n int) ([]fqueue.Message, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return nil, fqueue.ErrQueueClosed
+	}
+	if n > len(f.consumed) {
+		n = len(f.consumed)
+	}
+
+	return append([]fqueue.Message(nil), f.consumed[len(f.consumed)-n:]...), nil
+}
+
+// NewReplayCursor returns nil, as replay cursors read the queue file.
+func (f *Fake) NewReplayCursor(fromSeq uint64) *fqueue.ReplayCursor {
+	return nil
+}
+
+// PeekSize returns the length of the next entry's data.
+func (f *Fake) PeekSize() (int, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed || f.paused || len(f.entries) == 0 {
+		return 0, false
+	}
+
+	return len(f.entries[0].Data), true
+}
+
+// WaitUntilEmpty blocks until every entry was popped or committed, or ctx
+// is done.
+func (f *Fake) WaitUntilEmpty(ctx context.Context) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.waitEmpty(ctx)
+}
+
+// waitEmpty is WaitUntilEmpty for callers holding the lock.
+func (f *Fake) waitEmpty(ctx context.Context) error {
+	defer f.wakeOnDone(ctx)()
+	for len(f.entries) > 0 || len(f.tokens) > 0 {
+		if f.closed {
+			return fqueue.ErrQueueClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f.cond.Wait()
+	}
+
+	return nil
+}
+
+func (f *Fake) IsEmpty() bool {
+	return f.Size() == 0
+}
+
+// Size returns the number of entries that can be handed out; reserved
+// ones don't count.
+func (f *Fake) Size() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return len(f.entries)
+}
+
+func (f *Fake) Stats() fqueue.Stats {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	s := fqueue.Stats{
+		Entries:  len(f.entries),
+		InFlight: len(f.tokens),
+		HeadSeq:  f.nextSeq,
+		TailSeq:  f.nextSeq - 1,
+		Paused:   f.paused,
+		Lifetime: f.life,
+	}
+	f.each(func(m fqueue.Message) {
+		if m.Seq < s.HeadSeq {
+			s.HeadSeq = m.Seq
+		}
+	})
+
+	return s
+}
+
+// OldestAge reports how long ago the oldest entry still in the fake,
+// reserved ones included, was pushed.
+func (f *Fake) OldestAge() time.Duration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return 0
+	}
+	var oldest time.Time
+	f.each(func(m fqueue.Message) {
+		if oldest.IsZero() || m.Time.Before(oldest) {
+			oldest = m.Time
+		}
+	})
+	if oldest.IsZero() {
+		return 0
+	}
+
+	return time.Since(oldest)
+}
+
+func (f *Fake) Capacity() uint32 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.capacity
+}
+
+// Free returns the bytes of entry data that still fit, or the largest
+// uint32 if the fake has no capacity.
+func (f *Fake) Free() uint32 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.capacity == 0 {
+		return ^uint32(0)
+	}
+
+	return f.capacity - f.used
+}
+
+func (f *Fake) IsFull() bool {
+	return f.Free() == 0
+}
+
+// Resize changes the capacity, failing with a *fqueue.SpaceError if the
+// entries in the fake don't fit.
+func (f *Fake) Resize(capacity uint32) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.usable("Resize")
+	switch {
+	case err != nil:
+	case capacity > 0 && capacity < f.used:
+		err = &fqueue.SpaceError{Needed: f.used, Available: capacity}
+	default:
+		f.capacity = capacity
+		f.cond.Broadcast()
+	}
+	f.record("Resize", nil, 0, err)
+
+	return err
+}
+
+// Reconfigure records the call; the fake has no settings to change.
+func (f *Fake) Reconfigure(opts ...fqueue.Option) error {
+	return f.simple("Reconfigure")
+}
+
+// Refresh puts reserved entries back in front, as the real queue forgets
+// them.
+func (f *Fake) Refresh() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.usable("Refresh")
+	if err == nil {
+		var back []fqueue.Message
+		for token, m := range f.tokens {
+			back = append(back, m)
+			delete(f.tokens, token)
+		}
+		sort.Slice(back, func(i, j int) bool { return back[i].Seq < back[j].Seq })
+		f.entries = append(back, f.entries...)
+		f.cond.Broadcast()
+	}
+	f.record("Refresh", nil, 0, err)
+
+	return err
+}
+
+// Verify reports the entries in the fake, which is always consistent.
+func (f *Fake) Verify() (fqueue.Report, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return fqueue.Report{}, fqueue.ErrQueueClosed
+	}
+
+	return fqueue.Report{Entries: len(f.entries) + len(f.tokens), Bytes: f.used}, nil
+}
+
+// Clone fails with ErrUnsupported.
+func (f *Fake) Clone(path string, capacity uint32) error {
+	return ErrUnsupported
+}
+
+// Persist fails with fqueue.ErrNotTemporary, like it does for queues not
+// made by fqueue.NewTempQueue.
+func (f *Fake) Persist(path string) error {
+	return fqueue.ErrNotTemporary
+}
+
+func (f *Fake) Pause() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.paused = true
+	f.record("Pause", nil, 0, nil)
+}
+
+func (f *Fake) Resume() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.paused = false
+	f.cond.Broadcast()
+	f.record("Resume", nil, 0, nil)
+}
+
+func (f *Fake) Sync() error {
+	return f.simple("Sync")
+}
+
+// simple records a call of method that does nothing but fail as set up
+// with FailNext, or once the fake is closed.
+func (f *Fake) simple(method string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.usable(method)
+	f.record(method, nil, 0, err)
+
+	return err
+}
+
+// Close makes calls fail with fqueue.ErrQueueClosed and wakes callers
+// waiting for an entry, which get none. Closing again fails the same way.
+func (f *Fake) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := f.failing("Close")
+	switch {
+	case err != nil:
+	case f.closed:
+		err = fqueue.ErrQueueClosed
+	default:
+		f.closed = true
+		f.cond.Broadcast()
+	}
+	f.record("Close", nil, 0, err)
+
+	return err
+}
+
+// CloseDrain makes pushes fail with fqueue.ErrClosing, waits until every
+// entry was consumed or ctx is done, then closes the fake.
+func (f *Fake) CloseDrain(ctx context.Context) error {
+	f.lock.Lock()
+	err := f.failing("CloseDrain")
+	if err == nil && f.closed {
+		err = fqueue.ErrQueueClosed
+	}
+	if err == nil {
+		f.closing = true
+		err = f.waitEmpty(ctx)
+		f.closed = true
+		f.cond.Broadcast()
+	}
+	f.record("CloseDrain", nil, 0, err)
+	f.lock.Unlock()
+
+	return err
+}
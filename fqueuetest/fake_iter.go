@@ -0,0 +1,21 @@
+//go:build go1.23
+
+package fqueuetest
+
+import (
+	"context"
+	"iter"
+)
+
+// Messages returns an iterator that pops entries as they become
+// available until ctx is done, the fake is closed or the loop breaks.
+func (f *Fake) Messages(ctx context.Context) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for {
+			m, _, err := f.take(ctx, "Messages", true, false, f.first)
+			if err != nil || !yield(m.Data) {
+				return
+			}
+		}
+	}
+}
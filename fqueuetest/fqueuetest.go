@@ -0,0 +1,441 @@
+// Package fqueuetest checks queues keep fqueue's promises. Run is a
+// conformance suite for any Queue, such as a wrapper adding behaviour on
+// top of fqueue's own, and RunCrash checks what a queue recovers after
+// crashes simulated by a Crasher. Fake stands in for a queue in unit
+// tests of the code using it.
+package fqueuetest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fqueue"
+)
+
+// Run runs the conformance suite, each test on an empty queue from open.
+// The queues are closed when their test ends.
+func Run(t *testing.T, open func(t *testing.T) fqueue.Queue) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, q fqueue.Queue)
+	}{
+		{"Order", testOrder},
+		{"Message", testMessage},
+		{"PushFront", testPushFront},
+		{"Reserve", testReserve},
+		{"Tx", testTx},
+		{"Drain", testDrain},
+		{"PeekSize", testPeekSize},
+		{"Close", testClose},
+		{"CloseDrain", testCloseDrain},
+		{"CloseDrainTimeout", testCloseDrainTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := open(t)
+			defer q.Close()
+			tt.fn(t, q)
+		})
+	}
+}
+
+func entry(i int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprint(i, ":")), i%7+1)
+}
+
+func testOrder(t *testing.T, q fqueue.Queue) {
+	if !q.IsEmpty() || q.Size() != 0 {
+		t.Fatalf("new queue has %d entries", q.Size())
+	}
+	if _, ok := q.TryPop(); ok {
+		t.Fatal("TryPop on an empty queue returned an entry")
+	}
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err := q.Push(entry(i)); err != nil {
+			t.Fatalf("Push %d: %v", i, err)
+		}
+	}
+	if q.Size() != n {
+		t.Fatalf("Size is %d after %d pushes", q.Size(), n)
+	}
+	for i := 0; i < n; i++ {
+		data, ok := q.TryPop()
+		if !ok || !bytes.Equal(data, entry(i)) {
+			t.Fatalf("entry %d is %q, %v; want %q", i, data, ok, entry(i))
+		}
+	}
+	if !q.IsEmpty() {
+		t.Fatalf("%d entries left after popping everything", q.Size())
+	}
+}
+
+func testMessage(t *testing.T, q fqueue.Queue) {
+	in := fqueue.Message{Topic: "t", Headers: map[string]string{"k": "v"}, Data: []byte("data")}
+	if err := q.PushMsg(in); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push([]byte("raw")); err != nil {
+		t.Fatal(err)
+	}
+	first, second := q.PopMsg(), q.PopMsg()
+	if first.Topic != in.Topic || first.Headers["k"] != "v" || !bytes.Equal(first.Data, in.Data) {
+		t.Fatalf("got %+v, want %+v", first, in)
+	}
+	if first.Time.IsZero() || second.Seq <= first.Seq {
+		t.Fatalf("sequence numbers %d, %d and time %v not assigned", first.Seq, second.Seq, first.Time)
+	}
+	if second.Topic != "" || second.Headers != nil || string(second.Data) != "raw" {
+		t.Fatalf("raw entry came back as %+v", second)
+	}
+}
+
+func testPushFront(t *testing.T, q fqueue.Queue) {
+	for _, s := range []string{"b", "c"} {
+		if err := q.Push([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.PushFront([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		if data, ok := q.TryPop(); !ok || string(data) != want {
+			t.Fatalf("got %q, %v; want %q", data, ok, want)
+		}
+	}
+}
+
+func testReserve(t *testing.T, q fqueue.Queue) {
+	for _, s := range []string{"a", "b"} {
+		if err := q.Push([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, token := q.Reserve()
+	if string(data) != "a" {
+		t.Fatalf("reserved %q, want a", data)
+	}
+	if err := q.Abort(token); err != nil {
+		t.Fatal(err)
+	}
+	if data, token = q.Reserve(); string(data) != "a" {
+		t.Fatalf("reserved %q after abort, want a again", data)
+	}
+	if err := q.Commit(token); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Commit(token); !errors.Is(err, fqueue.ErrUnknownToken) {
+		t.Fatalf("second commit returned %v, want ErrUnknownToken", err)
+	}
+	if q.Size() != 1 {
+		t.Fatalf("Size is %d, want 1", q.Size())
+	}
+}
+
+func testTx(t *testing.T, q fqueue.Queue) {
+	if err := q.Push([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	tx := q.Begin()
+	if data, ok := tx.Pop(); !ok || string(data) != "a" {
+		t.Fatalf("tx popped %q, %v", data, ok)
+	}
+	if err := tx.Push([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if q.Size() != 1 {
+		t.Fatalf("Size is %d after rollback, want 1", q.Size())
+	}
+
+	tx = q.Begin()
+	tx.Pop()
+	if err := tx.Push([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, fqueue.ErrTxDone) {
+		t.Fatalf("second commit returned %v, want ErrTxDone", err)
+	}
+	if data, ok := q.TryPop(); !ok || string(data) != "b" || !q.IsEmpty() {
+		t.Fatalf("got %q, %v after commit; want only b", data, ok)
+	}
+}
+
+func testDrain(t *testing.T, q fqueue.Queue) {
+	for _, s := range []string{"a", "b", "c"} {
+		if err := q.Push([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, token := q.Reserve()
+	got, err := q.Drain(context.Background())
+	if err != nil || len(got) != 2 || string(got[0]) != "b" || string(got[1]) != "c" {
+		t.Fatalf("Drain returned %q, %v; want b and c", got, err)
+	}
+	if data, ok := q.TryPop(); ok {
+		t.Fatalf("TryPop returned %q with the only entry reserved", data)
+	}
+	if err := q.Abort(token); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got, err := q.Drain(ctx); len(got) != 0 || !errors.Is(err, context.Canceled) {
+		t.Fatalf("Drain with ctx done returned %q, %v", got, err)
+	}
+	if data, ok := q.TryPop(); !ok || string(data) != "a" {
+		t.Fatalf("TryPop returned %q, %v after abort; want a", data, ok)
+	}
+}
+
+func testPeekSize(t *testing.T, q fqueue.Queue) {
+	if n, ok := q.PeekSize(); ok {
+		t.Fatalf("PeekSize on an empty queue returned %d", n)
+	}
+	if err := q.PushMsg(fqueue.Message{Topic: "t", Headers: map[string]string{"k": "v"}, Data: []byte("abc")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Push([]byte("de")); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := q.PeekSize(); !ok || n != 3 {
+		t.Fatalf("PeekSize returned %d, %v; want 3", n, ok)
+	}
+	_, token := q.Reserve()
+	if n, ok := q.PeekSize(); !ok || n != 2 {
+		t.Fatalf("PeekSize returned %d, %v with the first entry reserved; want 2", n, ok)
+	}
+	if err := q.Abort(token); err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := q.PeekSize(); !ok || n != 3 {
+		t.Fatalf("PeekSize returned %d, %v after abort; want 3", n, ok)
+	}
+	if q.Size() != 2 {
+		t.Fatalf("PeekSize consumed entries, %d left", q.Size())
+	}
+}
+
+func testClose(t *testing.T, q fqueue.Queue) {
+	if err := q.Push([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, token := q.Reserve(); token == 0 {
+		t.Fatal("reserve failed")
+	}
+	popped := make(chan []byte)
+	go func() { popped <- q.Pop() }()
+	time.Sleep(10 * time.Millisecond)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-popped:
+		if data != nil {
+			t.Fatalf("blocked Pop returned %q after Close", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pop still blocked after Close")
+	}
+
+	if err := q.Push([]byte("b")); !errors.Is(err, fqueue.ErrQueueClosed) {
+		t.Fatalf("Push after Close returned %v, want ErrQueueClosed", err)
+	}
+	if data := q.Pop(); data != nil {
+		t.Fatalf("Pop after Close returned %q", data)
+	}
+	if data, token := q.Reserve(); data != nil || token != 0 {
+		t.Fatalf("Reserve after Close returned %q, %d", data, token)
+	}
+	if _, _, err := q.ReserveContext(context.Background()); !errors.Is(err, fqueue.ErrQueueClosed) {
+		t.Fatalf("ReserveContext after Close returned %v, want ErrQueueClosed", err)
+	}
+	if data, ok := q.TryPop(); ok {
+		t.Fatalf("TryPop after Close returned %q", data)
+	}
+	if _, err := q.Drain(context.Background()); !errors.Is(err, fqueue.ErrQueueClosed) {
+		t.Fatalf("Drain after Close returned %v, want ErrQueueClosed", err)
+	}
+	if n, ok := q.PeekSize(); ok {
+		t.Fatalf("PeekSize after Close returned %d", n)
+	}
+	if err := q.Commit(1); !errors.Is(err, fqueue.ErrQueueClosed) {
+		t.Fatalf("Commit after Close returned %v, want ErrQueueClosed", err)
+	}
+	if err := q.Close(); !errors.Is(err, fqueue.ErrQueueClosed) {
+		t.Fatalf("second Close returned %v, want ErrQueueClosed", err)
+	}
+	if err := q.CloseDrain(context.Background()); !errors.Is(err, fqueue.ErrQueueClosed) {
+		t.Fatalf("CloseDrain after Close returned %v, want ErrQueueClosed", err)
+	}
+}
+
+func testCloseDrain(t *testing.T, q fqueue.Queue) {
+	for _, s := range []string{"a", "b"} {
+		if err := q.Push([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, token := q.Reserve()
+	done := make(chan error, 1)
+	go func() { done <- q.CloseDrain(context.Background()) }()
+	for {
+		err := q.Push([]byte("late"))
+		if errors.Is(err, fqueue.ErrClosing) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Push during CloseDrain returned %v, want ErrClosing", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("CloseDrain returned %v with entries left", err)
+	default:
+	}
+	if err := q.Commit(token); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, ok := q.TryPop(); ok {
+			continue
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("CloseDrain returned %v", err)
+			}
+		case <-time.After(10 * time.Millisecond):
+			continue
+		}
+		break
+	}
+	if err := q.Push([]byte("c")); !errors.Is(err, fqueue.ErrQueueClosed) {
+		t.Fatalf("Push after CloseDrain returned %v, want ErrQueueClosed", err)
+	}
+	if err := q.Close(); !errors.Is(err, fqueue.ErrQueueClosed) {
+		t.Fatalf("Close after CloseDrain returned %v, want ErrQueueClosed", err)
+	}
+}
+
+func testCloseDrainTimeout(t *testing.T, q fqueue.Queue) {
+	if err := q.Push([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.CloseDrain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("CloseDrain returned %v, want DeadlineExceeded", err)
+	}
+	if err := q.Push([]byte("b")); !errors.Is(err, fqueue.ErrQueueClosed) {
+		t.Fatalf("Push after CloseDrain returned %v, want ErrQueueClosed", err)
+	}
+	if data, ok := q.TryPop(); ok {
+		t.Fatalf("TryPop after CloseDrain returned %q", data)
+	}
+}
+
+// RunCrash pushes and pops entries on queues opened with opts on a
+// Crasher, crashes them at a random point, and checks what they hold
+// once reopened. Entries popped before the last Sync must be gone, and
+// those pushed before it and never popped must be there. Of the rest, any
+// may be lost or come back, but what is recovered must be in the order it
+// was pushed, and Verify must find nothing wrong with it.
+func RunCrash(t *testing.T, rounds int, opts ...fqueue.Option) {
+	for round := 0; round < rounds; round++ {
+		seed := int64(round)
+		t.Run(fmt.Sprint("seed", seed), func(t *testing.T) {
+			crash(t, seed, opts)
+		})
+	}
+}
+
+func crash(t *testing.T, seed int64, opts []fqueue.Option) {
+	path := filepath.Join(t.TempDir(), "queue")
+	c := NewCrasher(seed)
+	r := rand.New(rand.NewSource(seed))
+	q, err := fqueue.NewCircularFileQueue(path, append(opts[:len(opts):len(opts)], fqueue.WithBackend(c.Open))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pushed [][]byte
+	popped, syncedPushed, syncedPopped := 0, 0, 0
+	for step, steps := 0, r.Intn(200); step < steps; step++ {
+		switch n := r.Intn(10); {
+		case n < 6:
+			data := append([]byte(fmt.Sprint(len(pushed), ":")), make([]byte, r.Intn(200))...)
+			if err := q.Push(data); errors.Is(err, fqueue.ErrNotEnoughSpace) || errors.Is(err, fqueue.ErrQueueFull) {
+				continue
+			} else if err != nil {
+				t.Fatalf("push %d: %v", len(pushed), err)
+			}
+			pushed = append(pushed, data)
+		case n < 9:
+			data, ok := q.TryPop()
+			if !ok {
+				continue
+			}
+			if !bytes.Equal(data, pushed[popped]) {
+				t.Fatalf("popped %.10q, want entry %d", data, popped)
+			}
+			popped++
+		default:
+			if err := q.Sync(); err != nil {
+				t.Fatal(err)
+			}
+			syncedPushed, syncedPopped = len(pushed), popped
+		}
+	}
+	if err := c.Crash(); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	q, err = fqueue.NewCircularFileQueue(path, opts...)
+	if err != nil {
+		t.Fatalf("reopening after crash: %v", err)
+	}
+	defer q.Close()
+	if r, err := q.Verify(); err != nil || !r.OK() {
+		t.Fatalf("Verify after crash: %+v, %v", r, err)
+	}
+	// Entries popped after the last Sync may come back, but the ones
+	// still queued that were pushed before it can't be lost.
+	next := syncedPopped
+	for {
+		data, ok := q.TryPop()
+		if !ok {
+			break
+		}
+		for next < len(pushed) && !bytes.Equal(data, pushed[next]) {
+			if next >= popped && next < syncedPushed {
+				t.Fatalf("entry %d, pushed before Sync, lost", next)
+			}
+			next++
+		}
+		if next == len(pushed) {
+			t.Fatalf("recovered %.10q, which is out of order or was popped before Sync", data)
+		}
+		next++
+	}
+	if next < popped {
+		next = popped
+	}
+	if next < syncedPushed {
+		t.Fatalf("entry %d, pushed before Sync, lost", next)
+	}
+}
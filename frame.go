@@ -0,0 +1,302 @@
+package fqueue
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// The length fields around every entry carry flags in their top bits.
+// pendingFlag marks entries written by a transaction; it only matters when
+// recovering entries past the end recorded in the header, see recover.
+// blobFlag marks entries whose data is stored in a blob, see blob.go.
+const (
+	deadFlag    uint32 = 1 << 31
+	metaFlag    uint32 = 1 << 30
+	pendingFlag uint32 = 1 << 29
+	blobFlag    uint32 = 1 << 28
+	lengthMask         = blobFlag - 1
+
+	metaLenLength uint32 = 4
+	timeLength    uint32 = 8
+	markerLength  uint32 = 4
+	crcLength     uint32 = 4
+
+	frameMarker uint32 = 0xf4a3e1d7
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// frame is an entry as laid out on disk between its prefix, the length
+// field followed by frameMarker, and its suffix, the length field again
+// followed by the CRC-32C of the body. The body holds the sequence number
+// and enqueue time in Unix nanoseconds, then, when metaFlag is set, the
+// length of the encoded metadata followed by the metadata itself, then
+// the data. The marker lets a reader find frames again after corrupt
+// bytes. The data may be held in several parts, written one after the
+// other, followed by srcLen bytes read from src.
+type frame struct {
+	flags  uint32
+	seq    uint64
+	time   int64
+	meta   []byte
+	data   [][]byte
+	src    io.Reader
+	srcLen uint32
+	// filled is data already in place after the stamp, see Alloc.
+	filled [][]byte
+}
+
+func newFrame(m Message) frame {
+	f := frame{time: time.Now().UnixNano(), data: [][]byte{m.Data}}
+	if m.Topic != "" || len(m.Headers) > 0 {
+		f.flags |= metaFlag
+		f.meta = encodeMeta(&m)
+	}
+
+	return f
+}
+
+func (f frame) dataLength() uint64 {
+	n := uint64(f.srcLen)
+	for _, p := range f.data {
+		n += uint64(len(p))
+	}
+	for _, p := range f.filled {
+		n += uint64(len(p))
+	}
+
+	return n
+}
+
+func (f frame) bodyLength() uint32 {
+	n := seqLength + timeLength + uint32(f.dataLength())
+	if f.flags&metaFlag != 0 {
+		n += metaLenLength + uint32(len(f.meta))
+	}
+
+	return n
+}
+
+func (f frame) length() uint32 {
+	return preLength + f.bodyLength() + sufLength
+}
+
+func (q *circularFileQueue) checkFrame(f frame) error {
+	size := f.dataLength()
+	if q.opts.maxEntrySize > 0 && size > uint64(q.opts.maxEntrySize) {
+		return &EntrySizeError{Size: uint32(size), Limit: q.opts.maxEntrySize}
+	}
+	limit := q.capacity - headPos - preLength - sufLength
+	if limit > lengthMask {
+		limit = lengthMask
+	}
+	if size+uint64(f.bodyLength()-uint32(size)) > uint64(limit) {
+		return &EntrySizeError{Size: uint32(size), Limit: limit}
+	}
+
+	return nil
+}
+
+// frameAt returns the body length and flags of the frame at pos. It fails
+// with ErrCorrupted if pos doesn't hold a plausible frame prefix.
+func (q *circularFileQueue) frameAt(pos uint32) (uint32, uint32, error) {
+	pre := make([]byte, preLength)
+	if _, err := q.readRing(pre, pos); err != nil {
+		return 0, 0, err
+	}
+	tag := binary.BigEndian.Uint32(pre)
+	length := tag & lengthMask
+	if binary.BigEndian.Uint32(pre[tagLength:]) != frameMarker ||
+		length < seqLength+timeLength || preLength+length+sufLength > q.capacity-headPos {
+		return 0, 0, ErrCorrupted
+	}
+
+	return length, tag &^ lengthMask, nil
+}
+
+// intactAt reports whether a complete frame of at most limit bytes, with
+// matching length fields and checksum, starts at pos.
+func (q *circularFileQueue) intactAt(pos, limit uint32) (uint32, uint32, bool, error) {
+	if limit < preLength+seqLength+timeLength+sufLength {
+		return 0, 0, false, nil
+	}
+	length, flags, err := q.frameAt(pos)
+	if err == ErrCorrupted || err == nil && preLength+length+sufLength > limit {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	body := make([]byte, length)
+	next, err := q.readRing(body, q.advance(pos, preLength))
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if err := q.checkSuffix(next, length|flags, body); err == ErrCorrupted {
+		return 0, 0, false, nil
+	} else if err != nil {
+		return 0, 0, false, err
+	}
+
+	return length, flags, true, nil
+}
+
+// checkSuffix verifies the suffix at pos against the frame's tag and body.
+func (q *circularFileQueue) checkSuffix(pos, tag uint32, body []byte) error {
+	suf := make([]byte, sufLength)
+	if _, err := q.readRing(suf, pos); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(suf) != tag || binary.BigEndian.Uint32(suf[tagLength:]) != crc32.Checksum(body, crcTable) {
+		return ErrCorrupted
+	}
+
+	return nil
+}
+
+// stampAt returns the sequence number and enqueue time of the frame at pos
+// without reading its body.
+func (q *circularFileQueue) stampAt(pos uint32) (uint64, time.Time, error) {
+	buf := make([]byte, seqLength+timeLength)
+	if _, err := q.readRing(buf, q.advance(pos, preLength)); err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return binary.BigEndian.Uint64(buf), time.Unix(0, int64(binary.BigEndian.Uint64(buf[seqLength:]))), nil
+}
+
+// metaAt decodes everything but the data of the frame at pos.
+func (q *circularFileQueue) metaAt(pos uint32) (Message, error) {
+	_, flags, err := q.frameAt(pos)
+	if err != nil {
+		return Message{}, err
+	}
+	buf := make([]byte, seqLength+timeLength+metaLenLength)
+	if flags&metaFlag == 0 {
+		buf = buf[:seqLength+timeLength]
+	}
+	next, err := q.readRing(buf, q.advance(pos, preLength))
+	if err != nil {
+		return Message{}, err
+	}
+	m := Message{
+		Seq:  binary.BigEndian.Uint64(buf),
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(buf[seqLength:]))),
+	}
+	if flags&metaFlag == 0 {
+		return m, nil
+	}
+	meta := make([]byte, binary.BigEndian.Uint32(buf[seqLength+timeLength:]))
+	if _, err := q.readRing(meta, next); err != nil {
+		return Message{}, err
+	}
+	if err := decodeMeta(meta, &m); err != nil {
+		return Message{}, err
+	}
+
+	return m, nil
+}
+
+func (q *circularFileQueue) readFrame(pos uint32) (Message, uint32, error) {
+	length, flags, err := q.frameAt(pos)
+	if err != nil {
+		return Message{}, pos, err
+	}
+	body := make([]byte, length)
+	if pos, err = q.readRing(body, q.advance(pos, preLength)); err != nil {
+		return Message{}, pos, err
+	}
+	if err := q.checkSuffix(pos, length|flags, body); err != nil {
+		return Message{}, pos, err
+	}
+
+	m := Message{
+		Seq:  binary.BigEndian.Uint64(body),
+		Time: time.Unix(0, int64(binary.BigEndian.Uint64(body[seqLength:]))),
+	}
+	body = body[seqLength+timeLength:]
+	if flags&metaFlag == 0 {
+		m.Data = body
+	} else if err := decodeMessage(body, &m); err != nil {
+		return Message{}, pos, err
+	}
+	if flags&blobFlag != 0 {
+		if q.blobs == nil {
+			return Message{}, pos, ErrCorrupted
+		}
+		name, _ := parseBlobRef(m.Data)
+		if m.Data, err = q.blobs.read(name); err != nil {
+			return Message{}, pos, err
+		}
+	}
+
+	return m, q.advance(pos, sufLength), nil
+}
+
+func (q *circularFileQueue) writeFrame(pos uint32, f frame) (uint32, error) {
+	tag := f.bodyLength() | f.flags
+	pre := make([]byte, preLength)
+	binary.BigEndian.PutUint32(pre, tag)
+	binary.BigEndian.PutUint32(pre[tagLength:], frameMarker)
+	pos, err := q.writeRing(pre, pos)
+	if err != nil {
+		return pos, err
+	}
+	stamp := make([]byte, seqLength+timeLength)
+	binary.BigEndian.PutUint64(stamp, f.seq)
+	binary.BigEndian.PutUint64(stamp[seqLength:], uint64(f.time))
+	if pos, err = q.writeRing(stamp, pos); err != nil {
+		return pos, err
+	}
+	crc := crc32.Update(0, crcTable, stamp)
+	if f.flags&metaFlag != 0 {
+		metaLen := make([]byte, metaLenLength)
+		binary.BigEndian.PutUint32(metaLen, uint32(len(f.meta)))
+		if pos, err = q.writeRing(metaLen, pos); err != nil {
+			return pos, err
+		}
+		if pos, err = q.writeRing(f.meta, pos); err != nil {
+			return pos, err
+		}
+		crc = crc32.Update(crc32.Update(crc, crcTable, metaLen), crcTable, f.meta)
+	}
+	for _, p := range f.data {
+		if pos, err = q.writeRing(p, pos); err != nil {
+			return pos, err
+		}
+		crc = crc32.Update(crc, crcTable, p)
+	}
+	for _, p := range f.filled {
+		pos = q.advance(pos, uint32(len(p)))
+		crc = crc32.Update(crc, crcTable, p)
+	}
+	if f.srcLen > 0 {
+		if pos, crc, err = q.copyFrom(f.src, f.srcLen, pos, crc); err != nil {
+			return pos, err
+		}
+	}
+	suf := make([]byte, sufLength)
+	binary.BigEndian.PutUint32(suf, tag)
+	binary.BigEndian.PutUint32(suf[tagLength:], crc)
+
+	return q.writeRing(suf, pos)
+}
+
+// markDead sets deadFlag in both length fields of the frame at pos so it is
+// recognised when walking forwards and backwards.
+func (q *circularFileQueue) markDead(pos uint32) error {
+	length, flags, err := q.frameAt(pos)
+	if err != nil {
+		return err
+	}
+	tag := make([]byte, tagLength)
+	binary.BigEndian.PutUint32(tag, length|flags|deadFlag)
+	if _, err := q.writeRing(tag, pos); err != nil {
+		return err
+	}
+	_, err = q.writeRing(tag, q.advance(pos, preLength+length))
+
+	return err
+}
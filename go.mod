@@ -2,7 +2,6 @@ module fqueue
 
 go 1.20
 
-require (
-	github.com/edsrzf/mmap-go v1.1.0 // indirect
-	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e // indirect
-)
+require github.com/edsrzf/mmap-go v1.1.0
+
+require golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
@@ -0,0 +1,52 @@
+package fqueue
+
+// Op identifies the operation an Interceptor is called for.
+type Op int
+
+const (
+	// OpPush is applied to data before it is written.
+	OpPush Op = iota
+	// OpPop is applied to data read for a consumer, before the entry is
+	// consumed. An error leaves the entry in the queue.
+	OpPop
+	// OpPeek is applied to data read without consuming it, by
+	// RangeReverse and RemoveIf.
+	OpPeek
+)
+
+// Interceptor may inspect, validate or transform entry data. Returning an
+// error aborts the operation.
+type Interceptor func(op Op, data []byte) ([]byte, error)
+
+// intercept runs the interceptors in order for OpPush and in reverse order
+// otherwise, so that transformations such as encryption unwind correctly.
+func (q *circularFileQueue) intercept(op Op, data []byte) ([]byte, error) {
+	fns := q.opts.interceptors
+	var err error
+	for i := range fns {
+		fn := fns[i]
+		if op != OpPush {
+			fn = fns[len(fns)-1-i]
+		}
+		if data, err = fn(op, data); err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// deliver reads the frame at pos for handing it to a consumer.
+func (q *circularFileQueue) deliver(pos uint32, op Op) (Message, uint32, error) {
+	r := q.region("fqueue.read")
+	m, next, err := q.readFrame(pos)
+	r.End()
+	if err != nil {
+		return Message{}, pos, err
+	}
+	if m.Data, err = q.intercept(op, m.Data); err != nil {
+		return Message{}, pos, err
+	}
+
+	return m, next, nil
+}
@@ -0,0 +1,61 @@
+// Package bridge holds what the broker bridges have in common: the
+// options every one of them takes and the loop forwarding a queue's
+// entries to a broker.
+package bridge
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"fqueue"
+	"fqueue/internal/retry"
+)
+
+// Options are the settings shared by every bridge, which embed them in
+// their own options.
+type Options struct {
+	Backoff retry.Backoff
+	// OnError is called with every failure that is going to be retried.
+	OnError func(error)
+}
+
+// DefaultOptions retries after 100ms, backing off up to 30s.
+func DefaultOptions() Options {
+	return Options{Backoff: retry.Backoff{Min: 100 * time.Millisecond, Max: 30 * time.Second}}
+}
+
+// Forward hands the entries of q to send until ctx is done, retrying
+// failed sends indefinitely. Each entry is reserved and committed only
+// once send succeeded, so entries are delivered at least once and in
+// order. The entry being sent when ctx is done is returned to the queue;
+// if that fails, the error is returned along with ctx.Err().
+func Forward(ctx context.Context, q fqueue.Queue, o Options, send func(ctx context.Context, data []byte) error) error {
+	for {
+		data, token, err := q.ReserveContext(ctx)
+		if err != nil {
+			return err
+		}
+		err = retry.Do(ctx, o.Backoff, o.OnError, func(ctx context.Context) error {
+			return send(ctx, data)
+		})
+		if err != nil {
+			return errors.Join(err, q.Abort(token))
+		}
+		if err := q.Commit(token); err != nil {
+			return err
+		}
+	}
+}
+
+// Push pushes data to q, retrying with o's backoff while the queue is
+// full, until ctx is done. Any other error is returned straight away.
+func Push(ctx context.Context, q fqueue.Queue, o Options, data []byte) error {
+	return retry.Do(ctx, o.Backoff, o.OnError, func(context.Context) error {
+		err := q.Push(data)
+		if err != nil && !errors.Is(err, fqueue.ErrNotEnoughSpace) && !errors.Is(err, fqueue.ErrQueueFull) {
+			return retry.Stop(err)
+		}
+		return err
+	})
+}
@@ -0,0 +1,60 @@
+// Package retry holds the backoff loop shared by the broker bridges.
+package retry
+
+import (
+	"context"
+	"time"
+)
+
+// Backoff bounds the delay between attempts, which starts at Min and
+// doubles after every failure up to Max.
+type Backoff struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+type permanent struct {
+	err error
+}
+
+func (p permanent) Error() string {
+	return p.err.Error()
+}
+
+// Stop wraps an error that retrying won't fix, making Do return it as is.
+func Stop(err error) error {
+	return permanent{err: err}
+}
+
+// Do calls fn until it succeeds, fails with an error wrapped by Stop, or
+// ctx is done, in which case it returns ctx.Err(). Other failures are
+// passed to onError, if not nil.
+func Do(ctx context.Context, b Backoff, onError func(error), fn func(context.Context) error) error {
+	delay := b.Min
+	for {
+		err := fn(ctx)
+		if err == nil {
+			return nil
+		}
+		if p, ok := err.(permanent); ok {
+			return p.err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if onError != nil {
+			onError(err)
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if delay *= 2; delay > b.Max {
+			delay = b.Max
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build go1.23
+
+package fqueue
+
+import (
+	"context"
+	"iter"
+)
+
+type iterQueue interface {
+	Messages(ctx context.Context) iter.Seq[[]byte]
+}
+
+// Messages returns an iterator that pops entries as they become
+// available, blocking in between, until ctx is done or the loop breaks.
+func (q *circularFileQueue) Messages(ctx context.Context) iter.Seq[[]byte] {
+	return func(yield func([]byte) bool) {
+		for {
+			data, err := q.popContext(ctx)
+			if err != nil {
+				if ctx.Err() == nil && err != ErrQueueClosed {
+					q.logError("fqueue: pop failed", err)
+				}
+				return
+			}
+			if !yield(data) {
+				return
+			}
+		}
+	}
+}
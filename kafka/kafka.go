@@ -0,0 +1,135 @@
+// Package kafka moves entries between a local queue and Kafka, so the
+// queue can buffer a producer through broker outages. It is written
+// against the small Producer and Consumer interfaces below rather than a
+// particular client library.
+package kafka
+
+import (
+	"context"
+	"time"
+
+	"fqueue"
+	"fqueue/internal/bridge"
+	"fqueue/internal/retry"
+)
+
+// Producer writes a record to a Kafka topic and returns once the broker
+// has acknowledged it.
+type Producer interface {
+	Produce(ctx context.Context, topic string, key, value []byte) error
+}
+
+// Record is a message read from Kafka.
+type Record struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+}
+
+// Consumer reads records from Kafka and commits their offsets, typically
+// as a member of a consumer group.
+type Consumer interface {
+	Fetch(ctx context.Context) (Record, error)
+	Commit(ctx context.Context, r Record) error
+}
+
+type Option func(*options)
+
+type options struct {
+	bridge.Options
+	key func(data []byte) []byte
+}
+
+func defaultOptions() options {
+	return options{Options: bridge.DefaultOptions()}
+}
+
+// WithBackoff sets the delay between retries, which starts at min and
+// doubles up to max. The default is 100ms to 30s.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.Backoff = retry.Backoff{Min: min, Max: max}
+	}
+}
+
+// WithKey derives the Kafka record key from each entry. Records are
+// produced without a key by default.
+func WithKey(fn func(data []byte) []byte) Option {
+	return func(o *options) {
+		o.key = fn
+	}
+}
+
+// WithErrorHandler is called with every failure that is going to be
+// retried.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *options) {
+		o.OnError = fn
+	}
+}
+
+// Forwarder drains a queue into a Kafka topic. Each entry is reserved,
+// produced, and committed to the queue only once Kafka acknowledged it,
+// so entries are delivered at least once and in order.
+type Forwarder struct {
+	q     fqueue.Queue
+	p     Producer
+	topic string
+	opts  options
+}
+
+func NewForwarder(q fqueue.Queue, p Producer, topic string, opts ...Option) *Forwarder {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Forwarder{q: q, p: p, topic: topic, opts: o}
+}
+
+// Run forwards entries until ctx is done, retrying failed produces
+// indefinitely. The entry being produced when ctx is done is returned to
+// the queue.
+func (f *Forwarder) Run(ctx context.Context) error {
+	return bridge.Forward(ctx, f.q, f.opts.Options, func(ctx context.Context, data []byte) error {
+		var key []byte
+		if f.opts.key != nil {
+			key = f.opts.key(data)
+		}
+		return f.p.Produce(ctx, f.topic, key, data)
+	})
+}
+
+// Fill pushes records read from c into q until ctx is done, committing
+// each offset after the record is in the queue. A crash in between means
+// the record is pushed again. Pushes that fail because the queue is full
+// are retried; any other push error, such as a record too large for the
+// queue or the queue being closed, stops Fill.
+func Fill(ctx context.Context, c Consumer, q fqueue.Queue, opts ...Option) error {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	for {
+		var r Record
+		err := retry.Do(ctx, o.Backoff, o.OnError, func(ctx context.Context) (err error) {
+			r, err = c.Fetch(ctx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := bridge.Push(ctx, q, o.Options, r.Value); err != nil {
+			return err
+		}
+		err = retry.Do(ctx, o.Backoff, o.OnError, func(ctx context.Context) error {
+			return c.Commit(ctx, r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
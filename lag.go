@@ -0,0 +1,66 @@
+package fqueue
+
+// Lag is how far a cursor is behind the most recently pushed entry.
+type Lag struct {
+	// Entries is the number of entries pushed after the cursor's sequence
+	// number.
+	Entries uint64
+	// Bytes is the space taken by those of them still in the queue.
+	Bytes uint64
+}
+
+// Lag returns how far cursor is behind, if it was ever committed.
+func (q *circularFileQueue) Lag(cursor string) (Lag, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return Lag{}, false
+	}
+	seq, ok := q.cursors.seqs[cursor]
+	if !ok {
+		return Lag{}, false
+	}
+
+	return q.lags(map[string]uint64{cursor: seq})[cursor], true
+}
+
+// lags works out the lag of each cursor in one pass over the queue.
+func (q *circularFileQueue) lags(cursors map[string]uint64) map[string]Lag {
+	if len(cursors) == 0 {
+		return nil
+	}
+	res := make(map[string]Lag, len(cursors))
+	tail := q.nextSeq - 1
+	for name, seq := range cursors {
+		var l Lag
+		if seq < tail {
+			l.Entries = tail - seq
+		}
+		res[name] = l
+	}
+
+	pos := q.start
+	for i := uint32(0); i < q.count; i++ {
+		length, flags, err := q.frameAt(pos)
+		if err != nil {
+			break
+		}
+		n := preLength + length + sufLength
+		if flags&deadFlag == 0 {
+			seq, _, err := q.stampAt(pos)
+			if err != nil {
+				break
+			}
+			for name, c := range cursors {
+				if seq > c {
+					l := res[name]
+					l.Bytes += uint64(n)
+					res[name] = l
+				}
+			}
+		}
+		pos = q.advance(pos, n)
+	}
+
+	return res
+}
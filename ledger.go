@@ -0,0 +1,146 @@
+package fqueue
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// ledger persists the sequence numbers of the most recently committed
+// entries in a file of fixed-size slots, overwritten round-robin. Entries
+// committed out of order, or before a deferred header write, are still in
+// the queue after a crash; on open they are found in the ledger and
+// removed instead of being delivered again.
+type ledger struct {
+	file  *os.File
+	slots []uint64
+	seen  map[uint64]struct{}
+	next  int
+}
+
+const (
+	ledgerExt  = ".ledger"
+	ledgerSlot = 8
+)
+
+func openLedger(path string, size int, fresh bool, mode os.FileMode) (*ledger, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+	l := &ledger{file: file, slots: make([]uint64, size), seen: make(map[uint64]struct{}, size)}
+	// Sequence numbers start over with a new queue file, so whatever an
+	// old ledger holds would match entries that were never committed.
+	if fresh {
+		err = file.Truncate(0)
+	} else {
+		err = l.load()
+	}
+	if err == nil {
+		err = file.Truncate(int64(size) * ledgerSlot)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *ledger) load() error {
+	buf := make([]byte, len(l.slots)*ledgerSlot)
+	n, err := l.file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var max uint64
+	for i := 0; i+ledgerSlot <= n; i += ledgerSlot {
+		seq := binary.BigEndian.Uint64(buf[i:])
+		if seq == 0 {
+			continue
+		}
+		l.slots[i/ledgerSlot] = seq
+		l.seen[seq] = struct{}{}
+		if seq > max {
+			max = seq
+			l.next = (i/ledgerSlot + 1) % len(l.slots)
+		}
+	}
+
+	return nil
+}
+
+func (l *ledger) has(seq uint64) bool {
+	if l == nil {
+		return false
+	}
+	_, ok := l.seen[seq]
+
+	return ok
+}
+
+func (l *ledger) add(seq uint64) error {
+	if l == nil {
+		return nil
+	}
+	delete(l.seen, l.slots[l.next])
+	l.slots[l.next] = seq
+	l.seen[seq] = struct{}{}
+	buf := make([]byte, ledgerSlot)
+	binary.BigEndian.PutUint64(buf, seq)
+	_, err := l.file.WriteAt(buf, int64(l.next)*ledgerSlot)
+	l.next = (l.next + 1) % len(l.slots)
+
+	return err
+}
+
+func (l *ledger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	return l.file.Close()
+}
+
+// skipProcessed removes the entries the ledger records as committed.
+func (q *circularFileQueue) skipProcessed() error {
+	removed := uint32(0)
+	pos := q.read
+	for i := uint32(0); i < q.unread; i++ {
+		length, flags, err := q.frameAt(pos)
+		if err != nil {
+			return err
+		}
+		if flags&deadFlag == 0 {
+			seq, _, err := q.stampAt(pos)
+			if err != nil {
+				return err
+			}
+			if q.ledger.has(seq) {
+				meta, err := q.metaAt(pos)
+				if err != nil {
+					return err
+				}
+				if err := q.markDead(pos); err != nil {
+					return err
+				}
+				q.untrack(meta.Topic, pos)
+				q.emit(EventRemoved, seq, meta.Topic)
+				removed++
+			}
+		}
+		pos = q.advance(pos, preLength+length+sufLength)
+	}
+	if removed == 0 {
+		return nil
+	}
+
+	q.opts.logger.Info("fqueue: skipped processed entries", "queue", q.name, "entries", removed)
+	q.dead += removed
+	if err := q.skipDead(); err != nil {
+		return err
+	}
+	q.release()
+
+	return q.writeMeta()
+}
@@ -0,0 +1,25 @@
+package fqueue
+
+// Logger receives diagnostics from a queue. Arguments after the message
+// are alternating keys and values. *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// logError logs err, if any, for an operation that has no way to return
+// it to the caller.
+func (q *circularFileQueue) logError(msg string, err error) {
+	if err != nil {
+		q.opts.logger.Error(msg, "queue", q.name, "err", err)
+	}
+}
@@ -0,0 +1,299 @@
+package fqueue
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const queueFileExt = ".fq"
+
+// sidecarExts are the suffixes of the files and directories kept next to
+// a queue file, which count towards the budget along with it.
+var sidecarExts = []string{ledgerExt, blobsExt, notifyExt, quarantineExt, cursorsExt}
+
+// Manager opens named queues stored as files in one directory and keeps
+// their combined size within a disk budget.
+type Manager struct {
+	dir    string
+	budget int64
+	opts   []Option
+	lock   sync.Mutex
+	queues map[string]*managedQueue
+	closed bool
+
+	// spent guards left, what the budget had left at the last check, see
+	// take.
+	spent sync.Mutex
+	left  int64
+}
+
+type managedQueue struct {
+	Queue
+	m    *Manager
+	name string
+}
+
+// NewManager creates dir if needed, with the permissions of WithFileMode
+// plus search permission where they grant read, and returns a Manager for
+// the queues in it. A budget of 0 means no limit. opts apply to every
+// queue opened through the Manager, before the options given to Open.
+func NewManager(dir string, budget int64, opts ...Option) (*Manager, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if err := createDir(dir, o.mode); err != nil {
+		return nil, err
+	}
+
+	return &Manager{
+		dir:    dir,
+		budget: budget,
+		opts:   opts,
+		queues: make(map[string]*managedQueue),
+	}, nil
+}
+
+// Open returns the queue with the given name, opening or creating its file
+// on first use. Creating a queue fails with ErrBudgetExceeded when its
+// capacity would take the directory over budget. Once open, writing
+// blobs, cursors and quarantined entries fails with a BudgetError when
+// it would.
+func (m *Manager) Open(name string, opts ...Option) (Queue, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, ErrInvalidName
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil, ErrManagerClosed
+	}
+	if q, ok := m.queues[name]; ok {
+		return q, nil
+	}
+
+	opts = append(append([]Option(nil), m.opts...), opts...)
+	if m.budget > 0 {
+		opts = append(opts, func(o *options) { o.budget = m.take })
+	}
+	path := m.path(name)
+	if m.budget > 0 {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			o := defaultOptions()
+			for _, opt := range opts {
+				opt(&o)
+			}
+			used, err := m.usage()
+			if err != nil {
+				return nil, err
+			}
+			if used+int64(o.capacity) > m.budget {
+				return nil, ErrBudgetExceeded
+			}
+		}
+	}
+
+	q, err := NewCircularFileQueue(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	mq := &managedQueue{Queue: q, m: m, name: name}
+	m.queues[name] = mq
+
+	return mq, nil
+}
+
+// List returns the names of all queues in the directory, open or not.
+func (m *Manager) List() ([]string, error) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasSuffix(e.Name(), queueFileExt) {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(e.Name(), queueFileExt))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// Usage returns the combined size in bytes of all queue files and the
+// files kept next to them, such as ledgers and blobs.
+func (m *Manager) Usage() (int64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.usage()
+}
+
+func (m *Manager) usage() (int64, error) {
+	names, err := m.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, name := range names {
+		size, err := m.size(name)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+
+	return total, nil
+}
+
+// size returns the size in bytes of the queue file of name and its
+// sidecars.
+func (m *Manager) size(name string) (int64, error) {
+	path := m.path(name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	total := fi.Size()
+	for _, ext := range sidecarExts {
+		// Missing sidecars, and blobs removed meanwhile, are skipped.
+		err := filepath.WalkDir(path+ext, func(_ string, d fs.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				var fi fs.FileInfo
+				if fi, err = d.Info(); err == nil {
+					total += fi.Size()
+				}
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return total, nil
+}
+
+// Close closes every queue opened through the Manager. Queues can't be
+// opened afterwards.
+func (m *Manager) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+
+	var firstErr error
+	for name, q := range m.queues {
+		if err := q.Queue.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(m.queues, name)
+	}
+
+	return firstErr
+}
+
+// take draws n bytes about to be written next to a queue from the budget,
+// failing with a BudgetError if they would take the directory over it.
+// Like diskBudget, it draws on what the last check of the directory left,
+// as if nothing written were ever removed, and only checks again once
+// that runs out. It doesn't take lock, which is held while calling into
+// queues that may be calling take.
+func (m *Manager) take(n int64) error {
+	m.spent.Lock()
+	defer m.spent.Unlock()
+	if n <= m.left {
+		m.left -= n
+		return nil
+	}
+	used, err := m.usage()
+	if err != nil {
+		return err
+	}
+	if used+n > m.budget {
+		m.left = 0
+		avail := m.budget - used
+		if avail < 0 {
+			avail = 0
+		}
+		return &BudgetError{Needed: n, Available: avail}
+	}
+	m.left = m.budget - used - n
+
+	return nil
+}
+
+// budgetFunc is Manager.take for the queues a Manager opens, nil for the
+// others.
+type budgetFunc func(n int64) error
+
+// take charges n bytes about to be written next to the queue, if it
+// belongs to a Manager with a budget.
+func (f budgetFunc) take(n int64) error {
+	if f == nil {
+		return nil
+	}
+
+	return f(n)
+}
+
+func (m *Manager) path(name string) string {
+	return filepath.Join(m.dir, name+queueFileExt)
+}
+
+// Resize fails with ErrBudgetExceeded when growing the queue would take
+// the directory over budget.
+func (q *managedQueue) Resize(capacity uint32) error {
+	q.m.lock.Lock()
+	defer q.m.lock.Unlock()
+	if q.m.budget > 0 {
+		fi, err := os.Stat(q.m.path(q.name))
+		if err != nil {
+			return err
+		}
+		used, err := q.m.usage()
+		if err != nil {
+			return err
+		}
+		if int64(capacity) > fi.Size() && used-fi.Size()+int64(capacity) > q.m.budget {
+			return ErrBudgetExceeded
+		}
+	}
+
+	return q.Queue.Resize(capacity)
+}
+
+func (q *managedQueue) CloseDrain(ctx context.Context) error {
+	err := q.Queue.(*circularFileQueue).quiesce(ctx)
+	if cerr := q.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func (q *managedQueue) Close() error {
+	q.m.lock.Lock()
+	defer q.m.lock.Unlock()
+	if q.m.queues[q.name] != q {
+		return ErrQueueClosed
+	}
+	delete(q.m.queues, q.name)
+
+	return q.Queue.Close()
+}
@@ -0,0 +1,103 @@
+package fqueue
+
+import "time"
+
+// MatchMode decides what PopMatch does with the entries it passes over.
+type MatchMode int
+
+const (
+	// MatchLeave leaves entries that don't match in place for other
+	// consumers.
+	MatchLeave MatchMode = iota
+	// MatchDiscard removes entries that don't match as they are passed
+	// over.
+	MatchDiscard
+)
+
+// PopMatch blocks until an entry for which fn returns true is available
+// and returns it. Entries queued before it that don't match are left or
+// removed depending on mode.
+func (q *circularFileQueue) PopMatch(fn func(data []byte) bool, mode MatchMode) []byte {
+	defer q.observe(OpPop, time.Now())
+	q.limiter.wait()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for !q.closed {
+		if !q.paused {
+			m, ok, err := q.popMatch(fn, mode)
+			if err != nil {
+				q.logError("fqueue: pop failed", err)
+				return nil
+			}
+			if ok {
+				return m.Data
+			}
+		}
+		r := q.region("fqueue.wait")
+		q.cond.Wait()
+		r.End()
+	}
+
+	return nil
+}
+
+func (q *circularFileQueue) popMatch(fn func(data []byte) bool, mode MatchMode) (Message, bool, error) {
+	for i := 0; i < len(q.redeliver); {
+		r := q.redeliver[i]
+		m, _, err := q.deliver(r.pos, OpPeek)
+		if err != nil {
+			return Message{}, false, err
+		}
+		match := fn(m.Data)
+		if !match && mode == MatchLeave {
+			i++
+			continue
+		}
+		settle := q.consume
+		if match {
+			if m, _, err = q.deliver(r.pos, OpPop); err != nil {
+				return Message{}, false, err
+			}
+			q.emit(EventDelivered, r.seq, r.topic)
+			settle = q.commit
+		}
+		q.redeliver = append(q.redeliver[:i], q.redeliver[i+1:]...)
+		if err := settle(r); err != nil || match {
+			return m, match, err
+		}
+	}
+
+	removed := uint32(0)
+	pos := q.read
+	for i := uint32(0); i < q.unread; i++ {
+		length, flags, err := q.frameAt(pos)
+		if err != nil {
+			return Message{}, false, err
+		}
+		if flags&deadFlag == 0 {
+			m, _, err := q.deliver(pos, OpPeek)
+			if err != nil {
+				return Message{}, false, err
+			}
+			if fn(m.Data) {
+				return q.take(pos)
+			}
+			if mode == MatchDiscard {
+				if err := q.markDead(pos); err != nil {
+					return Message{}, false, err
+				}
+				q.dead++
+				q.untrack(m.Topic, pos)
+				removed++
+			}
+		}
+		pos = q.advance(pos, preLength+length+sufLength)
+	}
+	if removed == 0 {
+		return Message{}, false, nil
+	}
+	q.logError("fqueue: skipping removed entries failed", q.skipDead())
+	q.release()
+
+	return Message{}, false, q.stateChanged()
+}
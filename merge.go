@@ -0,0 +1,206 @@
+package fqueue
+
+import (
+	"context"
+	"hash/fnv"
+	"os"
+	"strconv"
+)
+
+// partExt is appended to the name of a queue, followed by the partition
+// number, to name the queues Split creates.
+const partExt = ".part"
+
+// MovedFromHeader is the header Move stores an entry's sequence number in
+// src under, so consumers of dst can recognise the copy a crash during
+// Move may leave behind.
+const MovedFromHeader = "fqueue-moved-from"
+
+// Merge moves every entry that can be handed out from src to the end of
+// dst, in order, and returns how many it moved. Entries are moved in
+// batches: each entry is reserved in src and pushed to dst, and only once
+// dst is synced are the batch's entries committed, so a crash or power
+// loss in between leaves them in both queues rather than in neither. Topics and headers are
+// kept; sequence numbers and push times are assigned anew by dst. Merge
+// stops at the first entry dst refuses, leaving it in src, and when ctx
+// is done. src must be a queue opened by this package and not dst.
+func Merge(ctx context.Context, dst, src Queue) (int, error) {
+	return move(ctx, src, []Queue{dst}, func(Message) int { return 0 })
+}
+
+// Partition moves the entries of src to dsts like Merge, sending every
+// entry to the queue picked by the FNV-1a hash of its key, so entries
+// with the same key end up in the same queue and in order. Split creates
+// the queues as well.
+func Partition(ctx context.Context, src Queue, dsts []Queue, key func(m Message) string) (int, error) {
+	return move(ctx, src, dsts, func(m Message) int {
+		h := fnv.New32a()
+		h.Write([]byte(key(m)))
+		return int(h.Sum32() % uint32(len(dsts)))
+	})
+}
+
+// Split creates n new queues next to src and moves its entries to them
+// with Partition, returning the queues open. They are named after src
+// with ".part0" to ".partN-1" appended, and have its capacity and file
+// mode unless opts say otherwise. Split fails if any of those files
+// exists. If moving fails, the queues are returned along with the error,
+// as they may hold entries already; the caller closes them either way.
+func Split(ctx context.Context, src Queue, n int, key func(m Message) string, opts ...Option) ([]Queue, int, error) {
+	s, ok := unwrap(src)
+	if !ok || n < 1 {
+		return nil, 0, ErrInvalidQueue
+	}
+	s.lock.RLock()
+	name, capacity, mode := s.name, s.capacity, s.opts.mode
+	s.lock.RUnlock()
+
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = name + partExt + strconv.Itoa(i)
+		if _, err := os.Lstat(paths[i]); err == nil {
+			return nil, 0, &OpenError{Path: paths[i], Err: os.ErrExist}
+		} else if !os.IsNotExist(err) {
+			return nil, 0, &OpenError{Path: paths[i], Err: err}
+		}
+	}
+	opts = append([]Option{WithCapacity(capacity), WithFileMode(mode)}, opts...)
+	dsts := make([]Queue, 0, n)
+	for _, path := range paths {
+		q, err := NewCircularFileQueue(path, opts...)
+		if err != nil {
+			// The queues made so far are still empty.
+			for i, q := range dsts {
+				q.Close()
+				os.Remove(paths[i])
+			}
+			return nil, 0, err
+		}
+		dsts = append(dsts, q)
+	}
+	moved, err := Partition(ctx, src, dsts, key)
+
+	return dsts, moved, err
+}
+
+// Move pops the next entry of src and pushes it to dst, returning its
+// data, or nil if src has no entry to hand out; it doesn't wait for one.
+// It takes two phases: the entry is reserved in src, pushed to dst and
+// dst synced, and only then is it committed in src and src synced. If
+// either step on dst fails the entry goes back to src, so a crash at any
+// point leaves it in at least one of the queues; between the two syncs,
+// in both. Once the entry is in dst, Move returns its data even on error.
+// src must be a queue opened by this package and not dst.
+func Move(src, dst Queue) ([]byte, error) {
+	s, ok := unwrap(src)
+	if !ok {
+		return nil, ErrInvalidQueue
+	}
+	if d, ok := unwrap(dst); ok && d == s {
+		return nil, ErrInvalidQueue
+	}
+
+	m, token, ok, err := s.tryReserve()
+	if err != nil || !ok {
+		return nil, err
+	}
+	headers := make(map[string]string, len(m.Headers)+1)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers[MovedFromHeader] = strconv.FormatUint(m.Seq, 10)
+	var data []byte
+	err = dst.PushMsg(Message{Topic: m.Topic, Headers: headers, Data: m.Data})
+	if err == nil {
+		data = m.Data
+		err = dst.Sync()
+	}
+	if err != nil {
+		if aerr := src.Abort(token); aerr != nil {
+			s.logError("fqueue: returning entry after failed move failed", aerr)
+		}
+		return data, err
+	}
+	if err := src.Commit(token); err != nil {
+		return m.Data, err
+	}
+
+	return m.Data, src.Sync()
+}
+
+func move(ctx context.Context, src Queue, dsts []Queue, pick func(m Message) int) (int, error) {
+	s, ok := unwrap(src)
+	if !ok || len(dsts) == 0 {
+		return 0, ErrInvalidQueue
+	}
+	for _, dst := range dsts {
+		if d, ok := unwrap(dst); ok && d == s {
+			return 0, ErrInvalidQueue
+		}
+	}
+
+	n := 0
+	for {
+		moved, err := moveBatch(ctx, s, dsts, pick)
+		n += moved
+		if err != nil || moved < mergeBatch {
+			return n, err
+		}
+	}
+}
+
+// mergeBatch is how many entries move pushes before syncing.
+const mergeBatch = 64
+
+// moveBatch moves up to mergeBatch entries and returns how many it moved.
+// The queues pushed to are synced before the entries are committed in s;
+// if that fails they are put back in s as well, ending up in both.
+func moveBatch(ctx context.Context, s *circularFileQueue, dsts []Queue, pick func(m Message) int) (int, error) {
+	var tokens []Token
+	pushed := make(map[int]bool)
+	var err error
+	for len(tokens) < mergeBatch {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		var m Message
+		var token Token
+		var ok bool
+		if m, token, ok, err = s.tryReserve(); err != nil || !ok {
+			break
+		}
+		i := pick(m)
+		if err = dsts[i].PushMsg(m); err != nil {
+			s.logError("fqueue: returning entry after failed move failed", s.Abort(token))
+			break
+		}
+		tokens = append(tokens, token)
+		pushed[i] = true
+	}
+
+	for i := range pushed {
+		if serr := dsts[i].Sync(); serr != nil {
+			for _, token := range tokens {
+				s.logError("fqueue: returning entry after failed move failed", s.Abort(token))
+			}
+			return 0, serr
+		}
+	}
+	for n, token := range tokens {
+		if cerr := s.Commit(token); cerr != nil {
+			return n, cerr
+		}
+	}
+
+	return len(tokens), err
+}
+
+// unwrap returns the queue behind q.
+func unwrap(q Queue) (*circularFileQueue, bool) {
+	if mq, ok := q.(*managedQueue); ok {
+		q = mq.Queue
+	}
+	cq, ok := q.(*circularFileQueue)
+
+	return cq, ok
+}
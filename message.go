@@ -0,0 +1,129 @@
+package fqueue
+
+import (
+	"encoding/binary"
+	"sort"
+	"time"
+)
+
+// Message is an entry together with its metadata. Entries pushed with Push
+// come back from PopMsg as a Message without headers.
+type Message struct {
+	// Seq and Time are assigned by the queue on push and ignored by
+	// PushMsg.
+	Seq     uint64
+	Time    time.Time
+	Topic   string
+	Headers map[string]string
+	Data    []byte
+}
+
+func (q *circularFileQueue) PushMsg(m Message) error {
+	return q.push(m)
+}
+
+func (q *circularFileQueue) PopMsg() Message {
+	defer q.observe(OpPop, time.Now())
+	q.limiter.wait()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.waitReady() != nil {
+		return Message{}
+	}
+
+	r, m, err := q.next()
+	if err != nil {
+		q.logError("fqueue: pop failed", err)
+		return Message{}
+	}
+	q.logError("fqueue: persisting header failed", q.commit(r))
+
+	return m
+}
+
+// encodeMeta lays out the topic followed by a uvarint header count and the
+// header keys and values sorted by key, all strings uvarint
+// length-prefixed.
+func encodeMeta(m *Message) []byte {
+	keys := make([]string, 0, len(m.Headers))
+	for k := range m.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := appendString(nil, m.Topic)
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		buf = appendString(buf, k)
+		buf = appendString(buf, m.Headers[k])
+	}
+
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+// decodeMessage splits a body written with metaFlag into m.
+func decodeMessage(body []byte, m *Message) error {
+	if uint32(len(body)) < metaLenLength {
+		return ErrCorrupted
+	}
+	metaLen := binary.BigEndian.Uint32(body)
+	body = body[metaLenLength:]
+	if uint32(len(body)) < metaLen {
+		return ErrCorrupted
+	}
+	m.Data = body[metaLen:]
+
+	return decodeMeta(body[:metaLen], m)
+}
+
+func decodeMeta(meta []byte, m *Message) error {
+	var err error
+	if m.Topic, meta, err = readString(meta); err != nil {
+		return err
+	}
+	n, meta, err := readUvarint(meta)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		m.Headers = make(map[string]string, n)
+	}
+	for i := uint64(0); i < n; i++ {
+		var k, v string
+		if k, meta, err = readString(meta); err != nil {
+			return err
+		}
+		if v, meta, err = readString(meta); err != nil {
+			return err
+		}
+		m.Headers[k] = v
+	}
+
+	return nil
+}
+
+func readUvarint(buf []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return 0, nil, ErrCorrupted
+	}
+
+	return v, buf[n:], nil
+}
+
+func readString(buf []byte) (string, []byte, error) {
+	n, buf, err := readUvarint(buf)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint64(len(buf)) < n {
+		return "", nil, ErrCorrupted
+	}
+
+	return string(buf[:n]), buf[n:], nil
+}
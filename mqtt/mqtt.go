@@ -0,0 +1,98 @@
+// Package mqtt publishes entries spooled in a local queue to an MQTT
+// broker, so a gateway can keep taking sensor readings while it is
+// offline and hand them over in order once the broker is back. It is
+// written against the small Publisher interface below rather than a
+// particular client library.
+package mqtt
+
+import (
+	"context"
+	"time"
+
+	"fqueue"
+	"fqueue/internal/bridge"
+	"fqueue/internal/retry"
+)
+
+// Publisher publishes a message with QoS 1 and returns once the broker
+// has acknowledged it with a PUBACK. It returns an error while the
+// client is disconnected.
+type Publisher interface {
+	Publish(ctx context.Context, topic string, retained bool, payload []byte) error
+}
+
+type Option func(*options)
+
+type options struct {
+	bridge.Options
+	topic    func(data []byte) string
+	retained bool
+}
+
+func defaultOptions() options {
+	return options{Options: bridge.DefaultOptions()}
+}
+
+// WithBackoff sets the delay between retries, which starts at min and
+// doubles up to max. The default is 100ms to 30s.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.Backoff = retry.Backoff{Min: min, Max: max}
+	}
+}
+
+// WithTopic derives the topic from each entry instead of publishing every
+// entry to the Forwarder's topic.
+func WithTopic(fn func(data []byte) string) Option {
+	return func(o *options) {
+		o.topic = fn
+	}
+}
+
+// WithRetained sets the retain flag on every published message.
+func WithRetained() Option {
+	return func(o *options) {
+		o.retained = true
+	}
+}
+
+// WithErrorHandler is called with every failure that is going to be
+// retried.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *options) {
+		o.OnError = fn
+	}
+}
+
+// Forwarder publishes the entries of a queue to a broker. Each entry is
+// reserved, published, and committed to the queue only once the broker
+// sent its PUBACK, so entries are delivered at least once and in order.
+type Forwarder struct {
+	q     fqueue.Queue
+	p     Publisher
+	topic string
+	opts  options
+}
+
+func NewForwarder(q fqueue.Queue, p Publisher, topic string, opts ...Option) *Forwarder {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Forwarder{q: q, p: p, topic: topic, opts: o}
+}
+
+// Run publishes entries until ctx is done, retrying failed publishes
+// indefinitely, so entries pile up in the queue while the broker is
+// unreachable. The entry being published when ctx is done is returned to
+// the queue.
+func (f *Forwarder) Run(ctx context.Context) error {
+	return bridge.Forward(ctx, f.q, f.opts.Options, func(ctx context.Context, data []byte) error {
+		topic := f.topic
+		if f.opts.topic != nil {
+			topic = f.opts.topic(data)
+		}
+		return f.p.Publish(ctx, topic, f.opts.retained, data)
+	})
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package fqueue
+
+func msyncRange(b []byte) error {
+	return errNoRangeSync
+}
@@ -0,0 +1,9 @@
+//go:build unix
+
+package fqueue
+
+import "golang.org/x/sys/unix"
+
+func msyncRange(b []byte) error {
+	return unix.Msync(b, unix.MS_SYNC)
+}
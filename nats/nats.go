@@ -0,0 +1,134 @@
+// Package nats moves entries between a local queue and NATS JetStream, so
+// the queue can act as a durable buffer at the edge of a NATS system. It
+// is written against the small Publisher and Subscriber interfaces below
+// rather than a particular client library.
+package nats
+
+import (
+	"context"
+	"time"
+
+	"fqueue"
+	"fqueue/internal/bridge"
+	"fqueue/internal/retry"
+)
+
+// Publisher publishes a message to a JetStream subject and returns once
+// the stream has acknowledged it with a PubAck.
+type Publisher interface {
+	Publish(ctx context.Context, subject string, data []byte) error
+}
+
+// Msg is a message fetched from JetStream.
+type Msg struct {
+	Subject string
+	// Sequence is the message's sequence number in its stream.
+	Sequence uint64
+	Data     []byte
+}
+
+// Subscriber fetches messages from a JetStream pull consumer, one at a
+// time, and acknowledges them.
+type Subscriber interface {
+	Fetch(ctx context.Context) (Msg, error)
+	Ack(ctx context.Context, m Msg) error
+}
+
+type Option func(*options)
+
+type options struct {
+	bridge.Options
+	subject func(data []byte) string
+}
+
+func defaultOptions() options {
+	return options{Options: bridge.DefaultOptions()}
+}
+
+// WithBackoff sets the delay between retries, which starts at min and
+// doubles up to max. The default is 100ms to 30s.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.Backoff = retry.Backoff{Min: min, Max: max}
+	}
+}
+
+// WithSubject derives the subject from each entry instead of publishing
+// every entry to the Forwarder's subject.
+func WithSubject(fn func(data []byte) string) Option {
+	return func(o *options) {
+		o.subject = fn
+	}
+}
+
+// WithErrorHandler is called with every failure that is going to be
+// retried.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *options) {
+		o.OnError = fn
+	}
+}
+
+// Forwarder publishes the entries of a queue to JetStream. Each entry is
+// reserved, published, and committed to the queue only once the stream
+// acknowledged it, so entries are delivered at least once and in order.
+type Forwarder struct {
+	q       fqueue.Queue
+	p       Publisher
+	subject string
+	opts    options
+}
+
+func NewForwarder(q fqueue.Queue, p Publisher, subject string, opts ...Option) *Forwarder {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Forwarder{q: q, p: p, subject: subject, opts: o}
+}
+
+// Run publishes entries until ctx is done, retrying failed publishes
+// indefinitely. The entry being published when ctx is done is returned
+// to the queue.
+func (f *Forwarder) Run(ctx context.Context) error {
+	return bridge.Forward(ctx, f.q, f.opts.Options, func(ctx context.Context, data []byte) error {
+		subject := f.subject
+		if f.opts.subject != nil {
+			subject = f.opts.subject(data)
+		}
+		return f.p.Publish(ctx, subject, data)
+	})
+}
+
+// Fill pushes messages fetched from s into q until ctx is done,
+// acknowledging each one after it is in the queue. A crash in between
+// means JetStream redelivers it and it is pushed again. Pushes that fail
+// because the queue is full are retried; any other push error, such as a
+// message too large for the queue or the queue being closed, stops Fill.
+func Fill(ctx context.Context, s Subscriber, q fqueue.Queue, opts ...Option) error {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	for {
+		var m Msg
+		err := retry.Do(ctx, o.Backoff, o.OnError, func(ctx context.Context) (err error) {
+			m, err = s.Fetch(ctx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err := bridge.Push(ctx, q, o.Options, m.Data); err != nil {
+			return err
+		}
+		err = retry.Do(ctx, o.Backoff, o.OnError, func(ctx context.Context) error {
+			return s.Ack(ctx, m)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package fqueue
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+)
+
+const (
+	notifyExt      = ".notify"
+	notifyInterval = 50 * time.Millisecond
+)
+
+// notifier is a small file next to the queue that every push rewrites,
+// so that other processes with the queue open learn about new entries.
+type notifier struct {
+	file *os.File
+	buf  []byte
+}
+
+func openNotifier(path string, mode os.FileMode) (*notifier, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &notifier{file: file, buf: make([]byte, 8)}, nil
+}
+
+// signal stores the current time, so the content changes even for
+// watchers that can only poll it.
+func (n *notifier) signal() error {
+	binary.BigEndian.PutUint64(n.buf, uint64(time.Now().UnixNano()))
+	_, err := n.file.WriteAt(n.buf, 0)
+
+	return err
+}
+
+func (n *notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+
+	return n.file.Close()
+}
+
+// adoptNotified picks up the entries another process pushed since the
+// queue was last looked at and wakes consumers waiting for them.
+func (q *circularFileQueue) adoptNotified() {
+	q.wlock.Lock()
+	defer q.wlock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	n, err := q.adoptPastEnd()
+	q.logError("fqueue: picking up pushed entries failed", err)
+	if n == 0 {
+		return
+	}
+	q.unread += n
+	q.pushGen++
+	q.checkWatermarks()
+	q.cond.Broadcast()
+}
+
+// pollNotify checks the notification file for changes until the queue is
+// closed.
+func (q *circularFileQueue) pollNotify() {
+	t := time.NewTicker(notifyInterval)
+	defer t.Stop()
+	last, buf := make([]byte, 8), make([]byte, 8)
+	for {
+		select {
+		case <-t.C:
+			if _, err := q.notify.file.ReadAt(buf, 0); err != nil || string(buf) == string(last) {
+				continue
+			}
+			copy(last, buf)
+			q.adoptNotified()
+		case <-q.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package fqueue
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchNotify waits for changes to the notification file with inotify,
+// falling back to polling if that isn't available.
+func (q *circularFileQueue) watchNotify() {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err == nil {
+		if _, err = unix.InotifyAddWatch(fd, q.name+notifyExt, unix.IN_MODIFY); err != nil {
+			unix.Close(fd)
+		}
+	}
+	if err != nil {
+		q.logError("fqueue: watching for pushes failed, polling instead", err)
+		q.pollNotify()
+		return
+	}
+
+	// The descriptor is non-blocking, so reads go through the runtime
+	// poller and Close interrupts them.
+	events := os.NewFile(uintptr(fd), "inotify")
+	go func() {
+		<-q.done
+		events.Close()
+	}()
+	buf := make([]byte, 4096)
+	for {
+		if _, err := events.Read(buf); err != nil {
+			return
+		}
+		q.adoptNotified()
+	}
+}
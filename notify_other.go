@@ -0,0 +1,7 @@
+//go:build !linux
+
+package fqueue
+
+func (q *circularFileQueue) watchNotify() {
+	q.pollNotify()
+}
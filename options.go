@@ -0,0 +1,456 @@
+package fqueue
+
+import (
+	"os"
+	"time"
+)
+
+type Option func(*options)
+
+type options struct {
+	backend   BackendFunc
+	fileIO    bool
+	capacity  uint32
+	mapWindow uint32
+
+	maxEntrySize uint32
+	maxEntries   uint32
+	quotas       map[string]quota
+
+	popRate  float64
+	popBurst int
+
+	highWatermark float64
+	lowWatermark  float64
+	onHigh        func()
+	onLow         func()
+
+	interceptors []Interceptor
+
+	logger Logger
+
+	metaFlushEvery    int
+	metaFlushInterval time.Duration
+
+	syncOnPush bool
+	syncWindow time.Duration
+
+	dedupEntries int
+	dedupWindow  time.Duration
+	dedupKey     func(Message) string
+
+	ledgerSize int
+
+	retainBytes uint32
+	retainAge   time.Duration
+
+	visibility time.Duration
+
+	maxDeliveries int
+	deadLetter    Queue
+
+	slowThreshold time.Duration
+	onSlow        func(SlowOp)
+
+	skipCorrupt bool
+	onCorrupt   func(pos, n uint32)
+
+	releaseConsumed bool
+	punchHoles      bool
+
+	advice mapAdvice
+
+	blobs         bool
+	blobThreshold uint32
+
+	notify bool
+
+	scrubInterval time.Duration
+	scrubFn       func(Report)
+
+	overflow Queue
+
+	replayWindow int
+
+	mode      os.FileMode
+	createDir bool
+
+	diskReserve  bool
+	diskHeadroom uint64
+
+	// budget is set by the Manager that opens the queue, see budgetFunc.
+	budget budgetFunc
+
+	events func(Event)
+}
+
+func defaultOptions() options {
+	return options{
+		capacity:       defaultCapacity,
+		logger:         nopLogger{},
+		metaFlushEvery: 1,
+		mode:           0600,
+	}
+}
+
+// WithBackend stores the queue with the backend opened by fn instead of
+// the built-in ones, see Backend. It takes precedence over WithFileIO
+// and WithMapWindow.
+func WithBackend(fn BackendFunc) Option {
+	return func(o *options) {
+		o.backend = fn
+	}
+}
+
+// WithFileIO makes the queue use plain positional reads and writes on the
+// backing file instead of memory-mapping it. It is slower, but I/O errors
+// are reported instead of surfacing as SIGBUS, which matters on NFS and
+// on filesystems that can run out of space underneath the mapping.
+func WithFileIO() Option {
+	return func(o *options) {
+		o.fileIO = true
+	}
+}
+
+// WithFileMode sets the permissions of the files the queue creates, its
+// own and the ones kept next to it. Directories get search permission
+// wherever read permission is given. The default is 0600.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.mode = mode.Perm()
+	}
+}
+
+// WithCreateDir creates the directory the queue file goes in, along with
+// any missing parents, instead of failing when it doesn't exist.
+func WithCreateDir() Option {
+	return func(o *options) {
+		o.createDir = true
+	}
+}
+
+// WithCapacity sets the size in bytes of the backing file, header included.
+// It only applies when the file is created; an existing queue keeps the
+// capacity recorded in its header.
+func WithCapacity(capacity uint32) Option {
+	return func(o *options) {
+		o.capacity = capacity
+	}
+}
+
+// WithMapWindow maps the backing file in windows of the given size instead
+// of all at once, so only the regions around the head and tail of the queue
+// occupy address space. Files larger than autoWindowThreshold are windowed
+// with defaultMapWindow even without this option; a size of 0 keeps the
+// default behaviour. The size is rounded up to a multiple of 64 KiB.
+func WithMapWindow(size uint32) Option {
+	return func(o *options) {
+		o.mapWindow = size
+	}
+}
+
+// WithMaxEntrySize limits the size of a single entry; Push returns
+// ErrEntryTooLarge for anything bigger. Zero means no limit beyond what the
+// capacity can hold.
+func WithMaxEntrySize(size uint32) Option {
+	return func(o *options) {
+		o.maxEntrySize = size
+	}
+}
+
+// WithMaxEntries bounds the number of entries in the queue, in flight ones
+// included. Pushes beyond it fail with ErrQueueFull.
+func WithMaxEntries(n uint32) Option {
+	return func(o *options) {
+		o.maxEntries = n
+	}
+}
+
+// WithTopicQuota bounds the entries of topic in the queue, in flight ones
+// included, to maxEntries and the space they take, framing included, to
+// maxBytes, so one topic can't crowd out the others. A zero limit
+// disables that bound. Pushes beyond it fail with ErrQuotaExceeded. Raw
+// entries belong to the empty topic. It may be given once per topic.
+func WithTopicQuota(topic string, maxEntries, maxBytes uint32) Option {
+	return func(o *options) {
+		if o.quotas == nil {
+			o.quotas = make(map[string]quota)
+		}
+		o.quotas[topic] = quota{entries: maxEntries, bytes: maxBytes}
+	}
+}
+
+// WithPopRate limits consumers to perSecond entries per second on average,
+// allowing bursts of up to burst entries after an idle period. Pop,
+// PopMsg, PopTopic and Reserve all draw from the same budget, and callers
+// that have to wait are released evenly spaced.
+func WithPopRate(perSecond float64, burst int) Option {
+	return func(o *options) {
+		o.popRate = perSecond
+		o.popBurst = burst
+	}
+}
+
+// WithWatermarks registers callbacks for the fraction of the data region
+// in use: onHigh fires when usage reaches high, and onLow fires once it
+// drops below low again, so a queue hovering around one threshold doesn't
+// flap. Both run with the queue locked and must not call its methods.
+func WithWatermarks(high, low float64, onHigh, onLow func()) Option {
+	return func(o *options) {
+		o.highWatermark = high
+		o.lowWatermark = low
+		o.onHigh = onHigh
+		o.onLow = onLow
+	}
+}
+
+// WithInterceptors adds interceptors applied to entry data on every push
+// and read, see Interceptor.
+func WithInterceptors(fns ...Interceptor) Option {
+	return func(o *options) {
+		o.interceptors = append(o.interceptors, fns...)
+	}
+}
+
+// WithMetaFlush writes the header only after every changes instead of
+// after each one, and additionally every interval if that is positive.
+// Entries pushed since the last write are recovered from their framing
+// when the queue is reopened after a crash; entries consumed since then
+// are delivered again. PushFront, transactions and Close always write the
+// header.
+func WithMetaFlush(every int, interval time.Duration) Option {
+	return func(o *options) {
+		if every < 1 {
+			every = 1
+		}
+		o.metaFlushEvery = every
+		o.metaFlushInterval = interval
+	}
+}
+
+// WithSyncOnPush makes pushes return only once the entry is durable on
+// disk. Concurrent pushes are flushed together; a positive window delays
+// each flush by that long to let more pushes join it.
+func WithSyncOnPush(window time.Duration) Option {
+	return func(o *options) {
+		o.syncOnPush = true
+		o.syncWindow = window
+	}
+}
+
+// WithDedup drops entries passed to Push or PushMsg whose key matches one
+// of the last entries pushed, or one pushed within window; a zero limit
+// disables that bound. key derives the key from the message, with an
+// empty key meaning the message is never a duplicate; if key is nil the
+// SHA-256 of the data is used. Keys are only remembered while the queue
+// is open.
+func WithDedup(entries int, window time.Duration, key func(Message) string) Option {
+	return func(o *options) {
+		o.dedupEntries = entries
+		o.dedupWindow = window
+		o.dedupKey = key
+	}
+}
+
+// WithLedger records the sequence numbers of the last size committed
+// entries in a file next to the queue. Entries found there on open were
+// already processed and are dropped rather than delivered again, which
+// would otherwise happen to entries committed out of order, or before a
+// deferred header write, when the process crashed.
+func WithLedger(size int) Option {
+	return func(o *options) {
+		o.ledgerSize = size
+	}
+}
+
+// WithRetention drops the oldest entries waiting to be consumed once they
+// take more than maxBytes, framing included, or were pushed more than
+// maxAge ago, whether or not anyone consumes them. A zero limit disables
+// that bound. Retention is enforced every second.
+func WithRetention(maxBytes uint32, maxAge time.Duration) Option {
+	return func(o *options) {
+		o.retainBytes = maxBytes
+		o.retainAge = maxAge
+	}
+}
+
+// WithVisibilityTimeout aborts entries handed out by Reserve that are not
+// committed or aborted within d, so they are delivered again. Committing
+// or aborting afterwards fails with ErrUnknownToken.
+func WithVisibilityTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.visibility = d
+	}
+}
+
+// WithMaxDeliveries stops entries from being handed out again once they
+// were aborted, or timed out, after n deliveries. They are pushed to
+// deadLetter, with their topic and headers, or dropped if it is nil. If
+// the push fails the entry stays in the queue. deadLetter must not be
+// the queue itself. Delivery counts are kept in memory only.
+func WithMaxDeliveries(n int, deadLetter Queue) Option {
+	return func(o *options) {
+		o.maxDeliveries = n
+		o.deadLetter = deadLetter
+	}
+}
+
+// WithSlowOps calls fn after every push or pop that took threshold or
+// longer, time spent blocked included.
+func WithSlowOps(threshold time.Duration, fn func(SlowOp)) Option {
+	return func(o *options) {
+		o.slowThreshold = threshold
+		o.onSlow = fn
+	}
+}
+
+// WithSkipCorrupted makes consumers skip corrupt data at the head of the
+// queue, up to the next intact entry, instead of failing on it. fn, if not
+// nil, is called with the file offset and length of every skipped range.
+func WithSkipCorrupted(fn func(pos, n uint32)) Option {
+	return func(o *options) {
+		o.skipCorrupt = true
+		o.onCorrupt = fn
+	}
+}
+
+// WithReleaseConsumed advises the kernel to drop the pages of entries
+// once they are consumed, so a large queue doesn't keep data nobody will
+// read again in the page cache. It only has an effect on Linux.
+func WithReleaseConsumed() Option {
+	return func(o *options) {
+		o.releaseConsumed = true
+	}
+}
+
+// WithPunchHoles frees the disk space of consumed entries, on Linux file
+// systems that support it, so a large queue that is mostly empty takes
+// little space on disk. The queue file is created sparse in any case.
+// Consumed entries are then gone for Get and replay cursors, and space
+// reused later is allocated again, which fails when the disk is full:
+// with a memory-mapped file that raises SIGBUS, so consider WithFileIO.
+func WithPunchHoles() Option {
+	return func(o *options) {
+		o.punchHoles = true
+	}
+}
+
+// WithPopulate faults in every page of the mapping when it is created, so
+// pushes and pops don't take page faults later. With WithMapWindow, each
+// window is populated as it is mapped. It only has an effect on Linux.
+func WithPopulate() Option {
+	return func(o *options) {
+		o.advice.populate = true
+	}
+}
+
+// WithHugePages asks for the mapping to be backed by transparent huge
+// pages. Linux only does so for files on filesystems that support it,
+// such as tmpfs; elsewhere the option has no effect.
+func WithHugePages() Option {
+	return func(o *options) {
+		o.advice.hugePages = true
+	}
+}
+
+// WithMlock locks the mapping in memory so its pages are never swapped
+// out. With WithMapWindow only the mapped windows are locked. Opening
+// fails if the lock exceeds RLIMIT_MEMLOCK. It only has an effect on
+// Linux.
+func WithMlock() Option {
+	return func(o *options) {
+		o.advice.lock = true
+	}
+}
+
+// WithBlobs stores the data of entries larger than threshold, and of those
+// too large for the queue altogether, in files of their own next to the
+// queue; the queue only holds a reference to them. A threshold of 0 only
+// applies to the latter. It covers Push, PushMsg, PushV and PushFrom.
+// Blobs of consumed entries are removed on the next Sync or Close.
+func WithBlobs(threshold uint32) Option {
+	return func(o *options) {
+		o.blobs = true
+		o.blobThreshold = threshold
+	}
+}
+
+// WithNotify lets processes sharing the queue file wake each other up.
+// Every push rewrites a small file next to the queue, which the other
+// processes watch, with inotify on Linux and by polling elsewhere, to
+// pick up the entries pushed past the end they know of. Entries pushed
+// with PushFront or in a transaction, and space freed by consumers, are
+// only seen after Refresh.
+func WithNotify() Option {
+	return func(o *options) {
+		o.notify = true
+	}
+}
+
+// WithScrub checks the entries in the queue in the background, like
+// Verify, a megabyte's worth every interval, so damage is noticed before
+// a consumer runs into it. After every pass over the queue, which stops
+// at the first problem, fn is called with its report. Problems are also
+// logged. fn may be nil.
+func WithScrub(interval time.Duration, fn func(Report)) Option {
+	return func(o *options) {
+		o.scrubInterval = interval
+		o.scrubFn = fn
+	}
+}
+
+// WithOverflow sends entries that don't fit to q, a queue opened by this
+// package, instead of failing with ErrNotEnoughSpace or ErrQueueFull.
+// Once an entry went there, later ones follow until the overflow is
+// empty again, so entries keep their order. Consumers don't see q: when
+// nothing is left to hand out here, entries are moved back from it as
+// far as they fit. Entries pushed with PushFront or in a transaction
+// never overflow. The queue doesn't close q.
+func WithOverflow(q Queue) Option {
+	return func(o *options) {
+		o.overflow = q
+	}
+}
+
+// WithReplayWindow holds back the space of the last n popped entries, so
+// Replay can still return them. It is not reused by pushes until newer
+// entries are popped, but it is given up on PushFront, Resize and when
+// the queue is reopened.
+func WithReplayWindow(n int) Option {
+	return func(o *options) {
+		o.replayWindow = n
+	}
+}
+
+// WithDiskReserve keeps headroom bytes of the queue's file system free.
+// Queue files are sparse, taking up disk blocks as entries are first
+// written to them, and again after WithPunchHoles, so a disk filling up
+// otherwise surfaces as a failed write, or SIGBUS on a mapped file.
+// Instead, creating, resizing and cloning a queue fail with ErrDiskFull
+// when the file wouldn't fit, and so do pushes and blobs that could take
+// the free space below headroom. Pushes only check the free space again
+// after writing as much as was left at the last check.
+func WithDiskReserve(headroom uint64) Option {
+	return func(o *options) {
+		o.diskReserve = true
+		o.diskHeadroom = headroom
+	}
+}
+
+// WithEvents calls sink with an Event every time an entry is pushed,
+// delivered, acked, expired or dead-lettered, in the order it happens, to
+// keep an audit trail of what passed through the queue. sink runs with the
+// queue locked, so it must not call the queue's methods, and every
+// operation waits for it.
+func WithEvents(sink func(Event)) Option {
+	return func(o *options) {
+		o.events = sink
+	}
+}
+
+// WithLogger sets the logger for the queue. By default nothing is logged.
+func WithLogger(l Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
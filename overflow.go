@@ -0,0 +1,124 @@
+package fqueue
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// spills reports whether f goes to the overflow queue: when it doesn't
+// fit here, and for as long as entries wait there, so entries keep their
+// order.
+func (q *circularFileQueue) spills(f frame) bool {
+	if q.overflow == nil {
+		return false
+	}
+
+	return q.spilled || q.checkEntries(1) == ErrQueueFull || f.length() > q.free()
+}
+
+// spill pushes f to the overflow queue instead. The blob of a blob entry
+// is read back and left for the caller to remove.
+func (q *circularFileQueue) spill(f frame, topic, key string, now time.Time) (uint64, error) {
+	m := Message{Topic: topic}
+	if f.flags&metaFlag != 0 {
+		if err := decodeMeta(f.meta, &m); err != nil {
+			return 0, err
+		}
+	}
+	data := bytes.Join(f.data, nil)
+	if f.src != nil {
+		buf := make([]byte, f.srcLen)
+		if _, err := io.ReadFull(f.src, buf); err != nil {
+			return 0, err
+		}
+		data = append(data, buf...)
+	}
+	if f.flags&blobFlag != 0 {
+		var err error
+		name, _ := parseBlobRef(data)
+		if data, err = q.blobs.read(name); err != nil {
+			return 0, err
+		}
+	}
+	m.Data = data
+	if err := q.overflow.PushMsg(m); err != nil {
+		return 0, err
+	}
+	q.spilled = true
+	q.dedup.add(key, now)
+	q.cond.Broadcast()
+
+	return 0, nil
+}
+
+// ready reports whether an entry can be handed out, moving entries back
+// from the overflow queue when there are none left here. The caller must
+// hold the lock.
+func (q *circularFileQueue) ready() bool {
+	if q.paused {
+		return false
+	}
+
+	return q.deliverable() > 0 || q.refill()
+}
+
+// refill moves entries from the overflow queue to the end of this one, in
+// order, while they fit, and reports whether it moved any.
+func (q *circularFileQueue) refill() bool {
+	moved := false
+	for q.spilled && q.writing == 0 {
+		m, token, ok, err := q.overflow.tryReserve()
+		if err != nil {
+			q.logError("fqueue: reading overflow failed", err)
+			return moved
+		}
+		if !ok {
+			q.spilled = false
+			break
+		}
+		err = q.unspill(m)
+		if err != nil {
+			q.logError("fqueue: returning entry to overflow failed", q.overflow.Abort(token))
+			if !errors.Is(err, ErrNotEnoughSpace) && err != ErrQueueFull {
+				q.logError("fqueue: moving entry from overflow failed", err)
+			}
+			return moved
+		}
+		q.logError("fqueue: committing entry to overflow failed", q.overflow.Commit(token))
+		moved = true
+	}
+
+	return moved
+}
+
+// unspill appends m, taken from the overflow queue, with the time it was
+// first pushed.
+func (q *circularFileQueue) unspill(m Message) error {
+	var name string
+	if q.opts.blobs && q.wantsBlob(uint64(len(m.Data))) {
+		if err := q.opts.budget.take(int64(len(m.Data))); err != nil {
+			return err
+		}
+		var err error
+		if name, err = q.blobs.write(bytes.NewReader(m.Data), int64(len(m.Data))); err != nil {
+			return err
+		}
+		m.Data = blobRef(name, int64(len(m.Data)))
+	}
+	f := newFrame(m)
+	f.time = m.Time.UnixNano()
+	if name != "" {
+		f.flags |= blobFlag
+	}
+	if err := q.checkFrame(f); err != nil {
+		return err
+	}
+	_, err := q.appendFrame(f, m.Topic, "", time.Now(), EventRefilled)
+	if err != nil && name != "" {
+		q.logError("fqueue: removing blob failed", q.blobs.remove(name))
+	}
+
+	return err
+}
@@ -0,0 +1,24 @@
+package fqueue
+
+// Pause stops entries from being handed out until Resume is called: Pop,
+// PopMsg, PopTopic and Reserve block, and Pop on a transaction finds
+// nothing. Pushes, commits and aborts carry on. The paused state is not
+// persisted.
+func (q *circularFileQueue) Pause() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.paused {
+		q.paused = true
+		q.opts.logger.Info("fqueue: paused", "queue", q.name)
+	}
+}
+
+func (q *circularFileQueue) Resume() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.paused {
+		q.paused = false
+		q.opts.logger.Info("fqueue: resumed", "queue", q.name)
+		q.cond.Broadcast()
+	}
+}
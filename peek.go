@@ -0,0 +1,76 @@
+package fqueue
+
+import "encoding/binary"
+
+// PeekSize returns the length of the data of the entry the next Pop would
+// return, without reading it, or false if there is none. The length is as
+// stored, before any pop interceptors run.
+func (q *circularFileQueue) PeekSize() (int, bool) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return 0, false
+	}
+
+	pos, ok, err := q.head()
+	if err == nil && ok {
+		var n int64
+		if n, err = q.dataLength(pos); err == nil {
+			return int(n), true
+		}
+	}
+	q.logError("fqueue: peek failed", err)
+
+	return 0, false
+}
+
+// dataLength returns the length of the data of the entry at pos, which
+// for blob entries is that of the blob.
+func (q *circularFileQueue) dataLength(pos uint32) (int64, error) {
+	length, flags, err := q.frameAt(pos)
+	if err != nil {
+		return 0, err
+	}
+	if flags&blobFlag != 0 {
+		if q.blobs == nil {
+			return 0, ErrCorrupted
+		}
+		name, size, _, err := q.blobRefAt(pos)
+		if err == nil && size < 0 {
+			size, err = q.blobs.size(name)
+		}
+
+		return size, err
+	}
+	n := length - seqLength - timeLength
+	if flags&metaFlag == 0 {
+		return int64(n), nil
+	}
+	buf := make([]byte, metaLenLength)
+	if _, err := q.readRing(buf, q.advance(pos, preLength+seqLength+timeLength)); err != nil {
+		return 0, err
+	}
+
+	return int64(n - metaLenLength - binary.BigEndian.Uint32(buf)), nil
+}
+
+// head returns the position of the entry the next consumer gets, skipping
+// removed entries without consuming them.
+func (q *circularFileQueue) head() (uint32, bool, error) {
+	if len(q.redeliver) > 0 {
+		return q.redeliver[0].pos, true, nil
+	}
+	pos := q.read
+	for i := uint32(0); i < q.unread; i++ {
+		length, flags, err := q.frameAt(pos)
+		if err != nil {
+			return 0, false, err
+		}
+		if flags&deadFlag == 0 {
+			return pos, true, nil
+		}
+		pos = q.advance(pos, preLength+length+sufLength)
+	}
+
+	return 0, false, nil
+}
@@ -0,0 +1,143 @@
+package fqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"fqueue/internal/retry"
+)
+
+// StageFunc transforms an entry on its way from one queue to the next.
+// Returning nil data and a nil error drops the entry.
+type StageFunc func(ctx context.Context, data []byte) ([]byte, error)
+
+type stage struct {
+	src, dst Queue
+	fn       StageFunc
+	workers  int
+}
+
+// Pipeline moves entries through a chain of queues, transforming them
+// along the way. An entry is committed to its source only once the result
+// is in the destination, so a crash in between means it is processed
+// again.
+type Pipeline struct {
+	stages  []stage
+	errs    Queue
+	onError func(stage int, err error)
+}
+
+func NewPipeline() *Pipeline {
+	return &Pipeline{}
+}
+
+// Stage adds a stage that pops from src, passes entries to fn on the
+// given number of workers and pushes the results to dst. It returns p to
+// allow chaining.
+func (p *Pipeline) Stage(src, dst Queue, fn StageFunc, workers int) *Pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	p.stages = append(p.stages, stage{src: src, dst: dst, fn: fn, workers: workers})
+	return p
+}
+
+// Errors sets a queue that entries are moved to, unchanged, when a stage
+// function fails on them. Without one, a failure stops the pipeline and
+// the entry is left in its source.
+func (p *Pipeline) Errors(q Queue) *Pipeline {
+	p.errs = q
+	return p
+}
+
+// OnError sets a handler called with the stage index for every failure of
+// a stage function.
+func (p *Pipeline) OnError(fn func(stage int, err error)) *Pipeline {
+	p.onError = fn
+	return p
+}
+
+// Run runs every stage until ctx is done or a stage fails. Entries being
+// processed when that happens are returned to their source, and failures
+// to do so are joined to the error returned. Run waits for all workers to
+// stop before it returns.
+func (p *Pipeline) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var errs []error
+	for i, s := range p.stages {
+		for n := 0; n < s.workers; n++ {
+			wg.Add(1)
+			go func(i int, s stage) {
+				defer wg.Done()
+				err := p.work(ctx, i, s)
+				if err == nil {
+					return
+				}
+				lock.Lock()
+				defer lock.Unlock()
+				// Workers stopped by the first failure only report what
+				// else went wrong, such as an Abort failing.
+				if len(errs) == 0 || err != ctx.Err() {
+					errs = append(errs, err)
+				}
+				cancel()
+			}(i, s)
+		}
+	}
+	wg.Wait()
+	if len(errs) == 1 {
+		return errs[0]
+	}
+
+	return errors.Join(errs...)
+}
+
+func (p *Pipeline) work(ctx context.Context, i int, s stage) error {
+	for {
+		data, token, err := s.src.ReserveContext(ctx)
+		if err != nil {
+			return err
+		}
+		out, err := s.fn(ctx, data)
+		dst := s.dst
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.Join(ctx.Err(), s.src.Abort(token))
+			}
+			if p.onError != nil {
+				p.onError(i, err)
+			}
+			if p.errs == nil {
+				return errors.Join(fmt.Errorf("pipeline stage %d: %w", i, err), s.src.Abort(token))
+			}
+			out, dst = data, p.errs
+		}
+		if out != nil {
+			if err := pushWait(ctx, dst, out); err != nil {
+				return errors.Join(err, s.src.Abort(token))
+			}
+		}
+		if err := s.src.Commit(token); err != nil {
+			return err
+		}
+	}
+}
+
+// pushWait is Push that waits for space when q is full.
+func pushWait(ctx context.Context, q Queue, data []byte) error {
+	b := retry.Backoff{Min: 10 * time.Millisecond, Max: time.Second}
+	return retry.Do(ctx, b, nil, func(context.Context) error {
+		err := q.Push(data)
+		if err != nil && !errors.Is(err, ErrNotEnoughSpace) {
+			return retry.Stop(err)
+		}
+		return err
+	})
+}
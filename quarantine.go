@@ -0,0 +1,192 @@
+package fqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"sync"
+	"time"
+)
+
+const quarantineExt = ".quarantine"
+
+// QuarantinedEntry is an entry set aside with Quarantine.
+type QuarantinedEntry struct {
+	Message
+	// Note is the reason given to Quarantine.
+	Note string
+	// At is when the entry was quarantined.
+	At time.Time
+}
+
+// quarantine holds quarantined entries, persisted in a file next to the
+// queue that is rewritten on every change.
+type quarantine struct {
+	path    string
+	mode    os.FileMode
+	budget  budgetFunc
+	lock    sync.Mutex
+	entries []QuarantinedEntry
+}
+
+func loadQuarantine(path string, fresh bool, mode os.FileMode) (*quarantine, error) {
+	qr := &quarantine{path: path, mode: mode}
+	if fresh {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return qr, nil
+	}
+
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return qr, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for len(buf) > 0 {
+		var e QuarantinedEntry
+		var at uint64
+		var meta, data string
+		if e.Seq, buf, err = readUvarint(buf); err != nil {
+			return nil, err
+		}
+		if at, buf, err = readUvarint(buf); err != nil {
+			return nil, err
+		}
+		if e.Note, buf, err = readString(buf); err != nil {
+			return nil, err
+		}
+		if meta, buf, err = readString(buf); err != nil {
+			return nil, err
+		}
+		if data, buf, err = readString(buf); err != nil {
+			return nil, err
+		}
+		if err := decodeMeta([]byte(meta), &e.Message); err != nil {
+			return nil, err
+		}
+		e.At, e.Data = time.Unix(0, int64(at)), []byte(data)
+		qr.entries = append(qr.entries, e)
+	}
+
+	return qr, nil
+}
+
+func (qr *quarantine) save(entries []QuarantinedEntry) error {
+	var buf []byte
+	for i := range entries {
+		e := &entries[i]
+		buf = binary.AppendUvarint(buf, e.Seq)
+		buf = binary.AppendUvarint(buf, uint64(e.At.UnixNano()))
+		buf = appendString(buf, e.Note)
+		buf = appendString(buf, string(encodeMeta(&e.Message)))
+		buf = appendString(buf, string(e.Data))
+	}
+
+	if err := qr.budget.take(int64(len(buf))); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(qr.path, bytes.NewReader(buf), int64(len(buf)), qr.mode); err != nil {
+		return err
+	}
+	qr.entries = entries
+
+	return nil
+}
+
+// take removes the entry with the given sequence number and returns it.
+func (qr *quarantine) take(seq uint64) (QuarantinedEntry, error) {
+	for i, e := range qr.entries {
+		if e.Seq != seq {
+			continue
+		}
+		rest := append(append([]QuarantinedEntry(nil), qr.entries[:i]...), qr.entries[i+1:]...)
+		return e, qr.save(rest)
+	}
+
+	return QuarantinedEntry{}, ErrNotQuarantined
+}
+
+// Quarantine sets the entry handed out under token aside with a note
+// explaining why, committing it in the queue. Quarantined entries are
+// kept in a file next to the queue until requeued or purged.
+func (q *circularFileQueue) Quarantine(token Token, note string) error {
+	// The quarantine is locked first, as RequeueQuarantined pushes while
+	// holding it.
+	qr := q.quarantine
+	qr.lock.Lock()
+	defer qr.lock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	r, ok := q.tokens[token]
+	if !ok {
+		return ErrUnknownToken
+	}
+	m, _, err := q.deliver(r.pos, OpPop)
+	if err != nil {
+		return err
+	}
+
+	e := QuarantinedEntry{Message: m, Note: note, At: time.Now()}
+	if err := qr.save(append(append([]QuarantinedEntry(nil), qr.entries...), e)); err != nil {
+		return err
+	}
+	delete(q.tokens, token)
+	r.stopTimer()
+	q.opts.logger.Warn("fqueue: quarantined entry", "queue", q.name, "seq", m.Seq, "note", note)
+	q.emit(EventDeadLettered, r.seq, r.topic)
+
+	return q.consume(r)
+}
+
+// Quarantined returns the quarantined entries, oldest first.
+func (q *circularFileQueue) Quarantined() []QuarantinedEntry {
+	qr := q.quarantine
+	qr.lock.Lock()
+	defer qr.lock.Unlock()
+
+	return append([]QuarantinedEntry(nil), qr.entries...)
+}
+
+// RequeueQuarantined pushes the quarantined entry that had sequence
+// number seq back into the queue, as a new entry, and removes it from
+// quarantine.
+func (q *circularFileQueue) RequeueQuarantined(seq uint64) error {
+	qr := q.quarantine
+	qr.lock.Lock()
+	defer qr.lock.Unlock()
+	for _, e := range qr.entries {
+		if e.Seq != seq {
+			continue
+		}
+		if err := q.PushMsg(Message{Topic: e.Topic, Headers: e.Headers, Data: e.Data}); err != nil {
+			return err
+		}
+		_, err := qr.take(seq)
+		return err
+	}
+
+	return ErrNotQuarantined
+}
+
+// PurgeQuarantined discards the quarantined entry that had sequence number
+// seq.
+func (q *circularFileQueue) PurgeQuarantined(seq uint64) error {
+	qr := q.quarantine
+	qr.lock.Lock()
+	defer qr.lock.Unlock()
+	e, err := qr.take(seq)
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	q.emit(EventRemoved, e.Seq, e.Topic)
+	q.lock.Unlock()
+
+	return nil
+}
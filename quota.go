@@ -0,0 +1,54 @@
+package fqueue
+
+// quota bounds what a topic may take of the queue, see WithTopicQuota.
+type quota struct {
+	entries uint32
+	bytes   uint32
+}
+
+// checkQuota fails with ErrQuotaExceeded if n more entries of topic,
+// taking size bytes, would go over its quota.
+func (q *circularFileQueue) checkQuota(topic string, n, size uint32) error {
+	l, ok := q.opts.quotas[topic]
+	if !ok {
+		return nil
+	}
+	if l.entries > 0 && q.topics[topic]+n > l.entries || l.bytes > 0 && q.topicBytes[topic]+size > l.bytes {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// trackTopic counts n entries of topic taking size bytes, framing
+// included.
+func (q *circularFileQueue) trackTopic(topic string, n, size uint32) {
+	q.topics[topic] += n
+	if q.topicBytes != nil {
+		q.topicBytes[topic] += size
+	}
+}
+
+// resetTopics forgets what every topic takes. The space is only kept
+// track of when there are quotas to enforce.
+func (q *circularFileQueue) resetTopics() {
+	q.topics = make(map[string]uint32)
+	q.topicBytes = nil
+	if len(q.opts.quotas) > 0 {
+		q.topicBytes = make(map[string]uint32)
+	}
+}
+
+// sizeAt returns the space taken by the frame at pos, if it counts
+// towards topic quotas.
+func (q *circularFileQueue) sizeAt(pos uint32) uint32 {
+	if q.topicBytes == nil {
+		return 0
+	}
+	length, _, err := q.frameAt(pos)
+	if err != nil {
+		return 0
+	}
+
+	return preLength + length + sufLength
+}
@@ -0,0 +1,62 @@
+package fqueue
+
+import (
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket expressed as a theoretical arrival time: each
+// caller is handed the next free slot, so callers queued behind an empty
+// bucket are released one interval apart instead of all at once.
+type limiter struct {
+	lock      sync.Mutex
+	interval  time.Duration
+	tolerance time.Duration
+	tat       time.Time
+}
+
+func newLimiter(perSecond float64, burst int) *limiter {
+	l := &limiter{}
+	l.set(perSecond, burst)
+
+	return l
+}
+
+// set changes the rate, with a non-positive perSecond lifting the limit.
+func (l *limiter) set(perSecond float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	var interval time.Duration
+	if perSecond > 0 {
+		interval = time.Duration(float64(time.Second) / perSecond)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.interval = interval
+	l.tolerance = time.Duration(burst-1) * interval
+}
+
+func (l *limiter) wait() {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	if l.interval == 0 {
+		l.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.tat.Before(now) {
+		l.tat = now
+	}
+	at := l.tat.Add(-l.tolerance)
+	l.tat = l.tat.Add(l.interval)
+	l.lock.Unlock()
+
+	if d := at.Sub(now); d > 0 {
+		time.Sleep(d)
+	}
+}
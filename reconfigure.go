@@ -0,0 +1,86 @@
+package fqueue
+
+import "reflect"
+
+// reconfigurable lists the options fields Reconfigure may change.
+var reconfigurable = map[string]bool{
+	"syncOnPush":        true,
+	"syncWindow":        true,
+	"metaFlushEvery":    true,
+	"metaFlushInterval": true,
+	"highWatermark":     true,
+	"lowWatermark":      true,
+	"onHigh":            true,
+	"onLow":             true,
+	"popRate":           true,
+	"popBurst":          true,
+	"retainBytes":       true,
+	"retainAge":         true,
+}
+
+// Reconfigure changes the sync policy (WithSyncOnPush, WithMetaFlush),
+// watermarks, pop rate and retention of the open queue, as if it had been
+// opened with opts: those of these settings opts leave out go back to
+// their defaults, so Reconfigure() turns them all off. It fails with
+// ErrFixedOption, changing nothing, if opts set anything else.
+func (q *circularFileQueue) Reconfigure(opts ...Option) error {
+	var probe options
+	for _, opt := range opts {
+		opt(&probe)
+	}
+	v := reflect.ValueOf(probe)
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Field(i).IsZero() && !reconfigurable[v.Type().Field(i).Name] {
+			return ErrFixedOption
+		}
+	}
+	n := defaultOptions()
+	for _, opt := range opts {
+		opt(&n)
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	o := &q.opts
+	o.syncOnPush, o.syncWindow = n.syncOnPush, n.syncWindow
+	q.group.set(n.syncOnPush, n.syncWindow)
+	o.metaFlushEvery = n.metaFlushEvery
+	if o.metaFlushInterval != n.metaFlushInterval {
+		o.metaFlushInterval = n.metaFlushInterval
+		select {
+		case q.flushReset <- struct{}{}:
+		default:
+		}
+	}
+	o.highWatermark, o.lowWatermark = n.highWatermark, n.lowWatermark
+	o.onHigh, o.onLow = n.onHigh, n.onLow
+	if o.highWatermark <= 0 {
+		q.aboveHWM = false
+	}
+	q.checkWatermarks()
+	o.popRate, o.popBurst = n.popRate, n.popBurst
+	q.limiter.set(n.popRate, n.popBurst)
+	o.retainBytes, o.retainAge = n.retainBytes, n.retainAge
+	q.startLoops()
+	q.opts.logger.Info("fqueue: reconfigured", "queue", q.name)
+
+	return nil
+}
+
+// startLoops starts the header flush and retention loops if their
+// settings call for them and they aren't running yet. The loops stop by
+// themselves once their settings are turned off. The caller must hold
+// the lock, unless the queue isn't shared yet.
+func (q *circularFileQueue) startLoops() {
+	if q.opts.metaFlushInterval > 0 && !q.flushing {
+		q.flushing = true
+		go q.flushLoop()
+	}
+	if (q.opts.retainBytes > 0 || q.opts.retainAge > 0) && !q.retaining {
+		q.retaining = true
+		go q.retentionLoop()
+	}
+}
@@ -0,0 +1,253 @@
+package fqueue
+
+import "fmt"
+
+// recover rebuilds the in-memory counters from the entries between start
+// and end, then picks up entries pushed after the header was last written.
+// Those are recognised by their sequence numbers continuing from the one
+// recorded in the header; stale frames left over from earlier laps always
+// carry smaller ones. Every entry's checksum is checked, since entries
+// pushed after the header may have been written over consumed ones it
+// still counts and been torn by a crash.
+func (q *circularFileQueue) recover() error {
+	q.dead = 0
+	pos := q.start
+	for i := uint32(0); i < q.count; i++ {
+		length, flags, ok, err := q.intactAt(pos, q.capacity-headPos)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &LayoutError{Reason: fmt.Sprintf("entry %d from start %d is corrupt", i, q.start)}
+		}
+		if err := q.track(pos, flags); err != nil {
+			return err
+		}
+		pos = q.advance(pos, preLength+length+sufLength)
+	}
+	if pos != q.end {
+		return &LayoutError{Reason: fmt.Sprintf("%d entries from start %d end at %d, not %d", q.count, q.start, pos, q.end)}
+	}
+
+	recovered, err := q.adoptPastEnd()
+	if err != nil {
+		return err
+	}
+	if recovered > 0 {
+		q.opts.logger.Info("fqueue: recovered entries past header", "queue", q.name, "entries", recovered)
+		return q.writeMeta()
+	}
+
+	return nil
+}
+
+// adoptPastEnd extends the queue over the entries found past end and
+// returns how many there were.
+func (q *circularFileQueue) adoptPastEnd() (uint32, error) {
+	n := uint32(0)
+	for {
+		length, flags, ok, err := q.frameAfterEnd()
+		if err != nil || !ok {
+			return n, err
+		}
+		if err := q.track(q.end, flags); err != nil {
+			return n, err
+		}
+		q.end = q.advance(q.end, preLength+length+sufLength)
+		q.count++
+		q.nextSeq++
+		n++
+	}
+}
+
+func (q *circularFileQueue) track(pos, flags uint32) error {
+	if flags&deadFlag != 0 {
+		q.dead++
+		return nil
+	}
+	m, err := q.metaAt(pos)
+	if err != nil {
+		return err
+	}
+	q.trackTopic(m.Topic, 1, q.sizeAt(pos))
+
+	return nil
+}
+
+// frameAfterEnd reports whether a complete, committed entry carrying the
+// next sequence number starts at end.
+func (q *circularFileQueue) frameAfterEnd() (uint32, uint32, bool, error) {
+	length, flags, ok, err := q.intactAt(q.end, q.free())
+	if err != nil || !ok || flags&pendingFlag != 0 {
+		return 0, 0, false, err
+	}
+	seq, _, err := q.stampAt(q.end)
+	if err != nil || seq != q.nextSeq {
+		return 0, 0, false, err
+	}
+
+	return length, flags, true, nil
+}
+
+// mark is where a header slot put the queue.
+type mark struct {
+	start, count uint32
+	nextSeq      uint64
+}
+
+// found is an intact entry located by scan.
+type found struct {
+	pos, next uint32
+	seq       uint64
+}
+
+// scan returns the intact entries anywhere in the file, in file order.
+func (q *circularFileQueue) scan() ([]found, error) {
+	var frames []found
+	span := q.capacity - headPos
+	pos := headPos
+	for scanned := uint32(0); scanned < span; {
+		length, _, ok, err := q.intactAt(pos, span)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			pos = q.advance(pos, 1)
+			scanned++
+			continue
+		}
+		seq, _, err := q.stampAt(pos)
+		if err != nil {
+			return nil, err
+		}
+		n := preLength + length + sufLength
+		frames = append(frames, found{pos: pos, next: q.advance(pos, n), seq: seq})
+		pos = q.advance(pos, n)
+		scanned += n
+	}
+
+	return frames, nil
+}
+
+// stale fails if an intact entry was pushed after the header and can't be
+// reached from it, which happens when an older header slot is in use.
+// Frames left from earlier laps carry smaller sequence numbers.
+func (q *circularFileQueue) stale() error {
+	frames, err := q.scan()
+	if err != nil {
+		return err
+	}
+	for _, f := range frames {
+		if f.seq >= q.nextSeq {
+			return &LayoutError{Reason: fmt.Sprintf("entry %d found, header expects %d next", f.seq, q.nextSeq)}
+		}
+	}
+
+	return nil
+}
+
+// rebuild works out start, end and the count from the entries themselves
+// when the headers contradict them. If the marks place the start of the
+// queue, it runs from there as long as adjacent intact entries carry
+// increasing sequence numbers, stopping at the first hole a crash left.
+// Otherwise it is taken to be the longest such run ending at the most
+// recent entry. Entries consumed just before that run can't be told apart
+// from it, so they are delivered again unless the header's start still
+// points into the run.
+func (q *circularFileQueue) rebuild(marks []mark) error {
+	frames, err := q.scan()
+	if err != nil {
+		return err
+	}
+	byPos, byNext := make(map[uint32]int), make(map[uint32]int)
+	last := -1
+	for i, f := range frames {
+		byPos[f.pos], byNext[f.next] = i, i
+		if last < 0 || f.seq > frames[last].seq {
+			last = i
+		}
+	}
+
+	start, end, count, nextSeq := uint32(headPos), uint32(headPos), uint32(0), q.nextSeq
+	if last >= 0 && frames[last].seq >= nextSeq {
+		nextSeq = frames[last].seq + 1
+	}
+	// Entries consumed before the newest header was written never come
+	// back.
+	var low uint64
+	for _, m := range marks {
+		if m.nextSeq-uint64(m.count) > low {
+			low = m.nextSeq - uint64(m.count)
+		}
+		if m.nextSeq > nextSeq {
+			nextSeq = m.nextSeq
+		}
+	}
+	// Entries a header counted can only have been written over once
+	// consumed, so those still queued end with the last one it counted,
+	// run back from there. The run reaching furthest back is the queue.
+	// An empty header's queue starts with the first entry pushed after it,
+	// if any.
+	first := -1
+	for _, m := range marks {
+		cur := -1
+		if i, ok := byPos[m.start]; ok && m.count == 0 && frames[i].seq == m.nextSeq && m.nextSeq >= low {
+			cur = i
+		}
+		for i, f := range frames {
+			if m.count > 0 && f.seq == m.nextSeq-1 && f.seq >= low {
+				cur = i
+			}
+		}
+		for cur >= 0 && frames[cur].pos != m.start {
+			prev, ok := byNext[frames[cur].pos]
+			if !ok || frames[prev].seq >= frames[cur].seq || frames[prev].seq < low {
+				break
+			}
+			cur = prev
+		}
+		if cur >= 0 && (first < 0 || frames[cur].seq < frames[first].seq) {
+			first = cur
+		}
+	}
+	if first >= 0 {
+		cur := first
+		count = 1
+		for int(count) < len(frames) {
+			next, ok := byPos[frames[cur].next]
+			if !ok || frames[next].seq <= frames[cur].seq {
+				break
+			}
+			cur = next
+			count++
+		}
+		start, end = frames[first].pos, frames[cur].next
+	} else if last >= 0 && frames[last].seq >= low {
+		cur := last
+		count = 1
+		for frames[cur].pos != q.start && int(count) < len(frames) {
+			prev, ok := byNext[frames[cur].pos]
+			if !ok || frames[prev].seq >= frames[cur].seq || frames[prev].seq < low {
+				break
+			}
+			cur = prev
+			count++
+		}
+		start, end = frames[cur].pos, frames[last].next
+		if q.start == end {
+			start, count = end, 0
+		}
+	}
+	if nextSeq == 0 {
+		nextSeq = 1
+	}
+
+	q.start, q.end, q.count, q.nextSeq = start, end, count, nextSeq
+	q.resetTopics()
+	if err := q.recover(); err != nil {
+		return err
+	}
+	q.opts.logger.Info("fqueue: rebuilt header", "queue", q.name, "entries", q.count)
+
+	return q.writeMeta()
+}
@@ -0,0 +1,163 @@
+// Package redis mirrors entries between a local queue and a Redis Stream,
+// so consumers already reading the stream see what was buffered locally.
+// It is written against the small Client interface below, whose methods
+// map directly onto XADD, XREADGROUP and XACK.
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"fqueue"
+	"fqueue/internal/bridge"
+	"fqueue/internal/retry"
+)
+
+// Entry is a stream entry with its field-value pairs.
+type Entry struct {
+	ID     string
+	Values map[string]any
+}
+
+type Client interface {
+	XAdd(ctx context.Context, stream string, values map[string]any) error
+	// XReadGroup reads up to count entries for consumer in group, after
+	// id: ">" for entries never delivered to the group, "0" for those
+	// delivered to consumer but not acknowledged. Reading with ">" should
+	// block for a while when there is nothing new.
+	XReadGroup(ctx context.Context, stream, group, consumer, id string, count int64) ([]Entry, error)
+	XAck(ctx context.Context, stream, group string, ids ...string) error
+}
+
+type Option func(*options)
+
+type options struct {
+	bridge.Options
+	field string
+	count int64
+}
+
+func defaultOptions() options {
+	return options{
+		Options: bridge.DefaultOptions(),
+		field:   "data",
+		count:   100,
+	}
+}
+
+// WithBackoff sets the delay between retries, which starts at min and
+// doubles up to max. The default is 100ms to 30s.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.Backoff = retry.Backoff{Min: min, Max: max}
+	}
+}
+
+// WithField sets the stream entry field holding the queue entry, "data"
+// by default.
+func WithField(field string) Option {
+	return func(o *options) {
+		o.field = field
+	}
+}
+
+// WithBatch sets how many entries Fill reads at once, 100 by default.
+func WithBatch(count int64) Option {
+	return func(o *options) {
+		o.count = count
+	}
+}
+
+// WithErrorHandler is called with every failure that is going to be
+// retried, and for every stream entry dropped by Fill.
+func WithErrorHandler(fn func(error)) Option {
+	return func(o *options) {
+		o.OnError = fn
+	}
+}
+
+// Forwarder appends the entries of a queue to a stream. Each entry is
+// reserved, added, and committed to the queue only once XADD succeeded,
+// so entries are added at least once and in order.
+type Forwarder struct {
+	q      fqueue.Queue
+	c      Client
+	stream string
+	opts   options
+}
+
+func NewForwarder(q fqueue.Queue, c Client, stream string, opts ...Option) *Forwarder {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Forwarder{q: q, c: c, stream: stream, opts: o}
+}
+
+// Run forwards entries until ctx is done, retrying failed adds
+// indefinitely. The entry being added when ctx is done is returned to the
+// queue.
+func (f *Forwarder) Run(ctx context.Context) error {
+	return bridge.Forward(ctx, f.q, f.opts.Options, func(ctx context.Context, data []byte) error {
+		return f.c.XAdd(ctx, f.stream, map[string]any{f.opts.field: data})
+	})
+}
+
+// Fill pushes entries read from stream as consumer in group into q until
+// ctx is done, acknowledging each one after it is in the queue. Entries
+// delivered to consumer before but never acknowledged, because of a
+// crash, are pushed first. Entries without the configured field are
+// acknowledged and dropped. Pushes that fail because the queue is full
+// are retried; any other push error stops Fill.
+func Fill(ctx context.Context, c Client, q fqueue.Queue, stream, group, consumer string, opts ...Option) error {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	id := "0"
+	for {
+		var entries []Entry
+		err := retry.Do(ctx, o.Backoff, o.OnError, func(ctx context.Context) (err error) {
+			entries, err = c.XReadGroup(ctx, stream, group, consumer, id, o.count)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 && id == "0" {
+			id = ">"
+			continue
+		}
+
+		for _, e := range entries {
+			data, ok := value(e.Values[o.field])
+			if ok {
+				if err := bridge.Push(ctx, q, o.Options, data); err != nil {
+					return err
+				}
+			} else if o.OnError != nil {
+				o.OnError(fmt.Errorf("redis: entry %s has no field %q", e.ID, o.field))
+			}
+			err = retry.Do(ctx, o.Backoff, o.OnError, func(ctx context.Context) error {
+				return c.XAck(ctx, stream, group, e.ID)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func value(v any) ([]byte, bool) {
+	switch v := v.(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	default:
+		return nil, false
+	}
+}
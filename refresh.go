@@ -0,0 +1,57 @@
+package fqueue
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Refresh reloads the queue's state from the file, picking up changes
+// made by a repair tool or another process since it was opened. Entries
+// handed out by Reserve and not yet committed are forgotten, so their
+// tokens become unknown and the entries are delivered again.
+func (q *circularFileQueue) Refresh() error {
+	q.wlock.Lock()
+	defer q.wlock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	buf := make([]byte, headPos)
+	if _, err := q.s.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	i, _, ok := newestSlot(buf)
+	if !ok {
+		return errNoHeader
+	}
+	if capacity := binary.BigEndian.Uint32(slotIn(buf, i)[capTagPos:]); capacity != q.capacity {
+		return &LayoutError{Reason: fmt.Sprintf("header capacity %d, mapped %d", capacity, q.capacity)}
+	}
+
+	for _, r := range q.tokens {
+		r.stopTimer()
+	}
+	q.tokens = make(map[Token]*reservation)
+	q.inflight, q.redeliver = nil, nil
+	q.resetTopics()
+	if err := q.load(); err != nil {
+		return err
+	}
+	if q.ledger != nil {
+		if err := q.skipProcessed(); err != nil {
+			return err
+		}
+	}
+	cursors, err := loadCursors(q.name+cursorsExt, false, q.opts.mode)
+	if err != nil {
+		return err
+	}
+	q.cursors = cursors
+	q.checkWatermarks()
+	q.opts.logger.Info("fqueue: refreshed", "queue", q.name, "entries", q.count)
+	q.cond.Broadcast()
+
+	return nil
+}
@@ -0,0 +1,58 @@
+package fqueue
+
+// releasePages releases the whole pages between the last released
+// position and the floor, which hold nothing but consumed entries. The
+// page the floor is in is released once it moves past it.
+func (q *circularFileQueue) releasePages() {
+	to := q.floor()
+	if !q.opts.releaseConsumed && !q.opts.punchHoles || q.advised == to {
+		return
+	}
+
+	from := q.advised
+	if q.opts.punchHoles {
+		from = q.unusedFrom(from)
+	}
+	switch {
+	case from == to:
+	case from < to:
+		q.releaseRange(from, to)
+	default:
+		q.releaseRange(from, q.capacity)
+		q.releaseRange(headPos, to)
+	}
+	q.advised = to
+	if down := uint32(int64(to) / pageSize * pageSize); down > headPos {
+		q.advised = down
+	}
+}
+
+func (q *circularFileQueue) releaseRange(from, to uint32) {
+	lo := (int64(from) + pageSize - 1) / pageSize * pageSize
+	hi := int64(to) / pageSize * pageSize
+	if lo >= hi {
+		return
+	}
+	if p, ok := q.s.(holePuncher); ok && q.opts.punchHoles {
+		q.logError("fqueue: punching hole failed", p.PunchHole(lo, hi-lo))
+		return
+	}
+	q.logError("fqueue: releasing pages failed", q.s.Release(lo, hi-lo))
+}
+
+// unusedFrom moves pos, from which the space up to the floor is about to be
+// released, forward to where the free space begins if it isn't in it.
+// Punching holes loses data, unlike dropping pages from the cache, so
+// this keeps the page end is in, and whatever is written past end, from
+// being punched along with the consumed entries.
+func (q *circularFileQueue) unusedFrom(pos uint32) uint32 {
+	if q.used() == 0 && q.writing == 0 {
+		return pos
+	}
+	free, to := q.advance(q.end, q.writing), q.floor()
+	if q.distance(pos, to) > q.distance(free, to) {
+		return free
+	}
+
+	return pos
+}
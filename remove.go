@@ -0,0 +1,76 @@
+package fqueue
+
+// RemoveIf marks every queued entry for which fn returns true as removed
+// and returns how many were removed. Removed entries are skipped by
+// consumers and their space is reclaimed once consumption reaches them.
+// Entries currently handed out by Reserve are not considered.
+func (q *circularFileQueue) RemoveIf(fn func(data []byte) bool) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return 0
+	}
+
+	removed, err := q.removeIf(fn)
+	q.logError("fqueue: remove failed", err)
+	if removed == 0 {
+		return 0
+	}
+
+	q.dead += removed
+	q.logError("fqueue: remove failed", q.skipDead())
+	q.release()
+	q.logError("fqueue: persisting header failed", q.stateChanged())
+
+	return int(removed)
+}
+
+func (q *circularFileQueue) removeIf(fn func(data []byte) bool) (uint32, error) {
+	removed := uint32(0)
+	pos := q.read
+	for i := uint32(0); i < q.unread; i++ {
+		length, flags, err := q.frameAt(pos)
+		if err != nil {
+			return removed, err
+		}
+		next := q.advance(pos, preLength+length+sufLength)
+		if flags&deadFlag == 0 {
+			m, _, err := q.deliver(pos, OpPeek)
+			if err != nil {
+				return removed, err
+			}
+			if fn(m.Data) {
+				if err := q.markDead(pos); err != nil {
+					return removed, err
+				}
+				q.untrack(m.Topic, pos)
+				q.emit(EventRemoved, m.Seq, m.Topic)
+				removed++
+			}
+		}
+		pos = next
+	}
+
+	return removed, nil
+}
+
+// skipDead consumes removed entries sitting at the read position.
+func (q *circularFileQueue) skipDead() error {
+	for q.unread > 0 {
+		length, flags, err := q.frameAt(q.read)
+		if err != nil {
+			return err
+		}
+		if flags&deadFlag == 0 {
+			return nil
+		}
+		q.inflight = append(q.inflight, &reservation{pos: q.read, committed: true})
+		q.read = q.advance(q.read, preLength+length+sufLength)
+		q.unread--
+		if q.dead > 0 {
+			q.dead--
+		}
+	}
+
+	return nil
+}
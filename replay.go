@@ -0,0 +1,74 @@
+package fqueue
+
+// ReplayCursor reads entries in sequence order from a given sequence
+// number onward, whether they were consumed or not, without consuming
+// them. Consumed entries are only found until their space is reused, so
+// a gap in the sequence numbers returned means entries were lost.
+type ReplayCursor struct {
+	q    *circularFileQueue
+	next uint64
+	pos  uint32
+	hint bool
+}
+
+// NewReplayCursor returns a cursor starting at the entry with sequence
+// number fromSeq, or the first one retained after it.
+func (q *circularFileQueue) NewReplayCursor(fromSeq uint64) *ReplayCursor {
+	return &ReplayCursor{q: q, next: fromSeq}
+}
+
+// Next returns the next entry, or false once the cursor has caught up
+// with the most recently pushed one. A nil cursor has no entries.
+func (c *ReplayCursor) Next() (Message, bool, error) {
+	if c == nil {
+		return Message{}, false, nil
+	}
+	q := c.q
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return Message{}, false, ErrQueueClosed
+	}
+	if c.next >= q.nextSeq {
+		return Message{}, false, nil
+	}
+
+	pos, ok := c.pos, c.hint && c.at(c.pos)
+	if !ok {
+		var err error
+		if pos, ok, err = q.seek(c.next); err != nil || !ok {
+			return Message{}, false, err
+		}
+	}
+	m, next, err := q.deliver(pos, OpPeek)
+	if err != nil {
+		c.hint = false
+		return Message{}, false, err
+	}
+	c.next, c.pos, c.hint = m.Seq+1, next, true
+
+	return m, true, nil
+}
+
+// Seq returns the sequence number the cursor reads next.
+func (c *ReplayCursor) Seq() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	return c.next
+}
+
+// at reports whether the entry the cursor expects next is at pos, which
+// is the case as long as consecutive entries were written one after the
+// other and not since overwritten.
+func (c *ReplayCursor) at(pos uint32) bool {
+	q := c.q
+	_, flags, ok, err := q.intactAt(pos, q.capacity-headPos)
+	if err != nil || !ok || flags&(deadFlag|pendingFlag) != 0 {
+		return false
+	}
+	seq, _, err := q.stampAt(pos)
+
+	return err == nil && seq == c.next
+}
@@ -0,0 +1,307 @@
+package fqueue
+
+import (
+	"context"
+	"runtime/pprof"
+	"time"
+)
+
+// Token identifies an entry handed out by Reserve until it is committed or
+// aborted.
+type Token uint64
+
+type reservation struct {
+	pos       uint32
+	seq       uint64
+	topic     string
+	committed bool
+	timer     *time.Timer
+	attempts  int
+}
+
+func (q *circularFileQueue) Reserve() ([]byte, Token) {
+	defer q.observe(OpPop, time.Now())
+	q.limiter.wait()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.waitReady() != nil {
+		return nil, 0
+	}
+
+	r, m, err := q.next()
+	if err != nil {
+		q.logError("fqueue: reserve failed", err)
+		return nil, 0
+	}
+	q.hand(r)
+
+	return m.Data, q.nextToken
+}
+
+// ReserveContext is Reserve that gives up when ctx is done first. The
+// call runs with the queue's profiler labels added to those of ctx.
+func (q *circularFileQueue) ReserveContext(ctx context.Context) (data []byte, token Token, err error) {
+	pprof.Do(ctx, q.labels, func(ctx context.Context) {
+		data, token, err = q.reserveContext(ctx)
+	})
+
+	return data, token, err
+}
+
+func (q *circularFileQueue) reserveContext(ctx context.Context) ([]byte, Token, error) {
+	defer q.observe(OpPop, time.Now())
+	q.limiter.wait()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.waitReadyContext(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	r, m, err := q.next()
+	if err != nil {
+		return nil, 0, err
+	}
+	q.hand(r)
+
+	return m.Data, q.nextToken, nil
+}
+
+// tryReserve is Reserve for a whole message that returns false instead of
+// waiting when no entry can be handed out.
+func (q *circularFileQueue) tryReserve() (Message, Token, bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return Message{}, 0, false, ErrQueueClosed
+	}
+	if !q.available() {
+		return Message{}, 0, false, nil
+	}
+
+	r, m, err := q.next()
+	if err == errNoEntry {
+		return Message{}, 0, false, nil
+	}
+	if err != nil {
+		return Message{}, 0, false, err
+	}
+	q.hand(r)
+
+	return m, q.nextToken, true, nil
+}
+
+func (q *circularFileQueue) Commit(token Token) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	r, ok := q.tokens[token]
+	if !ok {
+		return ErrUnknownToken
+	}
+	delete(q.tokens, token)
+	r.stopTimer()
+
+	return q.commit(r)
+}
+
+func (q *circularFileQueue) Abort(token Token) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	r, ok := q.tokens[token]
+	if !ok {
+		return ErrUnknownToken
+	}
+	delete(q.tokens, token)
+	r.stopTimer()
+	q.requeue(r)
+
+	return nil
+}
+
+// Attempts returns how many times the entry behind token has been handed
+// out, this time included, or 0 if the token is unknown. Counts start over
+// when the queue is reopened.
+func (q *circularFileQueue) Attempts(token Token) int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if r, ok := q.tokens[token]; ok {
+		return r.attempts
+	}
+
+	return 0
+}
+
+// requeue makes r available again, unless it has used up its deliveries.
+func (q *circularFileQueue) requeue(r *reservation) {
+	if max := q.opts.maxDeliveries; max > 0 && r.attempts >= max && q.deadLetter(r) {
+		return
+	}
+	q.redeliver = append(q.redeliver, r)
+	q.cond.Broadcast()
+}
+
+// deadLetter moves r to the dead-letter queue, or drops it if there is
+// none, and reports whether it did.
+func (q *circularFileQueue) deadLetter(r *reservation) bool {
+	if dlq := q.opts.deadLetter; dlq != nil {
+		m, _, err := q.deliver(r.pos, OpPop)
+		if err == nil {
+			err = dlq.PushMsg(Message{Topic: m.Topic, Headers: m.Headers, Data: m.Data})
+		}
+		if err != nil {
+			q.logError("fqueue: moving entry to dead-letter queue failed", err)
+			return false
+		}
+	}
+	q.opts.logger.Warn("fqueue: entry exceeded max deliveries", "queue", q.name, "seq", r.seq, "attempts", r.attempts)
+	q.emit(EventDeadLettered, r.seq, r.topic)
+	q.logError("fqueue: persisting header failed", q.consume(r))
+
+	return true
+}
+
+// hand registers r under a new token. With a visibility timeout, r is
+// aborted if the token is still outstanding when the timeout expires.
+func (q *circularFileQueue) hand(r *reservation) {
+	q.nextToken++
+	token := q.nextToken
+	q.tokens[token] = r
+	if q.opts.visibility <= 0 {
+		return
+	}
+	r.timer = time.AfterFunc(q.opts.visibility, func() {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		if q.closed || q.tokens[token] != r {
+			return
+		}
+		delete(q.tokens, token)
+		r.timer = nil
+		q.opts.logger.Warn("fqueue: visibility timeout expired", "queue", q.name, "seq", r.seq)
+		q.requeue(r)
+	})
+}
+
+func (r *reservation) stopTimer() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+func (q *circularFileQueue) deliverable() uint32 {
+	live := uint32(len(q.redeliver))
+	if q.unread > q.dead {
+		live += q.unread - q.dead
+	}
+
+	return live
+}
+
+// next hands out the next entry, preferring aborted ones over fresh ones.
+// The caller must hold the lock and have checked deliverable.
+func (q *circularFileQueue) next() (*reservation, Message, error) {
+	return q.nextWith(func(pos uint32) (Message, uint32, error) {
+		return q.deliver(pos, OpPop)
+	})
+}
+
+// nextWith is next reading the entry with read, which returns it along
+// with the position of the following frame.
+func (q *circularFileQueue) nextWith(read func(pos uint32) (Message, uint32, error)) (*reservation, Message, error) {
+	if len(q.redeliver) > 0 {
+		r := q.redeliver[0]
+		m, _, err := read(r.pos)
+		if err != nil {
+			return nil, Message{}, err
+		}
+		q.redeliver = q.redeliver[1:]
+		r.attempts++
+		q.emit(EventDelivered, r.seq, r.topic)
+		return r, m, nil
+	}
+
+	var m Message
+	var pos uint32
+	for {
+		err := q.skipDead()
+		if err == nil {
+			if q.unread == 0 {
+				return nil, Message{}, errNoEntry
+			}
+			if m, pos, err = read(q.read); err == nil {
+				break
+			}
+		}
+		if !q.corruptAt(err) {
+			return nil, Message{}, err
+		}
+		if err := q.resync(); err != nil {
+			return nil, Message{}, err
+		}
+	}
+	r := &reservation{pos: q.read, seq: m.Seq, topic: m.Topic, attempts: 1}
+	q.inflight = append(q.inflight, r)
+	q.read = pos
+	q.unread--
+	q.emit(EventDelivered, r.seq, r.topic)
+
+	return r, m, nil
+}
+
+// commit marks r as consumed and persists the new start if that freed
+// any space.
+func (q *circularFileQueue) commit(r *reservation) error {
+	q.emit(EventAcked, r.seq, r.topic)
+
+	return q.consume(r)
+}
+
+// consume is commit for entries that leave the queue without being acked.
+func (q *circularFileQueue) consume(r *reservation) error {
+	r.committed = true
+	q.untrack(r.topic, r.pos)
+	q.life.Popped++
+	q.logError("fqueue: recording commit in ledger failed", q.ledger.add(r.seq))
+	if q.release() == 0 {
+		return nil
+	}
+
+	return q.stateChanged()
+}
+
+// release moves start past every committed entry at the front of the
+// in-flight list and returns how many were dropped. Entries committed out
+// of order keep their space, and are redelivered after a crash, until
+// everything before them is committed too.
+func (q *circularFileQueue) release() int {
+	n := 0
+	for n < len(q.inflight) && q.inflight[n].committed {
+		n++
+	}
+	if n == 0 {
+		return 0
+	}
+	if q.blobs != nil {
+		q.dropBlobs(q.inflight[:n])
+	}
+	q.keep(q.inflight[:n])
+	q.inflight = append(q.inflight[:0], q.inflight[n:]...)
+	q.count -= uint32(n)
+	if len(q.inflight) > 0 {
+		q.start = q.inflight[0].pos
+	} else {
+		q.start = q.read
+	}
+	q.releasePages()
+	if q.closing || q.emptyWait > 0 {
+		q.cond.Broadcast()
+	}
+
+	return n
+}
@@ -0,0 +1,151 @@
+package fqueue
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const resizeChunk = 64 * 1024
+
+// Resize changes the size of the backing file to capacity, header
+// included. Shrinking fails with a SpaceError unless the entries still in
+// the queue fit. The entries are copied to the front of a new file that
+// then replaces the old one, so a crash leaves either the old queue or
+// the resized one.
+func (q *circularFileQueue) Resize(capacity uint32) error {
+	if capacity <= headPos+preLength+sufLength {
+		return ErrInvalidCapacity
+	}
+
+	q.wlock.Lock()
+	defer q.wlock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	used := q.used()
+	if avail := capacity - headPos; used > avail {
+		return &SpaceError{Needed: used, Available: avail}
+	}
+
+	if err := q.reserveDisk(filepath.Dir(q.name), capacity); err != nil {
+		return err
+	}
+
+	o := q.opts
+	o.capacity = capacity
+	tmp := q.name + ".resize"
+	s, err := q.copyTo(tmp, &o, used)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, q.name); err != nil {
+		s.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := syncDir(filepath.Dir(q.name)); err != nil {
+		s.Close()
+		return err
+	}
+	q.logError("fqueue: closing old file failed", q.s.Close())
+	if q.temp != nil {
+		// The resized copy has a name, so it has to be removed.
+		q.temp.path = q.name
+	}
+
+	moved := func(off uint32) uint32 {
+		if off == capacity-headPos {
+			return headPos
+		}
+		return headPos + off
+	}
+	for _, r := range q.inflight {
+		r.pos = moved(q.distance(q.start, r.pos))
+	}
+	// read equals start both when nothing and when everything is in
+	// flight.
+	readOff := q.distance(q.start, q.read)
+	if readOff == 0 && len(q.inflight) > 0 {
+		readOff = used
+	}
+	q.read = moved(readOff)
+	q.start = headPos
+	q.advised = headPos
+	// The new file was synced with its header in the first slot.
+	q.headSlot = 0
+	q.forget()
+	q.end = moved(used)
+	q.capacity = capacity
+	q.opts = o
+	q.s = s
+	q.dirty = 0
+	q.checkWatermarks()
+	q.opts.logger.Info("fqueue: resized", "queue", q.name, "capacity", capacity)
+
+	return nil
+}
+
+// copyTo writes the used region to the front of a new file at path, with
+// a header describing it, and returns the file's backend once synced.
+func (q *circularFileQueue) copyTo(path string, o *options, used uint32) (Backend, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, o.mode)
+	if err != nil {
+		return nil, err
+	}
+	if err := file.Truncate(int64(o.capacity)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s, err := openStorage(file, o)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	buf := make([]byte, resizeChunk)
+	pos, off := q.start, headPos
+	for left := used; left > 0; {
+		n := uint32(len(buf))
+		if left < n {
+			n = left
+		}
+		if pos, err = q.readRing(buf[:n], pos); err != nil {
+			s.Close()
+			return nil, err
+		}
+		if _, err := s.WriteAt(buf[:n], int64(off)); err != nil {
+			s.Close()
+			return nil, err
+		}
+		off += n
+		left -= n
+	}
+	end := headPos + used
+	if end == o.capacity {
+		end = headPos
+	}
+	head := q.header(headPos, end, o.capacity)
+	seal(head, 1)
+	if _, err := s.WriteAt(head, 0); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.Sync(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// distance returns how far pos lies past from in the data region.
+func (q *circularFileQueue) distance(from, pos uint32) uint32 {
+	if pos >= from {
+		return pos - from
+	}
+
+	return q.capacity - from + pos - headPos
+}
@@ -0,0 +1,105 @@
+package fqueue
+
+// Get returns the entry with the given sequence number without consuming
+// it. Besides queued and in flight entries, that includes consumed ones
+// whose space hasn't been reused yet. It fails with ErrNotRetained when
+// the entry is no longer in the file.
+func (q *circularFileQueue) Get(seq uint64) ([]byte, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+
+	pos, ok, err := q.seek(seq)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		var found uint64
+		if found, _, err = q.stampAt(pos); err != nil {
+			return nil, err
+		}
+		ok = found == seq
+	}
+	if !ok {
+		return nil, ErrNotRetained
+	}
+	m, _, err := q.deliver(pos, OpPeek)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.Data, nil
+}
+
+// seek returns the position of the entry with the smallest sequence
+// number of at least seq, consumed or not, if there is one.
+func (q *circularFileQueue) seek(seq uint64) (uint32, bool, error) {
+	if seq >= q.nextSeq {
+		return 0, false, nil
+	}
+	positions, err := q.retained()
+	if err != nil {
+		return 0, false, err
+	}
+	pos := q.start
+	for i := uint32(0); i < q.count; i++ {
+		length, flags, err := q.frameAt(pos)
+		if err != nil {
+			return 0, false, err
+		}
+		if flags&deadFlag == 0 {
+			positions = append(positions, pos)
+		}
+		pos = q.advance(pos, preLength+length+sufLength)
+	}
+
+	best, bestSeq, ok := uint32(0), uint64(0), false
+	for _, pos := range positions {
+		s, _, err := q.stampAt(pos)
+		if err != nil {
+			return 0, false, err
+		}
+		if s >= seq && (!ok || s < bestSeq) {
+			best, bestSeq, ok = pos, s, true
+		}
+	}
+
+	return best, ok, nil
+}
+
+// retained returns the positions of the consumed entries still intact in
+// the free space between end and start, and of those held back by
+// WithReplayWindow. Frames there are only ever overwritten by new
+// entries, so whatever survived is found by scanning it for intact
+// frames.
+func (q *circularFileQueue) retained() ([]uint32, error) {
+	res, err := q.keptIntact()
+	if err != nil {
+		return nil, err
+	}
+	pos, left := q.advance(q.end, q.writing), q.free()
+	for left > 0 {
+		length, flags, ok, err := q.intactAt(pos, left)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			off, err := q.nextIntact(pos, left)
+			if err != nil {
+				return nil, err
+			}
+			pos, left = q.advance(pos, off), left-off
+			continue
+		}
+		// The blobs of consumed entries are gone.
+		if flags&(deadFlag|pendingFlag|blobFlag) == 0 {
+			res = append(res, pos)
+		}
+		n := preLength + length + sufLength
+		pos, left = q.advance(pos, n), left-n
+	}
+
+	return res, nil
+}
@@ -0,0 +1,69 @@
+package fqueue
+
+import "time"
+
+const retentionInterval = time.Second
+
+// retentionLoop enforces retention until both limits are set to zero.
+func (q *circularFileQueue) retentionLoop() {
+	t := time.NewTicker(retentionInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			q.lock.Lock()
+			if q.closed || q.opts.retainBytes == 0 && q.opts.retainAge <= 0 {
+				q.retaining = false
+				q.lock.Unlock()
+				return
+			}
+			q.logError("fqueue: enforcing retention failed", q.reclaim(time.Now()))
+			q.lock.Unlock()
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// reclaim drops entries from the head of the queue, as if they were
+// consumed, while the entries waiting to be handed out take more than the
+// retention size or the oldest of them is past the retention age. Entries
+// in flight are left alone.
+func (q *circularFileQueue) reclaim(now time.Time) error {
+	dropped := 0
+	for {
+		if err := q.skipDead(); err != nil {
+			return err
+		}
+		if q.unread == 0 {
+			break
+		}
+		length, _, err := q.frameAt(q.read)
+		if err != nil {
+			return err
+		}
+		m, err := q.metaAt(q.read)
+		if err != nil {
+			return err
+		}
+		over := q.opts.retainBytes > 0 && q.usedBetween(q.read, q.end, q.unread) > q.opts.retainBytes
+		if !over && (q.opts.retainAge <= 0 || now.Sub(m.Time) <= q.opts.retainAge) {
+			break
+		}
+
+		q.untrack(m.Topic, q.read)
+		q.emit(EventExpired, m.Seq, m.Topic)
+		q.inflight = append(q.inflight, &reservation{pos: q.read, committed: true})
+		q.read = q.advance(q.read, preLength+length+sufLength)
+		q.unread--
+		dropped++
+	}
+	if dropped == 0 {
+		return nil
+	}
+
+	q.opts.logger.Info("fqueue: dropped entries past retention", "queue", q.name, "entries", dropped)
+	q.release()
+
+	return q.stateChanged()
+}
@@ -0,0 +1,117 @@
+package fqueue
+
+import (
+	"fmt"
+	"time"
+)
+
+// scrubBytes is how much of the queue the scrubber checks per interval.
+const scrubBytes = 1 << 20
+
+// scrubber walks the queue from start to end a little at a time, checking
+// entries like Verify. Between steps it remembers where it got to by
+// position and sequence number, and starts over from the head when that
+// entry has been consumed or moved in the meantime.
+type scrubber struct {
+	q       *circularFileQueue
+	fn      func(Report)
+	rep     Report
+	pos     uint32
+	seq     uint64
+	started bool
+}
+
+func (q *circularFileQueue) scrubLoop() {
+	s := &scrubber{q: q, fn: q.opts.scrubFn}
+	t := time.NewTicker(q.opts.scrubInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			q.lock.RLock()
+			if q.closed {
+				q.lock.RUnlock()
+				return
+			}
+			rep, done, err := s.step()
+			q.lock.RUnlock()
+			q.logError("fqueue: scrubbing failed", err)
+			if !done {
+				continue
+			}
+			if !rep.OK() {
+				q.opts.logger.Error("fqueue: scrubbing found a problem", "queue", q.name, "problem", rep.Problem, "offset", rep.Offset)
+			}
+			if s.fn != nil {
+				s.fn(rep)
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// step checks up to scrubBytes of entries and returns the report of the
+// pass once it finishes, at the end of the queue or at the first problem.
+func (s *scrubber) step() (Report, bool, error) {
+	q := s.q
+	if s.started && !s.valid() {
+		s.started = false
+	}
+	if !s.started {
+		if q.count == 0 {
+			return Report{}, false, nil
+		}
+		s.rep, s.pos, s.started = Report{}, q.start, true
+	}
+
+	checked := uint32(0)
+	for checked < scrubBytes {
+		left := q.used() - s.offset()
+		if left == 0 {
+			s.started = false
+			return s.rep, true, nil
+		}
+		n, flags, problem, err := q.checkAt(s.pos, left)
+		if err != nil {
+			s.started = false
+			return Report{}, false, err
+		}
+		if problem != "" {
+			s.started = false
+			s.rep.Problem, s.rep.Offset = fmt.Sprintf("entry at %d %s", s.pos, problem), s.pos
+			return s.rep, true, nil
+		}
+		if flags&deadFlag != 0 {
+			s.rep.Removed++
+		}
+		s.rep.Entries++
+		s.rep.Bytes += n
+		checked += n
+		s.pos = q.advance(s.pos, n)
+		if s.offset() < q.used() {
+			if s.seq, _, err = q.stampAt(s.pos); err != nil {
+				s.started = false
+				return Report{}, false, err
+			}
+		}
+	}
+
+	return Report{}, false, nil
+}
+
+// offset returns how far past the head of the queue the scrubber is.
+func (s *scrubber) offset() uint32 {
+	return s.q.distance(s.q.start, s.pos)
+}
+
+// valid reports whether the entry the scrubber stopped at is still in the
+// queue where it was.
+func (s *scrubber) valid() bool {
+	if s.q.count == 0 || s.offset() >= s.q.used() {
+		return false
+	}
+	seq, _, err := s.q.stampAt(s.pos)
+
+	return err == nil && seq == s.seq
+}
@@ -0,0 +1,84 @@
+package fqueue
+
+import (
+	"context"
+	"math/rand"
+)
+
+// Select blocks until one of queues has an entry, pops it and returns it
+// with the index of its queue. When several queues have entries one is
+// picked at random, so none is starved. Entries are only taken from the
+// queue Select returns from. Select gives up when ctx is done, and fails
+// with the first error once no queue is left to wait on, such as when all
+// of them are closed. The queues must be opened by this package.
+func Select(ctx context.Context, queues ...Queue) (int, []byte, error) {
+	qs := make([]*circularFileQueue, len(queues))
+	for i, q := range queues {
+		cq, ok := unwrap(q)
+		if !ok {
+			return -1, nil, ErrInvalidQueue
+		}
+		qs[i] = cq
+	}
+	if len(qs) == 0 {
+		<-ctx.Done()
+		return -1, nil, ctx.Err()
+	}
+
+	for {
+		first := rand.Intn(len(qs))
+		for n := range qs {
+			i := (first + n) % len(qs)
+			data, ok, err := qs[i].drainOne()
+			if err == ErrQueueClosed {
+				continue
+			}
+			if err != nil {
+				return i, nil, err
+			}
+			if ok {
+				return i, data, nil
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return -1, nil, err
+		}
+		if err := awaitAny(ctx, qs); err != nil {
+			return -1, nil, err
+		}
+	}
+}
+
+// awaitAny waits until one of qs has an entry to hand out, without taking
+// it. It fails with ctx.Err() or, once every queue failed, the first
+// error.
+func awaitAny(ctx context.Context, qs []*circularFileQueue) error {
+	type result struct {
+		i   int
+		err error
+	}
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(qs))
+	for i, q := range qs {
+		go func(i int, q *circularFileQueue) {
+			results <- result{i, q.awaitReady(wctx)}
+		}(i, q)
+	}
+
+	var first error
+	for range qs {
+		r := <-results
+		if r.err == nil {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if first == nil {
+			first = r.err
+		}
+	}
+
+	return first
+}
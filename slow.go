@@ -0,0 +1,23 @@
+package fqueue
+
+import "time"
+
+// SlowOp describes a push or pop that exceeded the threshold set with
+// WithSlowOps. Pops include Reserve and PopTopic.
+type SlowOp struct {
+	Op       Op
+	Duration time.Duration
+	// Stats is the state of the queue once the operation finished.
+	Stats Stats
+}
+
+// observe reports the operation started at start if it was slow. It must
+// be called without the queue lock held.
+func (q *circularFileQueue) observe(op Op, start time.Time) {
+	if q.opts.onSlow == nil {
+		return
+	}
+	if d := time.Since(start); d >= q.opts.slowThreshold {
+		q.opts.onSlow(SlowOp{Op: op, Duration: d, Stats: q.Stats()})
+	}
+}
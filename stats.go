@@ -0,0 +1,184 @@
+package fqueue
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Stats is a point-in-time snapshot of a queue.
+type Stats struct {
+	// Entries is the number of entries ready to be handed out.
+	Entries int
+	// InFlight is the number of entries handed out by Reserve and not yet
+	// committed or aborted.
+	InFlight int
+	// HeadSeq is the sequence number of the oldest entry still in the
+	// queue, in flight ones included, or TailSeq+1 when it is empty.
+	HeadSeq uint64
+	// TailSeq is the sequence number of the most recently pushed entry.
+	TailSeq uint64
+	// Paused reports whether delivery is paused, see Pause.
+	Paused bool
+	// Lifetime holds the counters kept over the life of the queue file.
+	Lifetime Lifetime
+	// Lag holds the lag of every committed cursor, see CommitCursor.
+	Lag map[string]Lag
+}
+
+// Lifetime counters are stored in the header, so they survive restarts.
+// Like the rest of the header they may lag behind after a crash when
+// header writes are deferred, see WithMetaFlush.
+type Lifetime struct {
+	// Pushed and Popped count the entries pushed and consumed. Entries
+	// removed by RemoveIf, Compact, TruncateBefore or retention are not
+	// counted as popped.
+	Pushed uint64
+	Popped uint64
+	// Bytes is the total size of the data pushed, as stored in the queue
+	// after interceptors.
+	Bytes uint64
+	// Full counts the pushes rejected for lack of space, in the queue or
+	// on disk, or because of WithMaxEntries.
+	Full uint64
+	// Compacted is when Compact last ran.
+	Compacted time.Time
+}
+
+func (l *Lifetime) pushed(f frame) {
+	l.Pushed++
+	l.Bytes += f.dataLength()
+}
+
+// full counts err if it means the queue was full and returns it.
+func (l *Lifetime) full(err error) error {
+	if errors.Is(err, ErrNotEnoughSpace) || err == ErrQueueFull || err == ErrDiskFull {
+		l.Full++
+	}
+
+	return err
+}
+
+func (l *Lifetime) put(buf []byte) {
+	binary.BigEndian.PutUint64(buf[pushedTagPos:], l.Pushed)
+	binary.BigEndian.PutUint64(buf[poppedTagPos:], l.Popped)
+	binary.BigEndian.PutUint64(buf[bytesTagPos:], l.Bytes)
+	binary.BigEndian.PutUint64(buf[fullTagPos:], l.Full)
+	var compacted int64
+	if !l.Compacted.IsZero() {
+		compacted = l.Compacted.UnixNano()
+	}
+	binary.BigEndian.PutUint64(buf[compactedTagPos:], uint64(compacted))
+}
+
+func (l *Lifetime) get(buf []byte) {
+	l.Pushed = binary.BigEndian.Uint64(buf[pushedTagPos:])
+	l.Popped = binary.BigEndian.Uint64(buf[poppedTagPos:])
+	l.Bytes = binary.BigEndian.Uint64(buf[bytesTagPos:])
+	l.Full = binary.BigEndian.Uint64(buf[fullTagPos:])
+	l.Compacted = time.Time{}
+	if compacted := int64(binary.BigEndian.Uint64(buf[compactedTagPos:])); compacted != 0 {
+		l.Compacted = time.Unix(0, compacted)
+	}
+}
+
+func (q *circularFileQueue) Stats() Stats {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	st := Stats{
+		Entries:  int(q.deliverable()),
+		InFlight: len(q.tokens),
+		HeadSeq:  q.nextSeq,
+		TailSeq:  q.nextSeq - 1,
+		Paused:   q.paused,
+		Lifetime: q.life,
+	}
+	if q.closed {
+		return st
+	}
+	st.Lag = q.lags(q.cursors.seqs)
+	if q.count > 0 {
+		if seq, _, err := q.stampAt(q.start); err == nil {
+			st.HeadSeq = seq
+		}
+	}
+
+	return st
+}
+
+// OldestAge reports how long ago the oldest entry still in the queue, in
+// flight ones included, was pushed. It is zero when the queue is empty.
+func (q *circularFileQueue) OldestAge() time.Duration {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return 0
+	}
+
+	if q.count == 0 {
+		return 0
+	}
+	_, t, err := q.stampAt(q.start)
+	if err != nil {
+		return 0
+	}
+
+	return time.Since(t)
+}
+
+// Capacity returns the size of the backing file, header included.
+func (q *circularFileQueue) Capacity() uint32 {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.capacity
+}
+
+// Free returns the size of the largest entry, pushed without topic or
+// headers, that would be accepted right now.
+func (q *circularFileQueue) Free() uint32 {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	free, overhead := q.free(), newFrame(Message{}).length()
+	switch {
+	case free < overhead:
+		return 0
+	case q.opts.maxEntrySize > 0 && free-overhead > q.opts.maxEntrySize:
+		return q.opts.maxEntrySize
+	default:
+		return free - overhead
+	}
+}
+
+// IsFull reports whether not even an empty entry would fit, or the queue
+// holds as many entries as WithMaxEntries allows.
+func (q *circularFileQueue) IsFull() bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	return q.free() < newFrame(Message{}).length() || q.checkEntries(1) != nil
+}
+
+// checkEntries fails with ErrQueueFull if adding n entries would exceed
+// WithMaxEntries, with ErrClosing once CloseDrain was called, and with
+// ErrQueueClosed once the queue is closed. Removed entries not yet
+// reclaimed don't count.
+func (q *circularFileQueue) checkEntries(n uint32) error {
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if q.closing {
+		return ErrClosing
+	}
+	// An entry being written counts as well.
+	if q.writing > 0 {
+		n++
+	}
+	if max := q.opts.maxEntries; max > 0 && q.count-q.dead+n > max {
+		return ErrQueueFull
+	}
+
+	return nil
+}
@@ -0,0 +1,259 @@
+package fqueue
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// Backend stores the bytes of a queue, header included. The built-in
+// backends memory-map the queue file, in whole or in windows, or use
+// positional reads and writes on it; WithBackend plugs in others. Reads
+// and writes are always within the capacity the backend was opened
+// with.
+type Backend interface {
+	io.ReaderAt
+	io.WriterAt
+	// Sync makes everything written so far durable.
+	Sync() error
+	// Release tells the kernel the page-aligned range [off, off+n) won't
+	// be read again soon, so it needn't stay cached.
+	Release(off, n int64) error
+	// Close releases the backend and closes the file it was opened on.
+	Close() error
+}
+
+// holePuncher is implemented by backends that can free the disk space of
+// a range of the file, which then reads back as zeros.
+type holePuncher interface {
+	PunchHole(off, n int64) error
+}
+
+// mappedBackend is implemented by backends holding the whole file in
+// memory, so entries can be filled in place. Bytes changed through slice
+// have to be passed to touch before Sync makes them durable.
+type mappedBackend interface {
+	slice(off, n int64) []byte
+	touch(off, n int64)
+}
+
+// BackendFunc opens a Backend of the given capacity for the queue file,
+// which has already been sized to it.
+type BackendFunc func(file *os.File, capacity int64) (Backend, error)
+
+func openStorage(file *os.File, o *options) (Backend, error) {
+	switch {
+	case o.backend != nil:
+		return o.backend(file, int64(o.capacity))
+	case o.fileIO:
+		return newFileStorage(file), nil
+	case o.mapWindow > 0 && o.mapWindow < o.capacity:
+		return newWindowedStorage(file, int64(o.capacity), o.mapWindow, o.advice), nil
+	case o.mapWindow == 0 && o.capacity > autoWindowThreshold:
+		return newWindowedStorage(file, int64(o.capacity), defaultMapWindow, o.advice), nil
+	default:
+		return newMmapStorage(file, o.advice)
+	}
+}
+
+// mapAdvice is what the kernel is told about a mapping once it is made.
+type mapAdvice struct {
+	populate  bool
+	hugePages bool
+	lock      bool
+}
+
+type mmapStorage struct {
+	file  *os.File
+	m     mmap.MMap
+	lock  sync.Mutex
+	dirty dirtyRanges
+}
+
+func newMmapStorage(file *os.File, advice mapAdvice) (*mmapStorage, error) {
+	m, err := mmap.Map(file, mmap.RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := advice.apply(m); err != nil {
+		m.Unmap()
+		return nil, err
+	}
+
+	return &mmapStorage{file: file, m: m}, nil
+}
+
+func (s *mmapStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(s.m)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.m[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (s *mmapStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(s.m)) {
+		return 0, io.ErrShortWrite
+	}
+	n := copy(s.m[off:], p)
+	s.lock.Lock()
+	s.dirty.add(off, off+int64(n))
+	s.lock.Unlock()
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+func (s *mmapStorage) slice(off, n int64) []byte {
+	return s.m[off : off+n : off+n]
+}
+
+func (s *mmapStorage) touch(off, n int64) {
+	s.lock.Lock()
+	s.dirty.add(off, off+n)
+	s.lock.Unlock()
+}
+
+func (s *mmapStorage) Sync() error {
+	s.lock.Lock()
+	r := s.dirty.take()
+	s.lock.Unlock()
+
+	return flushRanges(s.m, r)
+}
+
+// flushRanges syncs the given ranges of m, or all of it where syncing
+// part of a mapping isn't supported.
+func flushRanges(m mmap.MMap, ranges [][2]int64) error {
+	for _, r := range ranges {
+		hi := r[1]
+		if hi > int64(len(m)) {
+			hi = int64(len(m))
+		}
+		if r[0] >= hi {
+			continue
+		}
+		if err := msyncRange(m[r[0]:hi]); err == errNoRangeSync {
+			return m.Flush()
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *mmapStorage) Release(off, n int64) error {
+	if err := adviseDontNeed(s.m[off : off+n]); err != nil {
+		return err
+	}
+
+	return fadviseDontNeed(s.file, off, n)
+}
+
+func (s *mmapStorage) PunchHole(off, n int64) error {
+	return punchHole(s.file, off, n)
+}
+
+func (s *mmapStorage) Close() error {
+	if err := s.m.Unmap(); err != nil {
+		s.file.Close()
+		return err
+	}
+
+	return s.file.Close()
+}
+
+type fileStorage struct {
+	file *os.File
+}
+
+func newFileStorage(file *os.File) *fileStorage {
+	return &fileStorage{file: file}
+}
+
+func (s *fileStorage) ReadAt(p []byte, off int64) (int, error) {
+	return s.file.ReadAt(p, off)
+}
+
+func (s *fileStorage) WriteAt(p []byte, off int64) (int, error) {
+	return s.file.WriteAt(p, off)
+}
+
+func (s *fileStorage) Sync() error {
+	return s.file.Sync()
+}
+
+func (s *fileStorage) Release(off, n int64) error {
+	return fadviseDontNeed(s.file, off, n)
+}
+
+func (s *fileStorage) PunchHole(off, n int64) error {
+	return punchHole(s.file, off, n)
+}
+
+func (s *fileStorage) Close() error {
+	return s.file.Close()
+}
+
+// MemoryBackend keeps the queue in memory, leaving the file untouched, so
+// its content is lost on Close. It is meant for tests and for queues that
+// don't need to outlive the process.
+func MemoryBackend(file *os.File, capacity int64) (Backend, error) {
+	return &memoryStorage{file: file, buf: make([]byte, capacity)}, nil
+}
+
+type memoryStorage struct {
+	file *os.File
+	buf  []byte
+}
+
+func (s *memoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(s.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, s.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (s *memoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(s.buf)) {
+		return 0, io.ErrShortWrite
+	}
+	n := copy(s.buf[off:], p)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+func (s *memoryStorage) slice(off, n int64) []byte {
+	return s.buf[off : off+n : off+n]
+}
+
+func (s *memoryStorage) touch(off, n int64) {}
+
+func (s *memoryStorage) Sync() error {
+	return nil
+}
+
+func (s *memoryStorage) Release(off, n int64) error {
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return s.file.Close()
+}
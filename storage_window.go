@@ -0,0 +1,196 @@
+package fqueue
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+const (
+	defaultMapWindow    uint32 = 64 << 20
+	autoWindowThreshold uint32 = 1 << 30
+
+	// mapAlignment is a multiple of the page size and of the allocation
+	// granularity on every supported platform.
+	mapAlignment  int64 = 64 << 10
+	maxMapWindows       = 4
+)
+
+type mapWindow struct {
+	off   int64
+	m     mmap.MMap
+	dirty dirtyRanges
+}
+
+// windowedStorage maps at most maxMapWindows fixed-size regions of the file
+// at a time, evicting the least recently used one when another is needed.
+type windowedStorage struct {
+	file    *os.File
+	size    int64
+	window  int64
+	lock    sync.Mutex
+	windows []*mapWindow
+	evicted bool
+	advice  mapAdvice
+}
+
+func newWindowedStorage(file *os.File, size int64, window uint32, advice mapAdvice) *windowedStorage {
+	w := (int64(window) + mapAlignment - 1) / mapAlignment * mapAlignment
+
+	return &windowedStorage{
+		file:    file,
+		size:    size,
+		window:  w,
+		advice:  advice,
+		windows: make([]*mapWindow, 0, maxMapWindows),
+	}
+}
+
+func (s *windowedStorage) get(off int64) (*mapWindow, error) {
+	base := off / s.window * s.window
+	for i, w := range s.windows {
+		if w.off == base {
+			copy(s.windows[i:], s.windows[i+1:])
+			s.windows[len(s.windows)-1] = w
+			return w, nil
+		}
+	}
+
+	if len(s.windows) == maxMapWindows {
+		old := s.windows[0]
+		if err := old.m.Unmap(); err != nil {
+			return nil, err
+		}
+		if len(old.dirty.take()) > 0 {
+			s.evicted = true
+		}
+		copy(s.windows, s.windows[1:])
+		s.windows = s.windows[:len(s.windows)-1]
+	}
+
+	length := s.window
+	if base+length > s.size {
+		length = s.size - base
+	}
+	m, err := mmap.MapRegion(s.file, int(length), mmap.RDWR, 0, base)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.advice.apply(m); err != nil {
+		m.Unmap()
+		return nil, err
+	}
+	w := &mapWindow{off: base, m: m}
+	s.windows = append(s.windows, w)
+
+	return w, nil
+}
+
+func (s *windowedStorage) ReadAt(p []byte, off int64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off < 0 || off >= s.size {
+			return n, io.EOF
+		}
+		w, err := s.get(off)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], w.m[off-w.off:])
+		n += c
+		off += int64(c)
+	}
+
+	return n, nil
+}
+
+func (s *windowedStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	for n < len(p) {
+		if off < 0 || off >= s.size {
+			return n, io.ErrShortWrite
+		}
+		w, err := s.get(off)
+		if err != nil {
+			return n, err
+		}
+		c := copy(w.m[off-w.off:], p[n:])
+		w.dirty.add(off-w.off, off-w.off+int64(c))
+		n += c
+		off += int64(c)
+	}
+
+	return n, nil
+}
+
+func (s *windowedStorage) PunchHole(off, n int64) error {
+	return punchHole(s.file, off, n)
+}
+
+func (s *windowedStorage) Release(off, n int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, w := range s.windows {
+		lo, hi := off-w.off, off+n-w.off
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > int64(len(w.m)) {
+			hi = int64(len(w.m))
+		}
+		if lo >= hi {
+			continue
+		}
+		if err := adviseDontNeed(w.m[lo:hi]); err != nil {
+			return err
+		}
+	}
+
+	return fadviseDontNeed(s.file, off, n)
+}
+
+// Sync flushes what was written to the mapped windows, and the whole file
+// only if a window was unmapped with unflushed writes since the last sync.
+func (s *windowedStorage) Sync() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, w := range s.windows {
+		if err := flushRanges(w.m, w.dirty.take()); err != nil {
+			return err
+		}
+	}
+	if !s.evicted {
+		return nil
+	}
+	s.evicted = false
+
+	return s.file.Sync()
+}
+
+func (s *windowedStorage) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var firstErr error
+	for _, w := range s.windows {
+		if err := w.m.Unmap(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.windows = nil
+	if err := s.file.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	return firstErr
+}
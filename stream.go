@@ -0,0 +1,210 @@
+package fqueue
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+const streamChunk = 64 * 1024
+
+// PushFrom queues the next n bytes read from r as a single entry, copying
+// them into the file in chunks rather than buffering the whole entry.
+// Other pushes wait while r is read, but consumers don't. If r fails or
+// ends early nothing is queued. With interceptors or deduplication set up
+// the entry is read into memory first, as those need the data in one
+// piece.
+func (q *circularFileQueue) PushFrom(r io.Reader, n int64) error {
+	if n < 0 {
+		return &EntrySizeError{Size: uint32(n), Limit: lengthMask}
+	}
+	if len(q.opts.interceptors) > 0 || q.dedup != nil {
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		return q.Push(data)
+	}
+	defer q.observe(OpPush, time.Now())
+	var gen uint64
+	var err error
+	switch {
+	case q.toBlob(uint64(n)):
+		gen, err = q.pushBlob(Message{}, r, n, "")
+	case n > int64(lengthMask):
+		return &EntrySizeError{Size: uint32(n), Limit: lengthMask}
+	default:
+		f := newFrame(Message{})
+		f.data, f.src, f.srcLen = nil, r, uint32(n)
+		gen, err = q.pushBack(f, "", "")
+	}
+	if err != nil {
+		return err
+	}
+
+	return q.durable(gen)
+}
+
+// copyFrom copies n bytes from r to pos, adding them to crc.
+func (q *circularFileQueue) copyFrom(r io.Reader, n, pos, crc uint32) (uint32, uint32, error) {
+	size := uint32(streamChunk)
+	if n < size {
+		size = n
+	}
+	buf := make([]byte, size)
+	for n > 0 {
+		chunk := buf
+		if n < uint32(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		if _, err := io.ReadFull(r, chunk); err == io.EOF {
+			return pos, crc, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return pos, crc, err
+		}
+		var err error
+		if pos, err = q.writeRing(chunk, pos); err != nil {
+			return pos, crc, err
+		}
+		crc = crc32.Update(crc, crcTable, chunk)
+		n -= uint32(len(chunk))
+	}
+
+	return pos, crc, nil
+}
+
+// PopTo blocks until an entry is available and copies its data to w
+// straight from the file, so it is never held in memory as a whole. Other
+// pushes and pops wait while w is written. If writing fails the entry
+// stays in the queue and is handed out again next. With interceptors set
+// up the entry is read into memory first, as they need the data in one
+// piece.
+func (q *circularFileQueue) PopTo(w io.Writer) (int64, error) {
+	defer q.observe(OpPop, time.Now())
+	q.limiter.wait()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.waitReady(); err != nil {
+		return 0, err
+	}
+
+	if len(q.opts.interceptors) > 0 {
+		r, m, err := q.next()
+		if err != nil {
+			return 0, err
+		}
+		n, err := w.Write(m.Data)
+		return int64(n), q.settle(r, err)
+	}
+
+	var dataPos, dataLen uint32
+	r, _, err := q.nextWith(func(pos uint32) (Message, uint32, error) {
+		return q.dataAt(pos, &dataPos, &dataLen)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if q.blobs != nil {
+		name, ok, err := q.blobAt(r.pos)
+		if err != nil || ok {
+			var n int64
+			if err == nil {
+				n, err = q.blobs.copyTo(w, name)
+			}
+			return n, q.settle(r, err)
+		}
+	}
+	n, err := q.writeData(w, dataPos, dataLen)
+
+	return n, q.settle(r, err)
+}
+
+// settle commits r once its data was written, or puts it back in front of
+// the entries to hand out if that failed with err.
+func (q *circularFileQueue) settle(r *reservation, err error) error {
+	if err != nil {
+		q.redeliver = append([]*reservation{r}, q.redeliver...)
+		return err
+	}
+
+	return q.commit(r)
+}
+
+// dataAt checks the checksum of the frame at pos, reading it in chunks,
+// and stores where its data lies in dataPos and dataLen. It returns the
+// frame's metadata and the position of the following frame.
+func (q *circularFileQueue) dataAt(pos uint32, dataPos, dataLen *uint32) (Message, uint32, error) {
+	length, flags, err := q.frameAt(pos)
+	if err != nil {
+		return Message{}, pos, err
+	}
+	m, err := q.metaAt(pos)
+	if err != nil {
+		return Message{}, pos, err
+	}
+	skip := seqLength + timeLength
+	if flags&metaFlag != 0 {
+		metaLen := make([]byte, metaLenLength)
+		if _, err := q.readRing(metaLen, q.advance(pos, preLength+skip)); err != nil {
+			return Message{}, pos, err
+		}
+		skip += metaLenLength + binary.BigEndian.Uint32(metaLen)
+	}
+	if skip > length {
+		return Message{}, pos, ErrCorrupted
+	}
+
+	crc, p := uint32(0), q.advance(pos, preLength)
+	buf := make([]byte, streamChunk)
+	for left := length; left > 0; {
+		chunk := buf
+		if left < uint32(len(chunk)) {
+			chunk = chunk[:left]
+		}
+		if p, err = q.readRing(chunk, p); err != nil {
+			return Message{}, pos, err
+		}
+		crc = crc32.Update(crc, crcTable, chunk)
+		left -= uint32(len(chunk))
+	}
+	suf := make([]byte, sufLength)
+	if _, err := q.readRing(suf, p); err != nil {
+		return Message{}, pos, err
+	}
+	if binary.BigEndian.Uint32(suf) != length|flags || binary.BigEndian.Uint32(suf[tagLength:]) != crc {
+		return Message{}, pos, ErrCorrupted
+	}
+
+	*dataPos, *dataLen = q.advance(pos, preLength+skip), length-skip
+
+	return m, q.advance(p, sufLength), nil
+}
+
+// writeData copies n bytes of the ring starting at pos to w.
+func (q *circularFileQueue) writeData(w io.Writer, pos, n uint32) (int64, error) {
+	size := uint32(streamChunk)
+	if n < size {
+		size = n
+	}
+	buf := make([]byte, size)
+	written := int64(0)
+	for n > 0 {
+		chunk := buf
+		if n < uint32(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		var err error
+		if pos, err = q.readRing(chunk, pos); err != nil {
+			return written, err
+		}
+		k, err := w.Write(chunk)
+		written += int64(k)
+		if err != nil {
+			return written, err
+		}
+		n -= uint32(len(chunk))
+	}
+
+	return written, nil
+}
@@ -0,0 +1,89 @@
+package fqueue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Handler processes an entry handed out by Subscribe. Returning an error
+// puts the entry back in the queue.
+type Handler func(ctx context.Context, data []byte) error
+
+type SubscribeOption func(*subscribeOptions)
+
+type subscribeOptions struct {
+	concurrency int
+}
+
+// WithConcurrency sets the number of entries handled at once, 1 by
+// default.
+func WithConcurrency(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.concurrency = n
+	}
+}
+
+// Subscribe hands entries to handler on a pool of workers until ctx is
+// done. Every entry is reserved first and committed once handler returns
+// nil. When handler fails or panics the entry is aborted, so it is handed
+// out again, straight away; WithMaxDeliveries keeps an entry that always
+// fails from going round forever. Failures are logged. Once ctx is done,
+// or reading an entry fails, no new entries are handed out, and
+// Subscribe waits for the running handlers, which see ctx done, before it
+// returns the reason it stopped.
+func (q *circularFileQueue) Subscribe(ctx context.Context, handler Handler, opts ...SubscribeOption) error {
+	o := subscribeOptions{concurrency: 1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.concurrency < 1 {
+		o.concurrency = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var res error
+	for i := 0; i < o.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := q.work(ctx, handler)
+			once.Do(func() {
+				res = err
+				cancel()
+			})
+		}()
+	}
+	wg.Wait()
+
+	return res
+}
+
+func (q *circularFileQueue) work(ctx context.Context, handler Handler) error {
+	for {
+		data, token, err := q.ReserveContext(ctx)
+		if err != nil {
+			return err
+		}
+		if err := handle(ctx, handler, data); err != nil {
+			q.opts.logger.Warn("fqueue: handler failed", "queue", q.name, "error", err)
+			q.logError("fqueue: aborting entry failed", q.Abort(token))
+			continue
+		}
+		q.logError("fqueue: committing entry failed", q.Commit(token))
+	}
+}
+
+// handle calls handler, turning a panic into an error.
+func handle(ctx context.Context, handler Handler, data []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panicked: %v", r)
+		}
+	}()
+
+	return handler(ctx, data)
+}
@@ -0,0 +1,73 @@
+package fqueue
+
+import (
+	"errors"
+	"fmt"
+)
+
+// TeePolicy decides what a failed push to one Tee destination means for
+// the push as a whole.
+type TeePolicy int
+
+const (
+	// TeeRequired destinations make Push return an error when they fail.
+	TeeRequired TeePolicy = iota
+	// TeeBestEffort destinations have their failures reported to the
+	// Tee's error handler, if any, and otherwise ignored.
+	TeeBestEffort
+)
+
+type teeDest struct {
+	q      Queue
+	policy TeePolicy
+}
+
+// Tee pushes every entry to several queues so independent consumers each
+// get their own durable copy. Destinations are pushed to in the order they
+// were added; a failure never stops the remaining ones from being tried.
+type Tee struct {
+	dests   []teeDest
+	onError func(i int, err error)
+}
+
+func NewTee() *Tee {
+	return &Tee{}
+}
+
+// Add appends a destination and returns t to allow chaining.
+func (t *Tee) Add(q Queue, policy TeePolicy) *Tee {
+	t.dests = append(t.dests, teeDest{q: q, policy: policy})
+	return t
+}
+
+// OnError sets a handler called with the destination index for failures
+// of best-effort destinations.
+func (t *Tee) OnError(fn func(i int, err error)) *Tee {
+	t.onError = fn
+	return t
+}
+
+func (t *Tee) Push(data []byte) error {
+	return t.each(func(q Queue) error { return q.Push(data) })
+}
+
+func (t *Tee) PushMsg(m Message) error {
+	return t.each(func(q Queue) error { return q.PushMsg(m) })
+}
+
+func (t *Tee) each(push func(q Queue) error) error {
+	var errs []error
+	for i, d := range t.dests {
+		err := push(d.q)
+		if err == nil {
+			continue
+		}
+		if d.policy == TeeRequired {
+			errs = append(errs, fmt.Errorf("tee destination %d: %w", i, err))
+		} else if t.onError != nil {
+			t.onError(i, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,105 @@
+package fqueue
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+var tempSeq uint32
+
+// tempFile is the backing file of a queue made by NewTempQueue. An
+// unnamed file is freed by the kernel once closed; a named one, used
+// where unnamed files aren't available, is removed by Close.
+type tempFile struct {
+	file *os.File
+	path string
+}
+
+// NewTempQueue returns a queue backed by a temporary file that goes away
+// when the queue is closed or the process exits, for spill buffers that
+// don't need to survive a restart. Persist keeps it. Files other
+// features keep next to a queue, such as cursors, are placed next to a
+// name in os.TempDir and are not removed.
+func NewTempQueue(opts ...Option) (Queue, error) {
+	dir := os.TempDir()
+	name := filepath.Join(dir, fmt.Sprintf("fqueue-%d-%d", os.Getpid(), atomic.AddUint32(&tempSeq, 1)))
+	q, err := newTempQueue(dir, name, opts)
+	if err != nil {
+		return nil, &OpenError{Path: name, Err: err}
+	}
+	q.opts.logger.Info("fqueue: opened", "queue", name, "capacity", q.capacity, "temporary", true)
+
+	return q, nil
+}
+
+func newTempQueue(dir, name string, opts []Option) (*circularFileQueue, error) {
+	o, err := buildOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	t := &tempFile{}
+	if t.file, err = createTemp(dir, o.mode); err != nil {
+		if t.file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, o.mode); err != nil {
+			return nil, err
+		}
+		t.path = name
+	}
+	q, err := openQueue(name, t.file, true, o)
+	if err != nil {
+		t.remove()
+		return nil, err
+	}
+	q.temp = t
+
+	return q, nil
+}
+
+// Persist gives the file of a queue made by NewTempQueue the name path,
+// so that it outlives the process and can be reopened with
+// NewCircularFileQueue. The queue stays open under its new name, but
+// files other features keep next to it are not moved. Other queues
+// return ErrNotTemporary.
+func (q *circularFileQueue) Persist(path string) error {
+	q.wlock.Lock()
+	defer q.wlock.Unlock()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	if q.temp == nil {
+		return ErrNotTemporary
+	}
+	if err := q.syncMeta(); err != nil {
+		return err
+	}
+	var err error
+	if q.temp.path != "" {
+		err = os.Rename(q.temp.path, path)
+	} else {
+		err = linkTemp(q.temp.file, path)
+	}
+	if err != nil {
+		return err
+	}
+	// The file has its new name from here on, even if syncing the
+	// directory that holds it fails.
+	name := q.name
+	q.name, q.temp = path, nil
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	q.opts.logger.Info("fqueue: persisted", "queue", name, "path", path)
+
+	return nil
+}
+
+// remove deletes a named temporary file; the storage closes it.
+func (t *tempFile) remove() {
+	if t != nil && t.path != "" {
+		os.Remove(t.path)
+	}
+}
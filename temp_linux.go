@@ -0,0 +1,24 @@
+package fqueue
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// createTemp opens an unnamed file in dir, which the kernel frees once
+// it is closed.
+func createTemp(dir string, mode os.FileMode) (*os.File, error) {
+	fd, err := unix.Open(dir, unix.O_RDWR|unix.O_TMPFILE|unix.O_CLOEXEC, uint32(mode.Perm()))
+	if err != nil {
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(fd), dir), nil
+}
+
+// linkTemp gives a file opened by createTemp the name path.
+func linkTemp(f *os.File, path string) error {
+	return unix.Linkat(unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", f.Fd()), unix.AT_FDCWD, path, unix.AT_SYMLINK_FOLLOW)
+}
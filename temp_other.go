@@ -0,0 +1,18 @@
+//go:build !linux
+
+package fqueue
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoTempFile = errors.New("unnamed temporary files not supported")
+
+func createTemp(dir string, mode os.FileMode) (*os.File, error) {
+	return nil, errNoTempFile
+}
+
+func linkTemp(f *os.File, path string) error {
+	return errNoTempFile
+}
@@ -0,0 +1,116 @@
+package fqueue
+
+import "time"
+
+// PopTopic blocks until an entry pushed with the given topic is available
+// and returns it, leaving entries of other topics in place. Raw entries
+// pushed with Push belong to the empty topic.
+func (q *circularFileQueue) PopTopic(topic string) Message {
+	defer q.observe(OpPop, time.Now())
+	q.limiter.wait()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for !q.closed {
+		if !q.paused {
+			m, ok, err := q.popTopic(topic)
+			if err != nil {
+				q.logError("fqueue: pop failed", err)
+				return Message{}
+			}
+			if ok {
+				return m
+			}
+		}
+		r := q.region("fqueue.wait")
+		q.cond.Wait()
+		r.End()
+	}
+
+	return Message{}
+}
+
+func (q *circularFileQueue) popTopic(topic string) (Message, bool, error) {
+	for i, r := range q.redeliver {
+		if r.topic != topic {
+			continue
+		}
+		m, _, err := q.deliver(r.pos, OpPop)
+		if err != nil {
+			return Message{}, false, err
+		}
+		q.redeliver = append(q.redeliver[:i], q.redeliver[i+1:]...)
+		q.emit(EventDelivered, r.seq, r.topic)
+		return m, true, q.commit(r)
+	}
+
+	pos := q.read
+	for i := uint32(0); i < q.unread; i++ {
+		length, flags, err := q.frameAt(pos)
+		if err != nil {
+			return Message{}, false, err
+		}
+		if flags&deadFlag == 0 {
+			meta, err := q.metaAt(pos)
+			if err != nil {
+				return Message{}, false, err
+			}
+			if meta.Topic == topic {
+				return q.take(pos)
+			}
+		}
+		pos = q.advance(pos, preLength+length+sufLength)
+	}
+
+	return Message{}, false, nil
+}
+
+// take consumes the fresh entry at pos, wherever it is, by marking it
+// removed.
+func (q *circularFileQueue) take(pos uint32) (Message, bool, error) {
+	m, _, err := q.deliver(pos, OpPop)
+	if err != nil {
+		return Message{}, false, err
+	}
+	if err := q.markDead(pos); err != nil {
+		return Message{}, false, err
+	}
+	q.dead++
+	q.untrack(m.Topic, pos)
+	q.life.Popped++
+	q.emit(EventDelivered, m.Seq, m.Topic)
+	q.emit(EventAcked, m.Seq, m.Topic)
+	q.logError("fqueue: skipping removed entries failed", q.skipDead())
+	q.release()
+
+	return m, true, q.stateChanged()
+}
+
+// TopicCounts returns the number of entries per topic still in the queue,
+// in flight ones included.
+func (q *circularFileQueue) TopicCounts() map[string]int {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	res := make(map[string]int, len(q.topics))
+	for topic, n := range q.topics {
+		res[topic] = int(n)
+	}
+
+	return res
+}
+
+// untrack stops counting the entry of topic at pos.
+func (q *circularFileQueue) untrack(topic string, pos uint32) {
+	if q.topicBytes != nil {
+		if size := q.sizeAt(pos); q.topicBytes[topic] <= size {
+			delete(q.topicBytes, topic)
+		} else {
+			q.topicBytes[topic] -= size
+		}
+	}
+	if q.topics[topic] <= 1 {
+		delete(q.topics, topic)
+		return
+	}
+	q.topics[topic]--
+}
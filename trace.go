@@ -0,0 +1,17 @@
+package fqueue
+
+import (
+	"context"
+	"runtime/trace"
+)
+
+// region starts a trace region of the given kind, suffixed with the queue
+// name while tracing, so execution traces attribute waits and I/O to
+// specific queues.
+func (q *circularFileQueue) region(kind string) *trace.Region {
+	if trace.IsEnabled() {
+		kind += " " + q.name
+	}
+
+	return trace.StartRegion(context.Background(), kind)
+}
@@ -0,0 +1,118 @@
+package fqueue
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Headers carrying a W3C trace context, see
+// https://www.w3.org/TR/trace-context/.
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+var errTraceparent = errors.New("invalid traceparent")
+
+// TraceContext identifies the span an entry was pushed from, so the trace
+// continues at the consumer.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+	// State is the vendor specific tracestate, passed along untouched.
+	State string
+}
+
+// ParseTraceparent parses a traceparent header value. Versions after 00
+// are read as 00, as the specification asks.
+func ParseTraceparent(s string) (TraceContext, error) {
+	var tc TraceContext
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return tc, errTraceparent
+	}
+	var version [1]byte
+	if err := decodeHex(version[:], parts[0]); err != nil {
+		return tc, err
+	}
+	if err := decodeHex(tc.TraceID[:], parts[1]); err != nil {
+		return tc, err
+	}
+	if err := decodeHex(tc.SpanID[:], parts[2]); err != nil {
+		return tc, err
+	}
+	var flags [1]byte
+	if err := decodeHex(flags[:], parts[3]); err != nil {
+		return tc, err
+	}
+	tc.Flags = flags[0]
+	if tc.TraceID == ([16]byte{}) || tc.SpanID == ([8]byte{}) {
+		return tc, errTraceparent
+	}
+
+	return tc, nil
+}
+
+func decodeHex(dst []byte, s string) error {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return errTraceparent
+	}
+	if _, err := hex.Decode(dst, []byte(s)); err != nil {
+		return errTraceparent
+	}
+
+	return nil
+}
+
+// Traceparent formats tc as a version 00 traceparent header value.
+func (tc TraceContext) Traceparent() string {
+	return "00-" + hex.EncodeToString(tc.TraceID[:]) + "-" + hex.EncodeToString(tc.SpanID[:]) + "-" + hex.EncodeToString([]byte{tc.Flags})
+}
+
+type traceKey struct{}
+
+// ContextWithTrace returns a copy of ctx carrying tc.
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceKey{}, tc)
+}
+
+// TraceFromContext returns the trace context carried by ctx.
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceKey{}).(TraceContext)
+	return tc, ok
+}
+
+// InjectTrace stores the trace context carried by ctx, if any, in the
+// headers of m before it is pushed.
+func InjectTrace(ctx context.Context, m *Message) {
+	tc, ok := TraceFromContext(ctx)
+	if !ok {
+		return
+	}
+	headers := make(map[string]string, len(m.Headers)+2)
+	for k, v := range m.Headers {
+		headers[k] = v
+	}
+	headers[TraceparentHeader] = tc.Traceparent()
+	if tc.State != "" {
+		headers[TracestateHeader] = tc.State
+	} else {
+		delete(headers, TracestateHeader)
+	}
+	m.Headers = headers
+}
+
+// ExtractTrace returns ctx carrying the trace context stored in the
+// headers of a popped m, or ctx itself if there is no valid one.
+func ExtractTrace(ctx context.Context, m Message) context.Context {
+	tc, err := ParseTraceparent(m.Headers[TraceparentHeader])
+	if err != nil {
+		return ctx
+	}
+	tc.State = m.Headers[TracestateHeader]
+
+	return ContextWithTrace(ctx, tc)
+}
@@ -0,0 +1,70 @@
+package fqueue
+
+// TruncateBefore removes every queued entry with a sequence number below
+// seq and returns how many were removed. Consumed entries still retained
+// below seq can no longer be read with Get or a ReplayCursor afterwards.
+// Entries in flight are left alone.
+func (q *circularFileQueue) TruncateBefore(seq uint64) (int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return 0, ErrQueueClosed
+	}
+
+	positions, err := q.retained()
+	if err != nil {
+		return 0, err
+	}
+	for _, pos := range positions {
+		s, _, err := q.stampAt(pos)
+		if err != nil {
+			return 0, err
+		}
+		if s < seq {
+			if err := q.markDead(pos); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	removed, err := q.removeBefore(seq)
+	if removed > 0 {
+		q.dead += removed
+		q.logError("fqueue: skipping removed entries failed", q.skipDead())
+		q.release()
+		q.opts.logger.Info("fqueue: truncated entries", "queue", q.name, "entries", removed, "before", seq)
+		if serr := q.stateChanged(); err == nil {
+			err = serr
+		}
+	}
+
+	return int(removed), err
+}
+
+func (q *circularFileQueue) removeBefore(seq uint64) (uint32, error) {
+	removed := uint32(0)
+	pos := q.read
+	for i := uint32(0); i < q.unread; i++ {
+		length, flags, err := q.frameAt(pos)
+		if err != nil {
+			return removed, err
+		}
+		if flags&deadFlag == 0 {
+			m, err := q.metaAt(pos)
+			if err != nil {
+				return removed, err
+			}
+			if m.Seq < seq {
+				if err := q.markDead(pos); err != nil {
+					return removed, err
+				}
+				q.untrack(m.Topic, pos)
+				q.emit(EventRemoved, m.Seq, m.Topic)
+				removed++
+			}
+		}
+		pos = q.advance(pos, preLength+length+sufLength)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,182 @@
+package fqueue
+
+type circularTx struct {
+	q      *circularFileQueue
+	read   uint32
+	end    uint32
+	popped []*reservation
+	taken  []*reservation
+	dead   uint32
+	pushed uint32
+	seq    uint64
+	bytes  uint64
+	// charged is what pushes took from the disk budget, given back if the
+	// transaction doesn't commit.
+	charged uint64
+	done    bool
+}
+
+var _ Tx = (*circularTx)(nil)
+
+func (q *circularFileQueue) Begin() Tx {
+	q.wlock.Lock()
+	q.lock.Lock()
+
+	return &circularTx{q: q, read: q.read, end: q.end, seq: q.nextSeq}
+}
+
+func (tx *circularTx) Push(data []byte) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	q := tx.q
+	data, err := q.intercept(OpPush, data)
+	if err != nil {
+		return err
+	}
+	f := newFrame(Message{Data: data})
+	f.flags |= pendingFlag
+	if err := q.checkFrame(f); err != nil {
+		return err
+	}
+	if err := q.checkEntries(tx.pushed + 1); err != nil {
+		return q.life.full(err)
+	}
+	// Space released by Pop in this transaction stays reserved until
+	// commit, so a crash before then leaves the old entries intact.
+	needLen := f.length()
+	if err := q.checkQuota("", tx.pushed+1, q.usedBetween(q.end, tx.end, tx.pushed)+needLen); err != nil {
+		return err
+	}
+	if free := q.capacity - headPos - q.keptBytes() - q.usedBetween(q.start, tx.end, q.count+tx.pushed); needLen > free {
+		return q.life.full(&SpaceError{Needed: needLen, Available: free})
+	}
+	if err := q.disk.take(uint64(needLen)); err != nil {
+		return q.life.full(err)
+	}
+
+	f.seq = tx.seq
+	pos, err := q.writeFrame(tx.end, f)
+	if err != nil {
+		q.disk.give(uint64(needLen))
+		return err
+	}
+	tx.charged += uint64(needLen)
+	tx.end = pos
+	tx.seq++
+	tx.pushed++
+	tx.bytes += f.dataLength()
+
+	return nil
+}
+
+// Pop follows the order waitReady keeps without blocking, which it can't
+// while holding the lock: consumers already in line come first, so it
+// returns false while any are waiting.
+func (tx *circularTx) Pop() ([]byte, bool) {
+	q := tx.q
+	if q.closed || q.paused || len(q.line) > 0 {
+		return nil, false
+	}
+	for !tx.done && uint32(len(tx.popped)) < q.unread {
+		length, flags, err := q.frameAt(tx.read)
+		if err != nil {
+			return nil, false
+		}
+		if flags&deadFlag == 0 {
+			break
+		}
+		tx.popped = append(tx.popped, &reservation{pos: tx.read, committed: true})
+		tx.read = q.advance(tx.read, preLength+length+sufLength)
+		tx.dead++
+	}
+	if tx.done || uint32(len(tx.popped)) == q.unread {
+		return nil, false
+	}
+
+	m, pos, err := q.deliver(tx.read, OpPop)
+	if err != nil {
+		return nil, false
+	}
+	r := &reservation{pos: tx.read, seq: m.Seq, topic: m.Topic, committed: true}
+	tx.popped = append(tx.popped, r)
+	tx.taken = append(tx.taken, r)
+	tx.read = pos
+
+	return m.Data, true
+}
+
+func (tx *circularTx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	q := tx.q
+	gen, err := tx.commit()
+	q.lock.Unlock()
+	q.wlock.Unlock()
+	if err != nil || tx.pushed == 0 {
+		return err
+	}
+
+	return q.durable(gen)
+}
+
+func (tx *circularTx) commit() (uint64, error) {
+	q := tx.q
+	if q.closed {
+		q.disk.give(tx.charged)
+		return 0, ErrQueueClosed
+	}
+	if len(tx.popped) == 0 && tx.pushed == 0 {
+		return 0, nil
+	}
+	q.trackTopic("", tx.pushed, q.usedBetween(q.end, tx.end, tx.pushed))
+	q.read = tx.read
+	q.unread = q.unread - uint32(len(tx.popped)) + tx.pushed
+	q.dead -= tx.dead
+	q.inflight = append(q.inflight, tx.popped...)
+	q.end = tx.end
+	for seq := q.nextSeq; seq < tx.seq; seq++ {
+		q.emit(EventPushed, seq, "")
+	}
+	q.nextSeq = tx.seq
+	q.count += tx.pushed
+	q.life.Pushed += uint64(tx.pushed)
+	q.life.Bytes += tx.bytes
+	q.life.Popped += uint64(len(tx.taken))
+	for _, r := range tx.taken {
+		q.untrack(r.topic, r.pos)
+		q.emit(EventDelivered, r.seq, r.topic)
+		q.emit(EventAcked, r.seq, r.topic)
+	}
+	q.release()
+	if tx.pushed > 0 {
+		q.pushGen++
+	}
+	if err := q.stateChanged(); err != nil {
+		return 0, err
+	}
+	// The header write is what makes the transaction visible, so it
+	// can't be deferred.
+	if err := q.flushMeta(); err != nil {
+		return 0, err
+	}
+	if tx.pushed > 0 {
+		q.cond.Broadcast()
+	}
+
+	return q.pushGen, nil
+}
+
+func (tx *circularTx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	tx.q.disk.give(tx.charged)
+	tx.q.lock.Unlock()
+	tx.q.wlock.Unlock()
+
+	return nil
+}
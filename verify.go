@@ -0,0 +1,114 @@
+package fqueue
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Report is the outcome of checking a queue file.
+type Report struct {
+	// Entries is the number of intact entries found, removed ones
+	// included, and Bytes the space they take.
+	Entries int
+	Removed int
+	Bytes   uint32
+	// Problem describes the first inconsistency found, at file offset
+	// Offset. It is empty if there is none.
+	Problem string
+	Offset  uint32
+}
+
+func (r Report) OK() bool {
+	return r.Problem == ""
+}
+
+// Verify checks every entry between start and end: framing, lengths,
+// checksums and metadata, and that the entries end where end says.
+func (q *circularFileQueue) Verify() (Report, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if q.closed {
+		return Report{}, ErrQueueClosed
+	}
+
+	return q.verify()
+}
+
+// VerifyFile checks the queue file at path like Verify, along with its
+// header, without opening it as a queue or modifying it.
+func VerifyFile(path string) (Report, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Report{}, err
+	}
+	defer file.Close()
+
+	o := defaultOptions()
+	fresh, err := checkFile(file, &o)
+	var le *LayoutError
+	switch {
+	case errors.As(err, &le):
+		return Report{Problem: le.Reason}, nil
+	case err != nil:
+		return Report{}, err
+	case fresh:
+		return Report{Problem: "no header"}, nil
+	}
+
+	q := &circularFileQueue{name: path, opts: o, s: newFileStorage(file), capacity: o.capacity}
+	if err := q.readHeader(); errors.As(err, &le) {
+		return Report{Problem: le.Reason}, nil
+	} else if err != nil {
+		return Report{}, err
+	}
+
+	return q.verify()
+}
+
+func (q *circularFileQueue) verify() (Report, error) {
+	var rep Report
+	pos, left := q.start, q.used()
+	for i := uint32(0); i < q.count; i++ {
+		n, flags, problem, err := q.checkAt(pos, left)
+		if err != nil {
+			return rep, err
+		}
+		if problem != "" {
+			rep.Problem, rep.Offset = fmt.Sprintf("entry %d %s", i, problem), pos
+			return rep, nil
+		}
+		if flags&deadFlag != 0 {
+			rep.Removed++
+		}
+		rep.Entries++
+		rep.Bytes += n
+		pos, left = q.advance(pos, n), left-n
+	}
+	if pos != q.end {
+		rep.Problem, rep.Offset = fmt.Sprintf("%d entries end at %d, not at end %d", q.count, pos, q.end), pos
+	}
+
+	return rep, nil
+}
+
+// checkAt checks the entry at pos, which has to end within limit bytes,
+// and returns the space it takes and its flags, or what is wrong with it.
+func (q *circularFileQueue) checkAt(pos, limit uint32) (uint32, uint32, string, error) {
+	length, flags, ok, err := q.intactAt(pos, limit)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if !ok {
+		return 0, 0, "is corrupt or truncated", nil
+	}
+	if flags&metaFlag != 0 {
+		if _, err := q.metaAt(pos); errors.Is(err, ErrCorrupted) {
+			return 0, 0, "has corrupt metadata", nil
+		} else if err != nil {
+			return 0, 0, "", err
+		}
+	}
+
+	return preLength + length + sufLength, flags, "", nil
+}
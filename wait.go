@@ -0,0 +1,146 @@
+package fqueue
+
+import (
+	"context"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// wakeOnDone wakes every waiter on cond, and every consumer in line, once
+// ctx is done, so waits can check ctx.Err() after each wake-up. The
+// returned func stops watching; it may be called with the lock held.
+func (q *circularFileQueue) wakeOnDone(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			q.lock.Lock()
+			q.cond.Broadcast()
+			for _, c := range q.line {
+				c.Signal()
+			}
+			q.lock.Unlock()
+		case <-stop:
+		}
+	}()
+
+	return func() { close(stop) }
+}
+
+// available reports whether an entry can be handed out to a caller that
+// isn't in line, which is only once nobody is waiting. The caller must
+// hold the lock.
+func (q *circularFileQueue) available() bool {
+	return len(q.line) == 0 && q.ready()
+}
+
+// waitReady blocks until an entry can be handed out. Blocked consumers
+// are served in the order they started waiting, and callers don't jump
+// ahead of them, see available; only the first in line waits on cond, the
+// others on their own cond until it is their turn. It fails with
+// ErrQueueClosed once the queue is closed. The caller must hold the lock.
+func (q *circularFileQueue) waitReady() error {
+	return q.waitReadyContext(context.Background())
+}
+
+// waitReadyContext is waitReady that gives up when ctx is done.
+func (q *circularFileQueue) waitReadyContext(ctx context.Context) error {
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if q.available() {
+		return nil
+	}
+	defer q.region("fqueue.wait").End()
+	c := sync.NewCond(&q.lock)
+	q.line = append(q.line, c)
+	defer q.leave(c)
+	defer q.wakeOnDone(ctx)()
+	for {
+		if q.closed {
+			return ErrQueueClosed
+		}
+		if q.line[0] == c && q.ready() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if q.line[0] == c {
+			q.cond.Wait()
+		} else {
+			c.Wait()
+		}
+	}
+}
+
+// awaitReady waits until an entry can be handed out to a caller that isn't
+// in line, without taking it, and fails with ErrQueueClosed once the
+// queue is closed or with ctx.Err() when ctx is done first.
+func (q *circularFileQueue) awaitReady(ctx context.Context) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.wakeOnDone(ctx)()
+	for {
+		if q.closed {
+			return ErrQueueClosed
+		}
+		if q.available() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.cond.Wait()
+	}
+}
+
+// leave takes c out of line, handing the wait on cond to the next
+// consumer if c was first, or waking those waiting for the line to empty
+// if c was last.
+func (q *circularFileQueue) leave(c *sync.Cond) {
+	for i := range q.line {
+		if q.line[i] == c {
+			q.line = append(q.line[:i], q.line[i+1:]...)
+			switch {
+			case len(q.line) == 0:
+				q.cond.Broadcast()
+			case i == 0:
+				q.line[0].Signal()
+			}
+			return
+		}
+	}
+}
+
+// popContext is Pop that gives up when ctx is done, run with the queue's
+// profiler labels.
+func (q *circularFileQueue) popContext(ctx context.Context) (data []byte, err error) {
+	pprof.Do(ctx, q.labels, func(ctx context.Context) {
+		data, err = q.popLabeled(ctx)
+	})
+
+	return data, err
+}
+
+func (q *circularFileQueue) popLabeled(ctx context.Context) ([]byte, error) {
+	defer q.observe(OpPop, time.Now())
+	q.limiter.wait()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.waitReadyContext(ctx); err != nil {
+		return nil, err
+	}
+
+	r, m, err := q.next()
+	if err != nil {
+		return nil, err
+	}
+	q.logError("fqueue: persisting header failed", q.commit(r))
+
+	return m.Data, nil
+}
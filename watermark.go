@@ -0,0 +1,25 @@
+package fqueue
+
+func (q *circularFileQueue) usage() float64 {
+	return float64(q.used()) / float64(q.capacity-headPos)
+}
+
+func (q *circularFileQueue) checkWatermarks() {
+	if q.opts.highWatermark <= 0 {
+		return
+	}
+
+	u := q.usage()
+	switch {
+	case !q.aboveHWM && u >= q.opts.highWatermark:
+		q.aboveHWM = true
+		if q.opts.onHigh != nil {
+			q.opts.onHigh()
+		}
+	case q.aboveHWM && u < q.opts.lowWatermark:
+		q.aboveHWM = false
+		if q.opts.onLow != nil {
+			q.opts.onLow()
+		}
+	}
+}
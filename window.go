@@ -0,0 +1,94 @@
+package fqueue
+
+// keep adds the entries release just moved start past to the most
+// recently popped ones held back with WithReplayWindow, forgetting the
+// oldest beyond the window.
+func (q *circularFileQueue) keep(rs []*reservation) {
+	n := q.opts.replayWindow
+	if n <= 0 {
+		return
+	}
+	for _, r := range rs {
+		q.kept = append(q.kept, r.pos)
+	}
+	if extra := len(q.kept) - n; extra > 0 {
+		q.kept = append(q.kept[:0], q.kept[extra:]...)
+	}
+}
+
+// forget stops holding back popped entries, making their space free.
+func (q *circularFileQueue) forget() {
+	q.kept = q.kept[:0]
+}
+
+// keptBytes is the space between the oldest entry held back and start,
+// which pushes must leave alone.
+func (q *circularFileQueue) keptBytes() uint32 {
+	switch {
+	case len(q.kept) == 0:
+		return 0
+	case q.kept[0] == q.start:
+		// Popped entries span the whole file.
+		return q.capacity - headPos
+	default:
+		return q.distance(q.kept[0], q.start)
+	}
+}
+
+// keptIntact returns the positions of the entries held back that can
+// still be read.
+func (q *circularFileQueue) keptIntact() ([]uint32, error) {
+	var res []uint32
+	for _, pos := range q.kept {
+		_, flags, ok, err := q.intactAt(pos, q.capacity-headPos)
+		if err != nil {
+			return nil, err
+		}
+		// The blobs of consumed entries are gone.
+		if ok && flags&(deadFlag|pendingFlag|blobFlag) == 0 {
+			res = append(res, pos)
+		}
+	}
+
+	return res, nil
+}
+
+// floor is where the space that has to be preserved begins: the oldest
+// entry held back, or start.
+func (q *circularFileQueue) floor() uint32 {
+	if len(q.kept) > 0 {
+		return q.kept[0]
+	}
+
+	return q.start
+}
+
+// Replay returns up to n of the most recently popped entries held back
+// with WithReplayWindow, oldest first, without consuming anything. They
+// can be inspected or pushed again after an incident. Entries since
+// removed or damaged, and those whose data was in a blob, are left out.
+func (q *circularFileQueue) Replay(n int) ([]Message, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return nil, ErrQueueClosed
+	}
+
+	kept, err := q.keptIntact()
+	if err != nil {
+		return nil, err
+	}
+	if n < len(kept) {
+		kept = kept[len(kept)-n:]
+	}
+	res := make([]Message, 0, len(kept))
+	for _, pos := range kept {
+		m, _, err := q.deliver(pos, OpPeek)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, m)
+	}
+
+	return res, nil
+}